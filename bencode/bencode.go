@@ -1,11 +1,10 @@
 package bencode
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"reflect"
-	"slices"
-	"strconv"
 )
 
 type DataType = int
@@ -22,6 +21,10 @@ const (
 type Data struct {
 	Type  DataType
 	Value interface{}
+	// Raw is the exact source span the value was decoded from, delimiters
+	// included. It is only set by the decoder, aliases the decoded input and
+	// is not updated when the value is changed afterwards.
+	Raw []byte
 }
 
 // func NewData(t int) Data {
@@ -137,145 +140,35 @@ func (d Data) ToBytes() []byte {
 	return Encode(&d)
 }
 
+// ToJSON returns the indented, lossless JSON view of d, see DataToJSON.
 func (d Data) ToJSON() string {
-	// convert to object first, then convert to JSON
-	var val interface{}
-	switch d.Type {
-	case STRING:
-		val = d.AsString()
-	case INTEGER:
-		val = d.AsInt()
-	case LIST:
-		val = []interface{}{}
-		for _, elem := range d.AsList() {
-			val = append(val.([]interface{}), elem.ToJSON())
-		}
-	case DICT:
-		val = map[string]interface{}{}
-		for key, elem := range d.AsDict() {
-			val.(map[string]interface{})[key] = elem.ToJSON()
-		}
-	}
-
-	jsonVal, err := json.MarshalIndent(val, "", "  ")
+	jsonVal, err := DataToJSON(&d, BinaryHex)
 	if err != nil {
 		return ""
 	}
-	return string(jsonVal)
+	var out bytes.Buffer
+	if err := json.Indent(&out, jsonVal, "", "  "); err != nil {
+		return ""
+	}
+	return out.String()
 }
 
-// Takes a byte slice and returns a Data struct, count of read bytes and an error
+// Decode takes a byte slice and returns a Data struct, count of read bytes and an error.
+// It is lenient about non-canonical encodings, see DecodeOptions.
 func Decode(content []byte) (*Data, int, error) {
-	if len(content) == 0 {
-		return nil, 0, nil
-	}
-	firstByte := content[0]
-	switch firstByte {
-	case 'i': // Integer
-		// read until 'e'
-		for i := 1; i < len(content); i++ {
-			if content[i] == 'e' {
-				intStr := string(content[1:i])
-
-				fVal, err := strconv.ParseInt(intStr, 10, 64)
-				if err != nil {
-					return nil, i + 1, nil
-				}
-				return NewData(fVal), i + 1, nil
-			}
-		}
-		return NewData(nil), len(content), fmt.Errorf("invalid integer")
-	case 'l': // List
-		list := make([]*Data, 0)
-		for i := 1; i < len(content); i++ {
-			if content[i] == 'e' {
-				return NewData(list), i + 1, nil
-			}
-			elem, count, err := Decode(content[i:])
-			if err != nil {
-				return NewData(list), count, err
-			}
-			list = append(list, elem)
-			i += count - 1
-		}
-		return NewData(list), len(content), fmt.Errorf("invalid list")
-
-	case 'd': // Dictionary
-		dict := make(map[string]*Data)
-		for i := 1; i < len(content); i++ {
-			if content[i] == 'e' {
-				return NewData(dict), i + 1, nil
-			}
-			key, count, err := Decode(content[i:])
-			if err != nil {
-				return NewData(dict), count, err
-			}
-			if key.Type != STRING {
-				return NewData(dict), count, fmt.Errorf("invalid dictionary key")
-			}
-			// if key.AsString() == "pieces" {
-			// 	fmt.Printf("pieces\n")
-			// }
-			i += count
-			val, count, err := Decode(content[i:])
-			if err != nil {
-				return NewData(dict), count, err
-			}
-			i += count - 1
-
-			dict[key.AsString()] = val
-		}
-		return NewData(dict), len(content), fmt.Errorf("invalid dictionary")
-	default: // String
-		// read until ':'
-		for i := 0; i < len(content); i++ {
-			if content[i] == ':' {
-				strLen, err := strconv.Atoi(string(content[:i]))
-				if err != nil {
-					return nil, i + 1, fmt.Errorf("invalid string length")
-				}
-				strVal := content[i+1 : i+1+strLen]
-
-				return NewData(strVal), i + 1 + strLen, nil
-			}
-		}
-		return nil, len(content), fmt.Errorf("invalid string")
+	return DecodeOptions{}.Decode(content)
+}
 
-	}
+// DecodeStrict is like Decode but rejects anything that is not the canonical encoding.
+func DecodeStrict(content []byte) (*Data, int, error) {
+	return DecodeOptions{Strict: true}.Decode(content)
 }
 
+// Encode returns the bencode encoding of data. Dictionary keys are written in
+// lexical order as the specification requires.
 func Encode(data *Data) []byte {
-	switch data.Type {
-	case STRING:
-		str := data.AsString()
-		return []byte(fmt.Sprintf("%d:%s", len(str), str))
-	case INTEGER:
-		return []byte(fmt.Sprintf("i%de", data.Value))
-	case LIST:
-		list := data.AsList()
-		encoded := []byte("l")
-		for _, elem := range list {
-			encoded = append(encoded, Encode(elem)...)
-		}
-		encoded = append(encoded, 'e')
-		return encoded
-	case DICT:
-		dict := data.AsDict()
-		encoded := []byte("d")
-		// sort keys in lexical order
-		keys := make([]string, 0, len(dict))
-		for key := range dict {
-			keys = append(keys, key)
-		}
-		slices.Sort(keys)
-
-		for _, key := range keys {
-			encoded = append(encoded, Encode(NewData(key))...)
-			encoded = append(encoded, Encode(dict[key])...)
-		}
-		encoded = append(encoded, 'e')
-		return encoded
-	default:
-		return []byte{}
-	}
+	var buf bytes.Buffer
+	e := &encodeState{w: &buf}
+	e.writeData(data)
+	return buf.Bytes()
 }
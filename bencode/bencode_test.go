@@ -1,6 +1,7 @@
 package bencode
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 )
@@ -59,7 +60,7 @@ func TestDecode(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			got, _, err := Decode(tt.content)
-			if !reflect.DeepEqual(got, tt.want) {
+			if !reflect.DeepEqual(stripRaw(got), tt.want) {
 				t.Errorf("Decode() got = %s, want %s", got.String(), tt.want.String())
 			}
 			if err != tt.wantErr {
@@ -112,3 +113,162 @@ func TestEncode(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    []byte
+		strict     bool
+		wantOffset int64
+	}{
+		{name: "Truncated string", content: []byte("10:spam"), wantOffset: 0},
+		{name: "Truncated string in list", content: []byte("l4:spam9:eggse"), wantOffset: 7},
+		{name: "Invalid integer", content: []byte("i4x2e"), wantOffset: 1},
+		{name: "Empty integer", content: []byte("ie"), wantOffset: 1},
+		{name: "Unterminated integer", content: []byte("i42"), wantOffset: 0},
+		{name: "Unterminated list", content: []byte("l4:spam"), wantOffset: 7},
+		{name: "Integer key", content: []byte("di1e3:fooe"), wantOffset: 1},
+		{name: "Missing value", content: []byte("d3:fooe"), wantOffset: 6},
+		{name: "Invalid character", content: []byte("x"), wantOffset: 0},
+		{name: "Leading zero", content: []byte("i042e"), strict: true, wantOffset: 1},
+		{name: "Negative zero", content: []byte("i-0e"), strict: true, wantOffset: 1},
+		{name: "Plus sign", content: []byte("i+1e"), strict: true, wantOffset: 1},
+		{name: "String length leading zero", content: []byte("04:spam"), strict: true, wantOffset: 0},
+		{name: "Unsorted keys", content: []byte("d4:spami1e3:cowi2ee"), strict: true, wantOffset: 10},
+		{name: "Duplicate keys", content: []byte("d3:cowi1e3:cowi2ee"), strict: true, wantOffset: 9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := DecodeOptions{Strict: tt.strict}.Decode(tt.content)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Decode() error = %v, want *SyntaxError", err)
+			}
+			if syntaxErr.Offset != tt.wantOffset {
+				t.Errorf("Decode() error offset = %d, want %d (%v)", syntaxErr.Offset, tt.wantOffset, err)
+			}
+		})
+	}
+}
+
+func TestDecodeLenient(t *testing.T) {
+	// non-canonical input seen in the wild is still accepted outside strict mode
+	tests := []struct {
+		name    string
+		content []byte
+		want    *Data
+	}{
+		{name: "Leading zero", content: []byte("i042e"), want: NewData(42)},
+		{name: "Negative zero", content: []byte("i-0e"), want: NewData(0)},
+		{name: "Unsorted keys", content: []byte("d4:spami1e3:cowi2ee"), want: NewData(map[string]any{"spam": 1, "cow": 2})},
+		{name: "Duplicate keys", content: []byte("d3:cowi1e3:cowi2ee"), want: NewData(map[string]any{"cow": 2})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := Decode(tt.content)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(stripRaw(got), tt.want) {
+				t.Errorf("Decode() got = %s, want %s", got.String(), tt.want.String())
+			}
+			if _, _, err := DecodeStrict(tt.content); err == nil {
+				t.Errorf("DecodeStrict() accepted %q", tt.content)
+			}
+		})
+	}
+}
+
+func TestDecodeRaw(t *testing.T) {
+	// unsorted and non-canonical on purpose, Raw must keep the bytes as they were
+	content := []byte("d4:spami042e4:infod6:lengthi1e4:name1:aee")
+	got, _, err := Decode(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Raw) != string(content) {
+		t.Errorf("Raw got = %s, want %s", got.Raw, content)
+	}
+	dict := got.AsDict()
+	if want := "i042e"; string(dict["spam"].Raw) != want {
+		t.Errorf("Raw of spam got = %s, want %s", dict["spam"].Raw, want)
+	}
+	if want := "d6:lengthi1e4:name1:ae"; string(dict["info"].Raw) != want {
+		t.Errorf("Raw of info got = %s, want %s", dict["info"].Raw, want)
+	}
+	if want := "1:a"; string(dict["info"].AsDict()["name"].Raw) != want {
+		t.Errorf("Raw of name got = %s, want %s", dict["info"].AsDict()["name"].Raw, want)
+	}
+}
+
+// stripRaw clears the source spans recorded by the decoder so decoded values
+// can be compared with ones built by NewData.
+func stripRaw(d *Data) *Data {
+	if d == nil {
+		return nil
+	}
+	d.Raw = nil
+	switch d.Type {
+	case LIST:
+		for _, elem := range d.AsList() {
+			stripRaw(elem)
+		}
+	case DICT:
+		for _, elem := range d.AsDict() {
+			stripRaw(elem)
+		}
+	}
+	return d
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data *Data
+		want string
+	}{
+		{name: "Text", data: NewData("spam"), want: `"spam"`},
+		{name: "Binary", data: NewData([]byte{0x00, 0xff, 0x10}), want: `{"$hex":"00ff10"}`},
+		{name: "Integer", data: NewData(-42), want: `-42`},
+		{
+			name: "Nested",
+			data: NewData(map[string]any{"peers": []byte{127, 0, 0, 1, 0x1a, 0xe1}, "list": []any{"a", 1}}),
+			want: `{"list":["a",1],"peers":{"$hex":"7f0000011ae1"}}`,
+		},
+		{
+			name: "Escaped keys",
+			data: NewData(map[string]any{"$hex": "not binary", "\xff\x00": 1}),
+			want: `{"$$hex":"not binary","$hex:ff00":1}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DataToJSON(tt.data, BinaryHex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("DataToJSON() got = %s, want %s", got, tt.want)
+			}
+			back, err := DataFromJSON(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(Encode(back), Encode(tt.data)) {
+				t.Errorf("DataFromJSON() got = %s, want %s", Encode(back), Encode(tt.data))
+			}
+		})
+	}
+
+	// base64 is accepted on the way back as well
+	back, err := DataFromJSON([]byte(`{"$base64":"AP8Q"}`))
+	if err != nil || !reflect.DeepEqual(back.AsBytes(), []byte{0x00, 0xff, 0x10}) {
+		t.Errorf("DataFromJSON(base64) got = %v, error = %v", back, err)
+	}
+	if _, err := DataFromJSON([]byte(`{"$other":1}`)); err == nil {
+		t.Errorf("DataFromJSON() accepted an unescaped $ key")
+	}
+}
@@ -0,0 +1,297 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// SyntaxError describes malformed or, in strict mode, non-canonical bencode.
+type SyntaxError struct {
+	Offset int64  // byte offset in the input where the problem was found
+	Msg    string // description of the problem
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: syntax error at offset %d: %s", e.Offset, e.Msg)
+}
+
+// LimitError is returned when input exceeds one of the configured Limits.
+type LimitError struct {
+	Offset int64  // byte offset in the input where the limit was hit
+	Msg    string // which limit was exceeded
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("bencode: limit exceeded at offset %d: %s", e.Offset, e.Msg)
+}
+
+// Limits bounds the resources spent decoding a single value, so hostile input
+// cannot exhaust the stack or memory. A zero field disables that limit.
+type Limits struct {
+	MaxDepth        int   // nesting depth of lists and dictionaries
+	MaxStringLength int64 // length of a single string
+	MaxElements     int   // total number of values, containers included
+	MaxInputSize    int64 // size of the encoded value
+}
+
+// DefaultLimits are used when DecodeOptions.Limits is nil. They are generous
+// enough for .torrent files with hundreds of thousands of pieces and files.
+var DefaultLimits = Limits{
+	MaxDepth:        256,
+	MaxStringLength: 128 << 20,
+	MaxElements:     4 << 20,
+	MaxInputSize:    256 << 20,
+}
+
+// DecodeOptions controls how bencode input is parsed.
+type DecodeOptions struct {
+	// Strict rejects anything but the canonical encoding: integers with
+	// leading zeros or "-0", string lengths with leading zeros, and
+	// dictionaries whose keys are not unique and sorted. Without it those are
+	// accepted, and the last value wins for duplicate keys.
+	Strict bool
+	// Limits bounds the decoded value, DefaultLimits is used when nil.
+	Limits *Limits
+}
+
+func (o DecodeOptions) limits() *Limits {
+	if o.Limits == nil {
+		return &DefaultLimits
+	}
+	return o.Limits
+}
+
+// Decode parses the first bencode value in content using the options in o.
+// It returns the value, the count of bytes read and an error, which is a
+// *SyntaxError for malformed input and a *LimitError for input over the
+// limits. Empty content returns nil, 0, nil.
+func (o DecodeOptions) Decode(content []byte) (*Data, int, error) {
+	if len(content) == 0 {
+		return nil, 0, nil
+	}
+	d := &decodeState{data: content, opts: o, limits: o.limits()}
+	if max := d.limits.MaxInputSize; max > 0 && int64(len(content)) > max {
+		return nil, 0, &LimitError{Offset: max, Msg: fmt.Sprintf("input size %d exceeds %d bytes", len(content), max)}
+	}
+	val, err := d.value()
+	if err != nil {
+		return nil, d.off, err
+	}
+	return val, d.off, nil
+}
+
+// Unmarshal is like the package level Unmarshal but parses b using the options in o.
+func (o DecodeOptions) Unmarshal(b []byte, v any) error {
+	return unmarshal(o, b, v)
+}
+
+// decodeState walks a complete bencode value held in memory.
+type decodeState struct {
+	data     []byte
+	off      int
+	opts     DecodeOptions
+	limits   *Limits
+	depth    int
+	elements int
+}
+
+func (d *decodeState) syntaxError(off int, format string, args ...any) error {
+	return &SyntaxError{Offset: int64(off), Msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *decodeState) value() (*Data, error) {
+	if d.off >= len(d.data) {
+		return nil, d.syntaxError(d.off, "unexpected end of input")
+	}
+	start := d.off
+	d.elements++
+	if max := d.limits.MaxElements; max > 0 && d.elements > max {
+		return nil, &LimitError{Offset: int64(start), Msg: fmt.Sprintf("more than %d elements", max)}
+	}
+	var val *Data
+	var err error
+	switch c := d.data[d.off]; {
+	case c == 'i':
+		val, err = d.integer()
+	case c == 'l':
+		val, err = d.list()
+	case c == 'd':
+		val, err = d.dict()
+	case c >= '0' && c <= '9':
+		var str []byte
+		str, err = d.string()
+		if err == nil {
+			val = NewData(str)
+		}
+	default:
+		return nil, d.syntaxError(d.off, "invalid character %q looking for beginning of value", c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	val.Raw = d.data[start:d.off:d.off]
+	return val, nil
+}
+
+func (d *decodeState) integer() (*Data, error) {
+	start := d.off
+	end := bytes.IndexByte(d.data[start:], 'e')
+	if end < 0 {
+		return nil, d.syntaxError(start, "unterminated integer")
+	}
+	digits := d.data[start+1 : start+end]
+	n, reason := parseInteger(digits, d.opts.Strict)
+	if reason != "" {
+		return nil, d.syntaxError(start+1, "%s %q", reason, digits)
+	}
+	d.off = start + end + 1
+	return NewData(n), nil
+}
+
+func (d *decodeState) string() ([]byte, error) {
+	start := d.off
+	colon := bytes.IndexByte(d.data[start:], ':')
+	if colon < 0 {
+		return nil, d.syntaxError(start, "missing ':' after string length")
+	}
+	length, reason := parseLength(d.data[start:start+colon], d.opts.Strict)
+	if reason != "" {
+		return nil, d.syntaxError(start, "%s %q", reason, d.data[start:start+colon])
+	}
+	begin := start + colon + 1
+	if max := d.limits.MaxStringLength; max > 0 && length > max {
+		return nil, &LimitError{Offset: int64(start), Msg: fmt.Sprintf("string length %d exceeds %d bytes", length, max)}
+	}
+	if length > int64(len(d.data)-begin) {
+		return nil, d.syntaxError(start, "string length %d exceeds remaining input of %d bytes", length, len(d.data)-begin)
+	}
+	d.off = begin + int(length)
+	return d.data[begin:d.off], nil
+}
+
+// enter records that a list or dictionary was opened, enforcing MaxDepth.
+func (d *decodeState) enter() error {
+	d.depth++
+	if max := d.limits.MaxDepth; max > 0 && d.depth > max {
+		return &LimitError{Offset: int64(d.off), Msg: fmt.Sprintf("nesting deeper than %d", max)}
+	}
+	return nil
+}
+
+func (d *decodeState) list() (*Data, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+	d.off++ // 'l'
+	list := make([]*Data, 0)
+	for {
+		if d.off >= len(d.data) {
+			return nil, d.syntaxError(d.off, "unterminated list")
+		}
+		if d.data[d.off] == 'e' {
+			d.off++
+			return NewData(list), nil
+		}
+		elem, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+}
+
+func (d *decodeState) dict() (*Data, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+	d.off++ // 'd'
+	dict := make(map[string]*Data)
+	var prevKey []byte
+	for i := 0; ; i++ {
+		if d.off >= len(d.data) {
+			return nil, d.syntaxError(d.off, "unterminated dictionary")
+		}
+		c := d.data[d.off]
+		if c == 'e' {
+			d.off++
+			return NewData(dict), nil
+		}
+		if c < '0' || c > '9' {
+			return nil, d.syntaxError(d.off, "dictionary key must be a string")
+		}
+		keyOff := d.off
+		key, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		if d.opts.Strict && i > 0 {
+			if cmp := bytes.Compare(prevKey, key); cmp == 0 {
+				return nil, d.syntaxError(keyOff, "duplicate dictionary key %q", key)
+			} else if cmp > 0 {
+				return nil, d.syntaxError(keyOff, "dictionary key %q is not sorted after %q", key, prevKey)
+			}
+		}
+		prevKey = key
+		if d.off >= len(d.data) || d.data[d.off] == 'e' {
+			return nil, d.syntaxError(d.off, "missing value for dictionary key %q", key)
+		}
+		val, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		dict[string(key)] = val
+	}
+}
+
+// parseInteger parses the digits between 'i' and 'e'. It returns a non-empty
+// reason when the digits are invalid, or not canonical in strict mode.
+func parseInteger(digits []byte, strict bool) (int64, string) {
+	if len(digits) == 0 {
+		return 0, "empty integer"
+	}
+	if strict {
+		neg := digits[0] == '-'
+		body := digits
+		if neg {
+			body = digits[1:]
+		}
+		if len(body) == 0 || !isDigits(body) {
+			return 0, "invalid integer"
+		}
+		if body[0] == '0' && (len(body) > 1 || neg) {
+			return 0, "non-canonical integer"
+		}
+	}
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, "invalid integer"
+	}
+	return n, ""
+}
+
+// parseLength parses a string length prefix.
+func parseLength(digits []byte, strict bool) (int64, string) {
+	if len(digits) == 0 || !isDigits(digits) {
+		return 0, "invalid string length"
+	}
+	if strict && digits[0] == '0' && len(digits) > 1 {
+		return 0, "non-canonical string length"
+	}
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, "invalid string length"
+	}
+	return n, ""
+}
+
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
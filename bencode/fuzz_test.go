@@ -0,0 +1,142 @@
+package bencode
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fuzzSeeds returns the inputs of the table tests plus the sample torrents.
+func fuzzSeeds(f *testing.F) {
+	seeds := []string{
+		"", "4:spam", "i42e", "i-42e", "i-0e", "i042e", "le", "de",
+		"l4:spam4:eggse", "l4:spaml1:a1:bee", "d3:cow3:moo4:spam4:eggs3:numi42ee",
+		"d4:spami1e3:cowi2ee", "d3:cowi1e3:cowi2ee", "10:spam", "llllllllee", "di1ei2ee",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	files, _ := filepath.Glob("../example/*.torrent")
+	for _, file := range files {
+		if content, err := os.ReadFile(file); err == nil {
+			f.Add(content)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, content []byte) {
+		data, n, err := Decode(content)
+		if err != nil || data == nil {
+			return
+		}
+		if n > len(content) {
+			t.Fatalf("Decode() read %d bytes of %d", n, len(content))
+		}
+		if !bytes.Equal(data.Raw, content[:n]) {
+			t.Fatalf("Raw %q does not match consumed input %q", data.Raw, content[:n])
+		}
+
+		// whatever the lenient decoder accepts must re-encode canonically
+		encoded := Encode(data)
+		again, m, err := DecodeStrict(encoded)
+		if err != nil {
+			t.Fatalf("DecodeStrict(Encode(%q)) error = %v", content[:n], err)
+		}
+		if m != len(encoded) || !bytes.Equal(Encode(again), encoded) {
+			t.Fatalf("re-encoding %q is not stable", encoded)
+		}
+
+		// canonical input must round-trip byte for byte
+		if _, _, err := DecodeStrict(content[:n]); err == nil && !bytes.Equal(encoded, content[:n]) {
+			t.Fatalf("canonical input %q re-encoded as %q", content[:n], encoded)
+		}
+	})
+}
+
+func FuzzDecoder(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, content []byte) {
+		limits := Limits{MaxDepth: 16, MaxStringLength: 1 << 10, MaxElements: 1 << 10, MaxInputSize: 4 << 10}
+		opts := DecodeOptions{Limits: &limits}
+
+		dec := NewDecoder(bytes.NewReader(content))
+		dec.SetOptions(opts)
+		for i := 0; i < 1<<12; i++ {
+			if _, err := dec.Token(); err != nil {
+				break
+			}
+		}
+
+		dec = NewDecoder(bytes.NewReader(content))
+		dec.SetOptions(opts)
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		var w any
+		encoded, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal(%v) error = %v", v, err)
+		}
+		if err := Unmarshal(encoded, &w); err != nil {
+			t.Fatalf("Unmarshal(Marshal(%v)) error = %v", v, err)
+		}
+	})
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, content []byte) {
+		var meta struct {
+			Announce     string     `bencode:"announce"`
+			AnnounceList [][]string `bencode:"announce-list"`
+			Info         *testInfo  `bencode:"info"`
+			Raw          RawMessage `bencode:"raw"`
+			Date         *uint32    `bencode:"creation date"`
+		}
+		_ = Unmarshal(content, &meta)
+	})
+}
+
+func TestDecodeLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		limits  Limits
+	}{
+		{name: "Depth", content: strings.Repeat("l", 5) + strings.Repeat("e", 5), limits: Limits{MaxDepth: 4}},
+		{name: "String length", content: "5:spams", limits: Limits{MaxStringLength: 4}},
+		{name: "Elements", content: "li1ei2ei3ee", limits: Limits{MaxElements: 3}},
+		{name: "Input size", content: "4:spam", limits: Limits{MaxInputSize: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DecodeOptions{Limits: &tt.limits}
+			if _, _, err := opts.Decode([]byte(tt.content)); !isLimitError(err) {
+				t.Errorf("Decode() error = %v, want *LimitError", err)
+			}
+			dec := NewDecoder(strings.NewReader(tt.content))
+			dec.SetOptions(opts)
+			var v any
+			if err := dec.Decode(&v); !isLimitError(err) {
+				t.Errorf("Decoder.Decode() error = %v, want *LimitError", err)
+			}
+		})
+	}
+
+	// the default limits stop runaway nesting before the stack does
+	deep := strings.Repeat("l", DefaultLimits.MaxDepth+1) + strings.Repeat("e", DefaultLimits.MaxDepth+1)
+	if _, _, err := Decode([]byte(deep)); !isLimitError(err) {
+		t.Errorf("Decode() error = %v, want *LimitError", err)
+	}
+}
+
+func isLimitError(err error) bool {
+	_, ok := err.(*LimitError)
+	return ok
+}
@@ -0,0 +1,264 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// The JSON view of bencode is lossless in both directions:
+//
+//   - integers are JSON numbers, lists are arrays and dictionaries are objects
+//   - strings that are printable UTF-8 are JSON strings, every other string is
+//     an object with a single "$hex" or "$base64" member holding its bytes
+//   - dictionary keys starting with "$" are escaped by doubling the "$", and
+//     keys that are not UTF-8 are written as "$hex:" followed by their bytes
+//
+// Because real keys never start with a single "$" once escaped, a tagged
+// binary string can never be confused with a dictionary.
+const (
+	jsonHexTag    = "$hex"
+	jsonBase64Tag = "$base64"
+	jsonKeyHex    = "$hex:"
+)
+
+// BinaryEncoding selects how DataToJSON writes strings that are not text.
+type BinaryEncoding int
+
+const (
+	BinaryHex BinaryEncoding = iota
+	BinaryBase64
+)
+
+// DataToJSON converts data to its lossless JSON view, see DataFromJSON for
+// the way back.
+func DataToJSON(data *Data, enc BinaryEncoding) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, data, enc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DataFromJSON converts the JSON view produced by DataToJSON back into bencode data.
+func DataFromJSON(b []byte) (*Data, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("bencode: trailing data after JSON value")
+	}
+	return dataFromJSONValue(v, "")
+}
+
+// MarshalJSON implements json.Marshaler using the lossless JSON view with hex
+// encoded binary strings.
+func (d Data) MarshalJSON() ([]byte, error) {
+	return DataToJSON(&d, BinaryHex)
+}
+
+// UnmarshalJSON implements json.Unmarshaler for the view written by MarshalJSON.
+func (d *Data) UnmarshalJSON(b []byte) error {
+	data, err := DataFromJSON(b)
+	if err != nil {
+		return err
+	}
+	*d = *data
+	return nil
+}
+
+// isText reports whether b can be shown as a JSON string without hiding
+// binary data behind escape sequences.
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == utf8.RuneError || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonKey(key string) string {
+	if !utf8.ValidString(key) {
+		return jsonKeyHex + hex.EncodeToString([]byte(key))
+	}
+	if strings.HasPrefix(key, "$") {
+		return "$" + key
+	}
+	return key
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+func writeJSON(buf *bytes.Buffer, data *Data, enc BinaryEncoding) error {
+	switch data.Type {
+	case STRING:
+		b := data.AsBytes()
+		if isText(b) {
+			writeJSONString(buf, string(b))
+			return nil
+		}
+		buf.WriteByte('{')
+		if enc == BinaryBase64 {
+			writeJSONString(buf, jsonBase64Tag)
+			buf.WriteByte(':')
+			writeJSONString(buf, base64.StdEncoding.EncodeToString(b))
+		} else {
+			writeJSONString(buf, jsonHexTag)
+			buf.WriteByte(':')
+			writeJSONString(buf, hex.EncodeToString(b))
+		}
+		buf.WriteByte('}')
+	case INTEGER:
+		fmt.Fprintf(buf, "%d", data.AsInt())
+	case LIST:
+		buf.WriteByte('[')
+		for i, elem := range data.AsList() {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, elem, enc); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case DICT:
+		dict := data.AsDict()
+		keys := make([]string, 0, len(dict))
+		for key := range dict {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, jsonKey(key))
+			buf.WriteByte(':')
+			if err := writeJSON(buf, dict[key], enc); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("bencode: cannot convert invalid value to JSON")
+	}
+	return nil
+}
+
+func dataFromJSONValue(v any, path string) (*Data, error) {
+	switch val := v.(type) {
+	case string:
+		return NewData(val), nil
+	case json.Number:
+		n, err := val.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("bencode: %s: %s is not an integer", jsonPath(path), val)
+		}
+		return NewData(n), nil
+	case []any:
+		list := make([]*Data, len(val))
+		for i, elem := range val {
+			d, err := dataFromJSONValue(elem, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = d
+		}
+		return NewData(list), nil
+	case map[string]any:
+		if len(val) == 1 {
+			if b, ok, err := taggedBinary(val, path); ok || err != nil {
+				if err != nil {
+					return nil, err
+				}
+				return NewData(b), nil
+			}
+		}
+		dict := make(map[string]*Data, len(val))
+		for jsonKey, elem := range val {
+			key, err := keyFromJSON(jsonKey, path)
+			if err != nil {
+				return nil, err
+			}
+			d, err := dataFromJSONValue(elem, joinPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = d
+		}
+		return NewData(dict), nil
+	case bool:
+		if val {
+			return NewData(1), nil
+		}
+		return NewData(0), nil
+	default:
+		return nil, fmt.Errorf("bencode: %s: %v has no bencode representation", jsonPath(path), v)
+	}
+}
+
+// taggedBinary decodes a {"$hex": ...} or {"$base64": ...} object.
+func taggedBinary(obj map[string]any, path string) ([]byte, bool, error) {
+	for tag, v := range obj {
+		if tag != jsonHexTag && tag != jsonBase64Tag {
+			return nil, false, nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, true, fmt.Errorf("bencode: %s: %s must be a string", jsonPath(path), tag)
+		}
+		var b []byte
+		var err error
+		if tag == jsonHexTag {
+			b, err = hex.DecodeString(s)
+		} else {
+			b, err = base64.StdEncoding.DecodeString(s)
+		}
+		if err != nil {
+			return nil, true, fmt.Errorf("bencode: %s: invalid %s value: %w", jsonPath(path), tag, err)
+		}
+		return b, true, nil
+	}
+	return nil, false, nil
+}
+
+func keyFromJSON(key, path string) (string, error) {
+	switch {
+	case !strings.HasPrefix(key, "$"):
+		return key, nil
+	case strings.HasPrefix(key, "$$"):
+		return key[1:], nil
+	case strings.HasPrefix(key, jsonKeyHex):
+		b, err := hex.DecodeString(key[len(jsonKeyHex):])
+		if err != nil {
+			return "", fmt.Errorf("bencode: %s: invalid binary key %q: %w", jsonPath(path), key, err)
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("bencode: %s: key %q must be escaped as %q", jsonPath(path), key, "$"+key)
+	}
+}
+
+func jsonPath(path string) string {
+	if path == "" {
+		return "top-level value"
+	}
+	return path
+}
@@ -0,0 +1,371 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Marshaler is implemented by types that can encode themselves into valid bencode.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// UnsupportedTypeError is returned by Marshal when asked to encode a Go type
+// that has no bencode representation (floats, channels, functions, ...).
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+// UnsupportedValueError is returned by Marshal when asked to encode a value
+// that cannot be represented, such as a nil pointer inside a list.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "bencode: unsupported value: " + e.Str
+}
+
+// MarshalerError wraps an error returned by a MarshalBencode method.
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return "bencode: error calling MarshalBencode for type " + e.Type.String() + ": " + e.Err.Error()
+}
+
+func (e *MarshalerError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	dataType      = reflect.TypeOf(Data{})
+	rawType       = reflect.TypeOf(RawMessage(nil))
+)
+
+// Marshal returns the bencode encoding of v.
+//
+// Structs are encoded as dictionaries whose keys are taken from the
+// `bencode:"name,omitempty"` field tag, or the field name when no tag is set.
+// A tag of "-" skips the field. Nil pointers and interfaces inside structs and
+// maps are omitted since bencode has no null value. Booleans are encoded as
+// i1e/i0e, byte slices and byte arrays as strings, and *Data, Data and
+// RawMessage values are written as they are.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	e := &encodeState{w: &buf}
+	if err := e.marshal(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writer is satisfied by both *bytes.Buffer and *bufio.Writer. Neither of them
+// needs its write errors checked on every call: bytes.Buffer never fails and
+// bufio.Writer keeps the first error and reports it on Flush.
+type writer interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// encodeState writes bencode straight into w without building intermediate strings.
+type encodeState struct {
+	w       writer
+	scratch [64]byte
+}
+
+func (e *encodeState) writeInt(i int64) {
+	e.w.WriteByte('i')
+	e.w.Write(strconv.AppendInt(e.scratch[:0], i, 10))
+	e.w.WriteByte('e')
+}
+
+func (e *encodeState) writeUint(u uint64) {
+	e.w.WriteByte('i')
+	e.w.Write(strconv.AppendUint(e.scratch[:0], u, 10))
+	e.w.WriteByte('e')
+}
+
+func (e *encodeState) writeString(s string) {
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(len(s)), 10))
+	e.w.WriteByte(':')
+	e.w.WriteString(s)
+}
+
+func (e *encodeState) writeBytes(b []byte) {
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(len(b)), 10))
+	e.w.WriteByte(':')
+	e.w.Write(b)
+}
+
+// writeData writes an already built Data tree, sorting dictionary keys.
+func (e *encodeState) writeData(data *Data) {
+	switch data.Type {
+	case STRING:
+		e.writeBytes(data.AsBytes())
+	case INTEGER:
+		e.writeInt(data.AsInt())
+	case LIST:
+		e.w.WriteByte('l')
+		for _, elem := range data.AsList() {
+			e.writeData(elem)
+		}
+		e.w.WriteByte('e')
+	case DICT:
+		dict := data.AsDict()
+		// sort keys in lexical order
+		keys := make([]string, 0, len(dict))
+		for key := range dict {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		e.w.WriteByte('d')
+		for _, key := range keys {
+			e.writeString(key)
+			e.writeData(dict[key])
+		}
+		e.w.WriteByte('e')
+	}
+}
+
+func (e *encodeState) marshal(v reflect.Value) error {
+	if !v.IsValid() {
+		return &UnsupportedValueError{Str: "nil"}
+	}
+
+	t := v.Type()
+	if t == rawType {
+		raw := v.Bytes()
+		if len(raw) == 0 {
+			return &UnsupportedValueError{Value: v, Str: "empty RawMessage"}
+		}
+		e.w.Write(raw)
+		return nil
+	}
+	if t == dataType {
+		d := v.Interface().(Data)
+		e.writeData(&d)
+		return nil
+	}
+	if t.Implements(marshalerType) && !(t.Kind() == reflect.Pointer && v.IsNil()) {
+		b, err := v.Interface().(Marshaler).MarshalBencode()
+		if err != nil {
+			return &MarshalerError{Type: t, Err: err}
+		}
+		e.w.Write(b)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.writeInt(1)
+		} else {
+			e.writeInt(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			e.writeBytes(v.Bytes())
+			return nil
+		}
+		return e.marshalList(v)
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.writeBytes(b)
+			return nil
+		}
+		return e.marshalList(v)
+	case reflect.Map:
+		return e.marshalMap(v)
+	case reflect.Struct:
+		return e.marshalStruct(v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &UnsupportedValueError{Value: v, Str: "nil " + t.String()}
+		}
+		return e.marshal(v.Elem())
+	default:
+		return &UnsupportedTypeError{Type: t}
+	}
+	return nil
+}
+
+func (e *encodeState) marshalList(v reflect.Value) error {
+	e.w.WriteByte('l')
+	for i := 0; i < v.Len(); i++ {
+		if err := e.marshal(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	e.w.WriteByte('e')
+	return nil
+}
+
+func (e *encodeState) marshalMap(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	keys := make([]string, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		keys = append(keys, iter.Key().String())
+	}
+	slices.Sort(keys)
+
+	e.w.WriteByte('d')
+	for _, key := range keys {
+		elem := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+		if isNilValue(elem) {
+			continue
+		}
+		e.writeString(key)
+		if err := e.marshal(elem); err != nil {
+			return err
+		}
+	}
+	e.w.WriteByte('e')
+	return nil
+}
+
+func (e *encodeState) marshalStruct(v reflect.Value) error {
+	e.w.WriteByte('d')
+	for _, f := range cachedFields(v.Type()) {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || isNilValue(fv) {
+			continue
+		}
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		e.writeString(f.name)
+		if err := e.marshal(fv); err != nil {
+			return err
+		}
+	}
+	e.w.WriteByte('e')
+	return nil
+}
+
+// field describes a struct field that takes part in encoding.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the bencode fields of t sorted by key, which is the
+// order bencode requires for dictionary keys.
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	fields := typeFields(t, nil)
+	slices.SortStableFunc(fields, func(a, b field) int {
+		return strings.Compare(a.name, b.name)
+	})
+	// keep only the first field for a given name, outer fields win over embedded ones
+	fields = slices.CompactFunc(fields, func(a, b field) bool {
+		return a.name == b.name
+	})
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.([]field)
+}
+
+func typeFields(t reflect.Type, parent []int) []field {
+	fields := make([]field, 0, t.NumField())
+	var embedded []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		index := append(slices.Clone(parent), i)
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			embedded = append(embedded, typeFields(ft, index)...)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{
+			name:      name,
+			index:     index,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	return append(fields, embedded...)
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but reports false instead of
+// panicking when it has to step through a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
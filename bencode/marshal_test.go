@@ -0,0 +1,170 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+	MD5Sum string   `bencode:"md5sum,omitempty"`
+}
+
+type testInfo struct {
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Private     bool       `bencode:"private,omitempty"`
+	Files       []testFile `bencode:"files,omitempty"`
+}
+
+type testMetainfo struct {
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	CreationDate *int64     `bencode:"creation date,omitempty"`
+	Info         RawMessage `bencode:"info"`
+	Ignored      string     `bencode:"-"`
+}
+
+func TestMarshal(t *testing.T) {
+	date := int64(1714777334)
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{name: "String", v: "spam", want: "4:spam"},
+		{name: "Bytes", v: []byte("eggs"), want: "4:eggs"},
+		{name: "Byte array", v: [3]byte{'a', 'b', 'c'}, want: "3:abc"},
+		{name: "Int", v: -42, want: "i-42e"},
+		{name: "Uint64", v: uint64(18446744073709551615), want: "i18446744073709551615e"},
+		{name: "Bool", v: true, want: "i1e"},
+		{name: "List", v: []any{"spam", 42}, want: "l4:spami42ee"},
+		{name: "Map sorted", v: map[string]int{"b": 2, "a": 1}, want: "d1:ai1e1:bi2ee"},
+		{name: "Data", v: NewData(map[string]any{"cow": "moo"}), want: "d3:cow3:mooe"},
+		{
+			name: "Struct with tags",
+			v: testInfo{
+				Name:        "a.txt",
+				PieceLength: 16384,
+				Pieces:      []byte("01234567890123456789"),
+				Files:       []testFile{{Length: 3, Path: []string{"dir", "a.txt"}}},
+			},
+			want: "d5:filesld6:lengthi3e4:pathl3:dir5:a.txteee4:name5:a.txt12:piece lengthi16384e6:pieces20:01234567890123456789e",
+		},
+		{
+			name: "Struct with raw message and pointer",
+			v: testMetainfo{
+				Announce:     "http://tracker/announce",
+				CreationDate: &date,
+				Info:         RawMessage("d4:name1:ae"),
+				Ignored:      "nope",
+			},
+			want: "d8:announce23:http://tracker/announce13:creation datei1714777334e4:infod4:name1:aee",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.v)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Marshal() got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	var typeErr *UnsupportedTypeError
+	if _, err := Marshal(1.5); !errors.As(err, &typeErr) {
+		t.Errorf("Marshal(float) error = %v, want *UnsupportedTypeError", err)
+	}
+	var valueErr *UnsupportedValueError
+	if _, err := Marshal([]*int{nil}); !errors.As(err, &valueErr) {
+		t.Errorf("Marshal([]*int{nil}) error = %v, want *UnsupportedValueError", err)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	content := []byte("d8:announce23:http://tracker/announce13:announce-listll1:a1:bel1:cee13:creation datei1714777334e" +
+		"4:infod5:filesld6:lengthi3e4:pathl3:dir5:a.txteee4:name5:a.txt12:piece lengthi16384e6:pieces20:01234567890123456789ee")
+
+	var meta testMetainfo
+	if err := Unmarshal(content, &meta); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if meta.Announce != "http://tracker/announce" {
+		t.Errorf("Announce = %q", meta.Announce)
+	}
+	if !reflect.DeepEqual(meta.AnnounceList, [][]string{{"a", "b"}, {"c"}}) {
+		t.Errorf("AnnounceList = %v", meta.AnnounceList)
+	}
+	if meta.CreationDate == nil || *meta.CreationDate != 1714777334 {
+		t.Errorf("CreationDate = %v", meta.CreationDate)
+	}
+
+	var info testInfo
+	if err := Unmarshal(meta.Info, &info); err != nil {
+		t.Fatalf("Unmarshal(info) error = %v", err)
+	}
+	want := testInfo{
+		Name:        "a.txt",
+		PieceLength: 16384,
+		Pieces:      []byte("01234567890123456789"),
+		Files:       []testFile{{Length: 3, Path: []string{"dir", "a.txt"}}},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("Unmarshal(info) got = %+v, want %+v", info, want)
+	}
+
+	var generic any
+	if err := Unmarshal([]byte("d1:ai1e1:bl1:xee"), &generic); err != nil {
+		t.Fatalf("Unmarshal(any) error = %v", err)
+	}
+	wantGeneric := map[string]any{"a": int64(1), "b": []any{"x"}}
+	if !reflect.DeepEqual(generic, wantGeneric) {
+		t.Errorf("Unmarshal(any) got = %v, want %v", generic, wantGeneric)
+	}
+
+	var hash [4]byte
+	if err := Unmarshal([]byte("4:abcd"), &hash); err != nil || string(hash[:]) != "abcd" {
+		t.Errorf("Unmarshal([4]byte) got = %q, error = %v", hash, err)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		v       any
+		wantErr any
+	}{
+		{name: "Not a pointer", content: "i1e", v: 0, wantErr: new(*InvalidUnmarshalError)},
+		{name: "Nil pointer", content: "i1e", v: (*int)(nil), wantErr: new(*InvalidUnmarshalError)},
+		{name: "String into int", content: "4:spam", v: new(int), wantErr: new(*UnmarshalTypeError)},
+		{name: "Overflow", content: "i300e", v: new(int8), wantErr: new(*UnmarshalTypeError)},
+		{name: "Negative into uint", content: "i-1e", v: new(uint), wantErr: new(*UnmarshalTypeError)},
+		{name: "Wrong array length", content: "3:abc", v: new([4]byte), wantErr: new(*UnmarshalTypeError)},
+		{name: "Wrong field type", content: "d6:lengthi3e4:path3:abce", v: new(testFile), wantErr: new(*UnmarshalTypeError)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal([]byte(tt.content), tt.v)
+			if err == nil || !errors.As(err, tt.wantErr) {
+				t.Errorf("Unmarshal() error = %v, want %T", err, tt.wantErr)
+			}
+		})
+	}
+
+	var fieldErr *UnmarshalTypeError
+	err := Unmarshal([]byte("d6:lengthi3e4:pathl1:ai1eee"), new(testFile))
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "path[1]" {
+		t.Errorf("Unmarshal() error = %v, want field path[1]", err)
+	}
+}
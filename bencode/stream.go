@@ -0,0 +1,389 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Token holds a value of one of these types:
+//
+//	Delim, for the four bencode delimiters l d e
+//	[]byte, for bencode strings (including dictionary keys)
+//	int64, for bencode integers
+type Token any
+
+// Delim is a bencode container delimiter: 'l', 'd' or 'e'.
+type Delim byte
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// maxIntLength bounds the digits read for an integer or a string length
+// prefix, "-9223372036854775808" is 20 characters long.
+const maxIntLength = 20
+
+// container is an open list or dictionary in the token stream.
+type container struct {
+	kind    byte   // 'l' or 'd'
+	wantKey bool   // for dictionaries, whether the next token must be a key
+	lastKey []byte // for dictionaries in strict mode, the previous key
+	hasKey  bool
+}
+
+// A Decoder reads and decodes bencode values from an input stream.
+type Decoder struct {
+	r      *bufio.Reader
+	offset int64
+	stack  []container
+	opts   DecodeOptions
+}
+
+// NewDecoder returns a new decoder that reads from r.
+// The decoder introduces its own buffering and may read data from r beyond
+// the bencode values requested.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// SetOptions changes how the following values are parsed, see DecodeOptions.
+func (dec *Decoder) SetOptions(opts DecodeOptions) {
+	dec.opts = opts
+}
+
+// InputOffset returns the offset of the next byte the decoder will consume.
+func (dec *Decoder) InputOffset() int64 {
+	return dec.offset
+}
+
+// Buffered returns a reader of the data remaining in the Decoder's buffer.
+func (dec *Decoder) Buffered() io.Reader {
+	b, _ := dec.r.Peek(dec.r.Buffered())
+	return bytes.NewReader(b)
+}
+
+// More reports whether there is another element in the current list or
+// dictionary being parsed.
+func (dec *Decoder) More() bool {
+	c, err := dec.peek()
+	return err == nil && c != 'e'
+}
+
+// Token returns the next bencode token in the input stream. At the end of the
+// input stream, Token returns nil, io.EOF.
+func (dec *Decoder) Token() (Token, error) {
+	c, err := dec.peek()
+	if err != nil {
+		if err == io.EOF && len(dec.stack) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	switch {
+	case c == 'e':
+		if len(dec.stack) == 0 {
+			return nil, dec.errorf("unexpected end of container")
+		}
+		if top := dec.stack[len(dec.stack)-1]; top.kind == 'd' && !top.wantKey {
+			return nil, dec.errorf("missing dictionary value")
+		}
+		dec.readByte()
+		dec.stack = dec.stack[:len(dec.stack)-1]
+		dec.valueDone()
+		return Delim('e'), nil
+	case c == 'l' || c == 'd':
+		if err := dec.checkKey(c); err != nil {
+			return nil, err
+		}
+		if max := dec.opts.limits().MaxDepth; max > 0 && len(dec.stack) >= max {
+			return nil, &LimitError{Offset: dec.offset, Msg: fmt.Sprintf("nesting deeper than %d", max)}
+		}
+		dec.readByte()
+		dec.stack = append(dec.stack, container{kind: c, wantKey: c == 'd'})
+		return Delim(c), nil
+	case c == 'i':
+		if err := dec.checkKey(c); err != nil {
+			return nil, err
+		}
+		start := dec.offset
+		digits, err := dec.readInteger(nil)
+		if err != nil {
+			return nil, err
+		}
+		n, reason := parseInteger(digits[1:len(digits)-1], dec.opts.Strict)
+		if reason != "" {
+			return nil, &SyntaxError{Offset: start + 1, Msg: fmt.Sprintf("%s %q", reason, digits[1:len(digits)-1])}
+		}
+		dec.valueDone()
+		return n, nil
+	case c >= '0' && c <= '9':
+		start := dec.offset
+		str, err := dec.readString(nil, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := dec.checkKeyOrder(str, start); err != nil {
+			return nil, err
+		}
+		dec.valueDone()
+		return str, nil
+	default:
+		return nil, dec.errorf("invalid character %q looking for beginning of value", c)
+	}
+}
+
+// Decode reads the next bencode value from its input and stores it in the
+// value pointed to by v, following the rules of Unmarshal. It can be mixed
+// with Token to decode single elements of a larger list or dictionary.
+func (dec *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+
+	c, err := dec.peek()
+	if err != nil {
+		if err == io.EOF && len(dec.stack) > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err := dec.checkKey(c); err != nil {
+		return err
+	}
+
+	start := dec.offset
+	raw, err := dec.readValue()
+	if err != nil {
+		return err
+	}
+	if c >= '0' && c <= '9' {
+		_, key, _ := bytes.Cut(raw, []byte(":"))
+		if err := dec.checkKeyOrder(key, start); err != nil {
+			return err
+		}
+	}
+	dec.valueDone()
+	err = dec.opts.Unmarshal(raw, v)
+	if serr, ok := err.(*SyntaxError); ok {
+		serr.Offset += start
+	}
+	return err
+}
+
+// readValue reads the bytes of the next complete value, enforcing the
+// decoder's limits as it goes so that nothing is buffered beyond them.
+func (dec *Decoder) readValue() ([]byte, error) {
+	limits := dec.opts.limits()
+	var buf []byte
+	depth := 0
+	elements := 0
+	for {
+		c, err := dec.peek()
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if c != 'e' {
+			elements++
+			if limits.MaxElements > 0 && elements > limits.MaxElements {
+				return nil, &LimitError{Offset: dec.offset, Msg: fmt.Sprintf("more than %d elements", limits.MaxElements)}
+			}
+		}
+		switch {
+		case c == 'e':
+			if depth == 0 {
+				return nil, dec.errorf("unexpected end of container")
+			}
+			dec.readByte()
+			buf = append(buf, c)
+			depth--
+		case c == 'l' || c == 'd':
+			if limits.MaxDepth > 0 && len(dec.stack)+depth >= limits.MaxDepth {
+				return nil, &LimitError{Offset: dec.offset, Msg: fmt.Sprintf("nesting deeper than %d", limits.MaxDepth)}
+			}
+			dec.readByte()
+			buf = append(buf, c)
+			depth++
+		case c == 'i':
+			buf, err = dec.readInteger(buf)
+			if err != nil {
+				return nil, err
+			}
+		case c >= '0' && c <= '9':
+			buf, err = dec.readString(buf, true)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, dec.errorf("invalid character %q looking for beginning of value", c)
+		}
+		if limits.MaxInputSize > 0 && int64(len(buf)) > limits.MaxInputSize {
+			return nil, &LimitError{Offset: dec.offset, Msg: fmt.Sprintf("value larger than %d bytes", limits.MaxInputSize)}
+		}
+		if depth == 0 {
+			return buf, nil
+		}
+	}
+}
+
+// readInteger appends an "i...e" integer, delimiters included, to buf.
+func (dec *Decoder) readInteger(buf []byte) ([]byte, error) {
+	start := len(buf)
+	for {
+		c, err := dec.readByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		buf = append(buf, c)
+		if c == 'e' {
+			return buf, nil
+		}
+		if len(buf)-start > maxIntLength+1 {
+			return nil, dec.errorf("integer too long")
+		}
+	}
+}
+
+// readString reads a "<length>:<bytes>" string. When withPrefix is set the
+// length prefix is appended to buf as well, otherwise only the string bytes are.
+func (dec *Decoder) readString(buf []byte, withPrefix bool) ([]byte, error) {
+	var prefix []byte
+	for {
+		c, err := dec.readByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if c == ':' {
+			break
+		}
+		if c < '0' || c > '9' || len(prefix) >= maxIntLength {
+			return nil, dec.errorf("invalid string length")
+		}
+		prefix = append(prefix, c)
+	}
+	length, reason := parseLength(prefix, dec.opts.Strict)
+	if reason != "" {
+		return nil, dec.errorf("%s %q", reason, prefix)
+	}
+	limits := dec.opts.limits()
+	if limits.MaxStringLength > 0 && length > limits.MaxStringLength {
+		return nil, &LimitError{Offset: dec.offset, Msg: fmt.Sprintf("string length %d exceeds %d bytes", length, limits.MaxStringLength)}
+	}
+	if limits.MaxInputSize > 0 && int64(len(buf))+length > limits.MaxInputSize {
+		return nil, &LimitError{Offset: dec.offset, Msg: fmt.Sprintf("value larger than %d bytes", limits.MaxInputSize)}
+	}
+	if withPrefix {
+		buf = append(buf, prefix...)
+		buf = append(buf, ':')
+	}
+
+	// grow the buffer as data arrives rather than trusting the length prefix
+	w := bytes.NewBuffer(buf)
+	n, err := io.CopyN(w, dec.r, length)
+	dec.offset += n
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return w.Bytes(), nil
+}
+
+func (dec *Decoder) peek() (byte, error) {
+	b, err := dec.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (dec *Decoder) readByte() (byte, error) {
+	c, err := dec.r.ReadByte()
+	if err == nil {
+		dec.offset++
+	}
+	return c, err
+}
+
+// checkKey reports an error if the next token has to be a dictionary key but
+// c does not start a string.
+func (dec *Decoder) checkKey(c byte) error {
+	if len(dec.stack) == 0 || (c >= '0' && c <= '9') {
+		return nil
+	}
+	if top := dec.stack[len(dec.stack)-1]; top.kind == 'd' && top.wantKey {
+		return dec.errorf("dictionary key must be a string")
+	}
+	return nil
+}
+
+// checkKeyOrder enforces sorted, unique dictionary keys in strict mode when
+// the string just read at offset off was a key.
+func (dec *Decoder) checkKeyOrder(key []byte, off int64) error {
+	if !dec.opts.Strict || len(dec.stack) == 0 {
+		return nil
+	}
+	top := &dec.stack[len(dec.stack)-1]
+	if top.kind != 'd' || !top.wantKey {
+		return nil
+	}
+	if top.hasKey {
+		if cmp := bytes.Compare(top.lastKey, key); cmp == 0 {
+			return &SyntaxError{Offset: off, Msg: fmt.Sprintf("duplicate dictionary key %q", key)}
+		} else if cmp > 0 {
+			return &SyntaxError{Offset: off, Msg: fmt.Sprintf("dictionary key %q is not sorted after %q", key, top.lastKey)}
+		}
+	}
+	top.lastKey = append(top.lastKey[:0], key...)
+	top.hasKey = true
+	return nil
+}
+
+// valueDone flips the key/value expectation of the enclosing dictionary.
+func (dec *Decoder) valueDone() {
+	if len(dec.stack) == 0 {
+		return
+	}
+	top := &dec.stack[len(dec.stack)-1]
+	if top.kind == 'd' {
+		top.wantKey = !top.wantKey
+	}
+}
+
+func (dec *Decoder) errorf(format string, args ...any) error {
+	return &SyntaxError{Offset: dec.offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// An Encoder writes bencode values to an output stream.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode writes the bencode encoding of v to the stream, following the rules
+// of Marshal. Values are written as they are walked, so if an error occurs
+// part of v may already have been written.
+func (enc *Encoder) Encode(v any) error {
+	e := &encodeState{w: enc.w}
+	if err := e.marshal(reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	return enc.w.Flush()
+}
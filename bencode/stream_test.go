@@ -0,0 +1,116 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoderToken(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("d3:cowl3:mooi-3ee4:spami42eei7e"))
+	want := []Token{
+		Delim('d'), []byte("cow"), Delim('l'), []byte("moo"), int64(-3), Delim('e'),
+		[]byte("spam"), int64(42), Delim('e'), int64(7),
+	}
+	for i, w := range want {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatalf("Token() #%d error = %v", i, err)
+		}
+		if !reflect.DeepEqual(tok, w) {
+			t.Fatalf("Token() #%d got = %v, want %v", i, tok, w)
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		t.Errorf("Token() at end error = %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderDecode(t *testing.T) {
+	// a stream of peers decoded one by one, the way a tracker reply is walked
+	dec := NewDecoder(strings.NewReader("ld2:ip9:127.0.0.14:porti6881eed2:ip8:10.0.0.14:porti51413eee"))
+	type peer struct {
+		IP   string `bencode:"ip"`
+		Port uint16 `bencode:"port"`
+	}
+
+	if tok, err := dec.Token(); err != nil || tok != Delim('l') {
+		t.Fatalf("Token() got = %v, error = %v", tok, err)
+	}
+	var peers []peer
+	for dec.More() {
+		var p peer
+		if err := dec.Decode(&p); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		peers = append(peers, p)
+	}
+	if tok, err := dec.Token(); err != nil || tok != Delim('e') {
+		t.Fatalf("Token() got = %v, error = %v", tok, err)
+	}
+
+	want := []peer{{"127.0.0.1", 6881}, {"10.0.0.1", 51413}}
+	if !reflect.DeepEqual(peers, want) {
+		t.Errorf("Decode() got = %v, want %v", peers, want)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "Truncated string", content: "10:spam"},
+		{name: "Unterminated list", content: "l4:spam"},
+		{name: "Integer key", content: "di1ei2ee"},
+		{name: "Stray end", content: "e"},
+		{name: "Garbage", content: "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			if err := NewDecoder(strings.NewReader(tt.content)).Decode(&v); err == nil {
+				t.Errorf("Decode() got = %v, want error", v)
+			}
+		})
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(map[string]any{"spam": []any{"a", 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(NewData("eggs")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "d4:spaml1:ai1eee4:eggs"; got != want {
+		t.Errorf("Encode() got = %s, want %s", got, want)
+	}
+}
+
+func TestDecoderStrict(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("d4:spami1e3:cowi2ee"))
+	dec.SetOptions(DecodeOptions{Strict: true})
+	var v map[string]int
+	err := dec.Decode(&v)
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != 10 {
+		t.Errorf("Decode() error = %v, want *SyntaxError at offset 10", err)
+	}
+
+	dec = NewDecoder(strings.NewReader("d4:spami1e3:cowi2ee"))
+	dec.SetOptions(DecodeOptions{Strict: true})
+	for i := 0; i < 3; i++ {
+		if _, err := dec.Token(); err != nil {
+			t.Fatalf("Token() #%d error = %v", i, err)
+		}
+	}
+	if _, err := dec.Token(); !errors.As(err, &syntaxErr) {
+		t.Errorf("Token() error = %v, want *SyntaxError", err)
+	}
+}
@@ -0,0 +1,358 @@
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Unmarshaler is implemented by types that can decode a bencode description of themselves.
+// UnmarshalBencode receives the encoded bytes of a single value.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+// RawMessage is a raw encoded bencode value. It can be used to delay decoding
+// of part of a message, or to embed pre-encoded bencode while marshaling.
+type RawMessage []byte
+
+// MarshalBencode returns m as the bencode encoding of m.
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, fmt.Errorf("empty RawMessage")
+	}
+	return m, nil
+}
+
+// UnmarshalBencode sets *m to a copy of data.
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+// InvalidUnmarshalError describes an invalid argument passed to Unmarshal.
+// The argument must be a non-nil pointer.
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: Unmarshal(nil)"
+	}
+	if e.Type.Kind() != reflect.Pointer {
+		return "bencode: Unmarshal(non-pointer " + e.Type.String() + ")"
+	}
+	return "bencode: Unmarshal(nil " + e.Type.String() + ")"
+}
+
+// UnmarshalTypeError describes a bencode value that was not appropriate for
+// the Go value it was decoded into.
+type UnmarshalTypeError struct {
+	Value string       // description of the bencode value, e.g. "string" or "integer 300"
+	Type  reflect.Type // type of the Go value it could not be assigned to
+	Field string       // dotted path of the struct field or dictionary key, if any
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field != "" {
+		return "bencode: cannot unmarshal " + e.Value + " into field " + e.Field + " of type " + e.Type.String()
+	}
+	return "bencode: cannot unmarshal " + e.Value + " into Go value of type " + e.Type.String()
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// Unmarshal decodes the bencoded data in b and stores the result in the value
+// pointed to by v, which must be a non-nil pointer.
+//
+// Dictionary keys are matched against struct fields using the same
+// `bencode:"name"` tags as Marshal, falling back to a case-insensitive match
+// on the field name. Unknown keys are ignored. Integers may be stored in any
+// integer type or bool and are range-checked, strings may be stored in string,
+// []byte or a [N]byte of exactly the right length. Decoding into an empty
+// interface produces string, int64, []any and map[string]any values.
+func Unmarshal(b []byte, v any) error {
+	return unmarshal(DecodeOptions{}, b, v)
+}
+
+func unmarshal(opts DecodeOptions, b []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+
+	data, n, err := opts.Decode(b)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return &SyntaxError{Offset: 0, Msg: "unexpected end of input"}
+	}
+	if n != len(b) {
+		return &SyntaxError{Offset: int64(n), Msg: "trailing data after top-level value"}
+	}
+	return unmarshalData(data, rv, "")
+}
+
+// UnmarshalData stores an already decoded value in the value pointed to by v,
+// following the same rules as Unmarshal.
+func UnmarshalData(data *Data, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+	if data == nil {
+		return fmt.Errorf("bencode: UnmarshalData(nil *Data)")
+	}
+	return unmarshalData(data, rv, "")
+}
+
+// rawBytes returns the encoded form of data, preferring the original source
+// bytes when data came out of the decoder.
+func rawBytes(data *Data) []byte {
+	if data.Raw != nil {
+		return data.Raw
+	}
+	return Encode(data)
+}
+
+func typeError(data *Data, t reflect.Type, path string) error {
+	var desc string
+	switch data.Type {
+	case STRING:
+		desc = "string"
+	case INTEGER:
+		desc = fmt.Sprintf("integer %d", data.AsInt())
+	case LIST:
+		desc = "list"
+	case DICT:
+		desc = "dictionary"
+	default:
+		desc = "invalid value"
+	}
+	return &UnmarshalTypeError{Value: desc, Type: t, Field: path}
+}
+
+func unmarshalData(data *Data, v reflect.Value, path string) error {
+	// walk down pointers, allocating as needed, until we hit a non-pointer
+	// or something that knows how to decode itself
+	for {
+		if v.Kind() != reflect.Pointer && v.Type().Name() != "" && v.CanAddr() {
+			if v.Addr().Type().Implements(unmarshalerType) {
+				v = v.Addr()
+			}
+		}
+		if v.Type().Implements(unmarshalerType) && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			return v.Interface().(Unmarshaler).UnmarshalBencode(rawBytes(data))
+		}
+		if v.Kind() != reflect.Pointer {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Type() == dataType {
+		v.Set(reflect.ValueOf(*data))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeError(data, v.Type(), path)
+		}
+		generic, err := genericValue(data)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(generic))
+		return nil
+	case reflect.Bool:
+		if data.Type != INTEGER {
+			return typeError(data, v.Type(), path)
+		}
+		v.SetBool(data.AsInt() != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if data.Type != INTEGER {
+			return typeError(data, v.Type(), path)
+		}
+		i := data.AsInt()
+		if v.OverflowInt(i) {
+			return typeError(data, v.Type(), path)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if data.Type != INTEGER {
+			return typeError(data, v.Type(), path)
+		}
+		i := data.AsInt()
+		if i < 0 || v.OverflowUint(uint64(i)) {
+			return typeError(data, v.Type(), path)
+		}
+		v.SetUint(uint64(i))
+	case reflect.String:
+		if data.Type != STRING {
+			return typeError(data, v.Type(), path)
+		}
+		v.SetString(data.AsString())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && data.Type == STRING {
+			b := make([]byte, len(data.AsBytes()))
+			copy(b, data.AsBytes())
+			v.SetBytes(b)
+			return nil
+		}
+		if data.Type != LIST {
+			return typeError(data, v.Type(), path)
+		}
+		list := data.AsList()
+		s := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, elem := range list {
+			if err := unmarshalData(elem, s.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && data.Type == STRING {
+			b := data.AsBytes()
+			if len(b) != v.Len() {
+				return &UnmarshalTypeError{
+					Value: fmt.Sprintf("string of length %d", len(b)),
+					Type:  v.Type(),
+					Field: path,
+				}
+			}
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		if data.Type != LIST {
+			return typeError(data, v.Type(), path)
+		}
+		list := data.AsList()
+		for i := 0; i < v.Len(); i++ {
+			if i >= len(list) {
+				v.Index(i).SetZero()
+				continue
+			}
+			if err := unmarshalData(list[i], v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if data.Type != DICT || v.Type().Key().Kind() != reflect.String {
+			return typeError(data, v.Type(), path)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for key, elem := range data.AsDict() {
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := unmarshalData(elem, ev, joinPath(path, key)); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), ev)
+		}
+	case reflect.Struct:
+		if data.Type != DICT {
+			return typeError(data, v.Type(), path)
+		}
+		fields := cachedFields(v.Type())
+		for key, elem := range data.AsDict() {
+			f := lookupField(fields, key)
+			if f == nil {
+				continue
+			}
+			fv, err := fieldByIndexAlloc(v, f.index)
+			if err != nil {
+				return err
+			}
+			if err := unmarshalData(elem, fv, joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+	default:
+		return typeError(data, v.Type(), path)
+	}
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func lookupField(fields []field, key string) *field {
+	for i := range fields {
+		if fields[i].name == key {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, key) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// fieldByIndexAlloc walks index like reflect.Value.FieldByIndex, allocating
+// nil embedded struct pointers on the way.
+func fieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("bencode: cannot set embedded pointer to unexported struct: %v", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// genericValue converts data into plain Go values for decoding into an empty interface.
+func genericValue(data *Data) (any, error) {
+	switch data.Type {
+	case STRING:
+		return data.AsString(), nil
+	case INTEGER:
+		return data.AsInt(), nil
+	case LIST:
+		list := data.AsList()
+		out := make([]any, len(list))
+		for i, elem := range list {
+			val, err := genericValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = val
+		}
+		return out, nil
+	case DICT:
+		dict := data.AsDict()
+		out := make(map[string]any, len(dict))
+		for key, elem := range dict {
+			val, err := genericValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = val
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("bencode: invalid value")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gtorrent/bencode"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// dumpBencode prints the bencoded file at path as indented JSON on standard output.
+// Text strings are written as JSON strings and binary strings are tagged,
+// so the output can be turned back into the exact same bencode with buildBencode.
+func dumpBencode(path string, useBase64 bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data, n, err := bencode.Decode(content)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("%s is empty", path)
+	}
+	if n != len(content) {
+		log.Warn().Msgf("Ignoring %d bytes of trailing data after the first value", len(content)-n)
+	}
+
+	enc := bencode.BinaryHex
+	if useBase64 {
+		enc = bencode.BinaryBase64
+	}
+	jsonVal, err := bencode.DataToJSON(data, enc)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, jsonVal, "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+// buildBencode encodes the JSON file at path, in the format written by dumpBencode,
+// into bencode and writes it to output, or to standard output when output is empty.
+func buildBencode(path string, output string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data, err := bencode.DataFromJSON(content)
+	if err != nil {
+		return err
+	}
+	encoded := bencode.Encode(data)
+
+	if output == "" {
+		_, err = os.Stdout.Write(encoded)
+		return err
+	}
+	return os.WriteFile(output, encoded, 0644)
+}
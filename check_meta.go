@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gtorrent/torrent"
+	"os"
+)
+
+// checkMeta validates the metainfo of the torrent file at path and prints
+// every problem found, or a short summary when the torrent is valid.
+func checkMeta(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tor, err := torrent.TorrentFromBytes(content)
+	var validationErr *torrent.ValidationError
+	if errors.As(err, &validationErr) {
+		fmt.Printf("%s: %d problem(s)\n", path, len(validationErr.Problems))
+		for _, problem := range validationErr.Problems {
+			fmt.Printf("  %s\n", problem)
+		}
+		return fmt.Errorf("%s is not a valid torrent", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: OK\n", path)
+	fmt.Printf("  name: %s\n", tor.Name)
+	if tor.HasV1() {
+		fmt.Printf("  info hash: %s\n", tor.InfoHashString())
+	}
+	if tor.HasV2() {
+		fmt.Printf("  info hash v2: %s\n", tor.InfoHashV2String())
+	}
+	fmt.Printf("  files: %d, %d bytes\n", len(tor.FileList), tor.Length)
+	fmt.Printf("  pieces: %d of %d bytes\n", len(tor.Pieces), tor.PieceLength)
+	return nil
+}
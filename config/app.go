@@ -10,6 +10,7 @@ type AppConfig struct {
 	CacheDir    string
 	DownloadDir string
 	DB          *DBConfig
+	Encryption  *EncryptionConfig
 }
 
 func NewAppConfig() *AppConfig {
@@ -24,11 +25,13 @@ func NewAppConfig() *AppConfig {
 	}
 
 	dbConf := NewDBConfig()
+	encryptionConf := NewEncryptionConfig()
 
 	return &AppConfig{
 		CacheDir:    cacheDir,
 		DownloadDir: downloadDir,
 		DB:          dbConf,
+		Encryption:  encryptionConf,
 	}
 }
 
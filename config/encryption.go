@@ -0,0 +1,27 @@
+package config
+
+import "os"
+
+// EncryptionConfig holds the encryption policies of peer connections:
+// disabled, prefer or require.
+type EncryptionConfig struct {
+	Outgoing string
+	Incoming string
+}
+
+func NewEncryptionConfig() *EncryptionConfig {
+	outgoing := os.Getenv("ENCRYPTION_OUTGOING")
+	if outgoing == "" {
+		outgoing = "prefer"
+	}
+
+	incoming := os.Getenv("ENCRYPTION_INCOMING")
+	if incoming == "" {
+		incoming = "prefer"
+	}
+
+	return &EncryptionConfig{
+		Outgoing: outgoing,
+		Incoming: incoming,
+	}
+}
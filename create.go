@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"gtorrent/torrent"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// createTorrent builds a .torrent file from the options of the create command.
+func createTorrent() error {
+	opts := CLI.Create
+	tiers := make([][]string, 0, len(opts.Announce))
+	for _, tier := range opts.Announce {
+		urls := make([]string, 0)
+		for _, url := range strings.Split(tier, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			tiers = append(tiers, urls)
+		}
+	}
+
+	createdBy := opts.CreatedBy
+	if createdBy == "" {
+		createdBy = "gTorrent v" + VERSION
+	}
+	createOpts := torrent.CreateOptions{
+		Path:          opts.Path,
+		PieceLength:   opts.PieceLength,
+		AnnounceTiers: tiers,
+		WebSeeds:      opts.WebSeed,
+		Private:       opts.Private,
+		Comment:       opts.Comment,
+		CreatedBy:     createdBy,
+	}
+	if !opts.NoDate {
+		createOpts.CreationDate = time.Now()
+	}
+
+	log.Info().Msg("Hashing " + opts.Path)
+	content, err := torrent.Create(createOpts)
+	if err != nil {
+		return err
+	}
+	tor, err := torrent.TorrentFromBytes(content)
+	if err != nil {
+		return err
+	}
+
+	output := opts.Output
+	if output == "" {
+		output = tor.Name + ".torrent"
+	}
+	if err := os.WriteFile(output, content, 0644); err != nil {
+		return err
+	}
+	log.Info().Msgf("Created %s with %d pieces of %d bytes", filepath.Base(output), len(tor.Pieces), tor.PieceLength)
+	fmt.Printf("%s %s\n", tor.InfoHashString(), output)
+	return nil
+}
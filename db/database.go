@@ -20,7 +20,7 @@ func Init() (*Database, error) {
 		log.Fatal(err)
 	}
 
-	err = db.AutoMigrate(&models.Download{}, &models.Peer{}, &models.Piece{}, &models.Tracker{})
+	err = db.AutoMigrate(&models.Download{}, &models.Peer{}, &models.Piece{}, &models.Tracker{}, &models.ResumeFile{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -43,6 +43,7 @@ func (d *Database) CreateDownload(tor *torrent.Torrent, torrentPath string) (*mo
 	// if it does, return the download
 	// if it doesn't, create a new download and return it
 	download := &models.Download{}
+	var pieces []models.Piece
 	var err error
 	tx := d.db.Where("info_hash = ?", tor.InfoHashString()).First(download)
 	if tx.Error == nil {
@@ -63,31 +64,45 @@ func (d *Database) CreateDownload(tor *torrent.Torrent, torrentPath string) (*mo
 		return nil, err
 	}
 
-	for _, pieceHash := range tor.Pieces {
-		piece := &models.Piece{
+	pieces = make([]models.Piece, len(tor.Pieces))
+	for pieceIndex := range tor.Pieces {
+		pieces[pieceIndex] = models.Piece{
 			DownloadID: download.ID,
-			Hash:       pieceHash,
-		}
-		err = d.db.Create(piece).Error
-		if err != nil {
-			return nil, err
+			Index:      pieceIndex,
+			Hash:       tor.Pieces[pieceIndex][:],
 		}
 	}
+	// insert many rows per statement, large torrents have hundreds of thousands of pieces
+	err = d.db.CreateInBatches(pieces, 1000).Error
+	if err != nil {
+		return nil, err
+	}
 
-	for _, announce := range tor.AnnounceList {
-		tracker := &models.Tracker{
-			DownloadID: download.ID,
-			Announce:   announce,
-			Status:     models.TrackerAnnouncing,
-		}
-		err = d.db.Create(tracker).Error
-		if err != nil {
-			return nil, err
+	// trackers are shuffled within their tiers once, the order is kept from then on
+	for tierIndex, tier := range torrent.ShuffleTiers(tor.AnnounceTiers) {
+		for position, announce := range tier {
+			tracker := &models.Tracker{
+				DownloadID: download.ID,
+				Announce:   announce,
+				Tier:       tierIndex,
+				Position:   position,
+				Status:     models.TrackerAnnouncing,
+			}
+			err = d.db.Create(tracker).Error
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
 fillup:
-	result := d.db.Preload("Trackers").Preload("Pieces").First(download)
+	result := d.db.Preload("Trackers", func(db *gorm.DB) *gorm.DB {
+		return db.Order("tier, position")
+	}).Preload("Pieces", func(db *gorm.DB) *gorm.DB {
+		return db.Order("`index`, id")
+	}).Preload("ResumeFiles", func(db *gorm.DB) *gorm.DB {
+		return db.Order("`index`")
+	}).First(download)
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -114,13 +129,35 @@ func (d *Database) CreatePeer(tracker *models.Tracker, peer *torrent.Peer) error
 		TrackerID:  tracker.ID,
 		IP:         peer.IP,
 		Port:       peer.Port,
+		Source:     peer.Source,
+		IsStopped:  true,
+	}
+	return d.savePeer(newPeer)
+}
+
+// CreateDownloadPeer saves a peer of the download that was not returned by
+// a tracker, such as one received through Peer Exchange.
+func (d *Database) CreateDownloadPeer(download *models.Download, peer *torrent.Peer) error {
+	newPeer := &models.Peer{
+		DownloadID: download.ID,
+		IP:         peer.IP,
+		Port:       peer.Port,
+		Source:     peer.Source,
 		IsStopped:  true,
 	}
-	// if a peer with the same trackerID, IP and Port already exists, update it, otherwise create a new one
+	return d.savePeer(newPeer)
+}
+
+func (d *Database) savePeer(newPeer *models.Peer) error {
+	// if a peer with the same download, IP and Port already exists, update it, otherwise create a new one
 	existingPeer := &models.Peer{}
-	result := d.db.Where("download_id = ? AND ip = ? AND port = ?", tracker.ID, peer.IP, peer.Port).First(existingPeer)
+	result := d.db.Where("download_id = ? AND ip = ? AND port = ?", newPeer.DownloadID, newPeer.IP, newPeer.Port).First(existingPeer)
 	if result.Error == nil {
 		newPeer.ID = existingPeer.ID
+		if newPeer.TrackerID == 0 {
+			// keep the tracker a peer was first seen on
+			newPeer.TrackerID = existingPeer.TrackerID
+		}
 		result = d.db.Save(newPeer)
 		return result.Error
 	} else {
@@ -2,6 +2,8 @@ package db
 
 import (
 	"gtorrent/db/models"
+
+	"gorm.io/gorm"
 )
 
 // UpdateDownload updates a download record in the database
@@ -13,3 +15,27 @@ func (d *Database) UpdateDownload(download *models.Download) error {
 func (d *Database) UpdatePiece(piece *models.Piece) error {
 	return d.db.Save(piece).Error
 }
+
+// SaveResume saves the fast-resume record of a download in one transaction:
+// the pieces that changed since the last save and the state of the files.
+func (d *Database) SaveResume(download *models.Download, pieces []*models.Piece) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		for _, piece := range pieces {
+			if err := tx.Save(piece).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("download_id = ?", download.ID).Delete(&models.ResumeFile{}).Error; err != nil {
+			return err
+		}
+		for i := range download.ResumeFiles {
+			file := &download.ResumeFiles[i]
+			file.ID = 0
+			file.DownloadID = download.ID
+			if err := tx.Create(file).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -15,9 +15,10 @@ type Download struct {
 	LastError       string
 	CompletedAt     int64
 
-	Peers    []Peer
-	Pieces   []Piece
-	Trackers []Tracker
+	Peers       []Peer
+	Pieces      []Piece
+	Trackers    []Tracker
+	ResumeFiles []ResumeFile
 }
 
 type DownloadStatus = string
@@ -39,6 +40,7 @@ type Peer struct {
 	TrackerID    uint `gorm:"foreignKey:Trackers"`
 	IP           string
 	Port         uint16
+	Source       string // where the peer was learned from, see torrent.PeerSource
 	IsSeeder     bool
 	IsStopped    bool
 	IsChoked     bool
@@ -49,14 +51,28 @@ type Piece struct {
 	ID           uint `gorm:"primaryKey"`
 	DownloadID   uint
 	Index        int
-	Hash         string
+	Hash         []byte // SHA-1 hash of the piece
 	IsDownloaded bool
+	Blocks       []byte // bitfield of the blocks of an unfinished piece already on disk
+}
+
+// ResumeFile is the size and modification time a file of a download had when
+// the fast-resume record of the download was saved. The record is only
+// trusted while every file still matches.
+type ResumeFile struct {
+	ID         uint `gorm:"primaryKey"`
+	DownloadID uint
+	Index      int
+	Size       int64 // -1 if the file did not exist
+	ModTime    int64 // in nanoseconds since the epoch
 }
 
 type Tracker struct {
 	ID         uint `gorm:"primaryKey"`
 	DownloadID uint
 	Announce   string
+	Tier       int // BEP 12 tier, lower tiers are tried first
+	Position   int // position in the tier, moved to 0 when the tracker answers
 	Status     TrackerStatus
 	LastCheck  int64
 	LastError  string
@@ -7,10 +7,10 @@ import (
 	"gtorrent/torrent"
 	"gtorrent/utils"
 	"path/filepath"
+	"slices"
 	"time"
 
 	"os"
-	"sync"
 
 	"github.com/rs/zerolog/log"
 )
@@ -35,104 +35,128 @@ func DownloadTorrent(torrentFile string) error {
 	}
 
 	// copy the torrent file into cacheDir
-	torrentFilename := filepath.Base(torrentFile)
+	cachePath, err := cacheTorrentFile(torrentFile)
+	if err != nil {
+		return err
+	}
+	return downloadTorrent(tor, cachePath)
+}
 
-	// write the torrent file to the cacheDir
-	cachePath := filepath.Join(config.Main.CacheDir, torrentFilename)
-	err = utils.CopyFile(torrentFile, cachePath)
+// DownloadTorrentFromInfo downloads a torrent that was built from its info
+// dictionary alone, such as one fetched from peers for a magnet link. A
+// standalone .torrent file is written to the cache directory for it.
+func DownloadTorrentFromInfo(tor *torrent.Torrent) error {
+	log.Info().Msg("Downloading torrent: " + tor.Name)
+
+	cachePath, err := tor.WriteTorrentFile(config.Main.CacheDir)
 	if err != nil {
 		return err
 	}
+	return downloadTorrent(tor, cachePath)
+}
 
-	// check the mainDB for the torrent, if not found, add it
-	dlModel, err := mainDB.CreateDownload(tor, cachePath)
+// DownloadMagnet downloads the torrent of a magnet link. Its info dictionary
+// is fetched from the peers found through the trackers of the link, unless
+// the torrent was already downloaded once and is in the cache directory.
+func DownloadMagnet(uri string) error {
+	magnet, err := torrent.ParseMagnet(uri)
 	if err != nil {
 		return err
 	}
+	if !magnet.HasV1() {
+		return fmt.Errorf("magnet links without a v1 info hash are not supported")
+	}
+	stub := torrent.NewTorrent()
+	stub.InfoHash = magnet.InfoHash
+	stub.Name = magnet.Name
+	stub.Length = magnet.Length
+	log.Info().Msg("Downloading magnet link: " + stub.InfoHashString())
 
-	trackers := make([]torrent.ITracker, 0)
-	for _, announce := range tor.AnnounceList {
-		tracker, err := torrent.NewTracker(announce)
-		if err != nil {
-			log.Warn().Err(err).Str("tracker", announce).Msg("Failed to create tracker, skipping")
-			continue
+	cachePath := filepath.Join(config.Main.CacheDir, stub.InfoHashString()+".torrent")
+	if content, err := os.ReadFile(cachePath); err == nil {
+		if tor, err := torrent.TorrentFromBytes(content); err == nil && tor.InfoHash == magnet.InfoHash {
+			log.Info().Msg("Using the cached torrent file " + cachePath)
+			return downloadTorrent(tor, cachePath)
 		}
-		trackers = append(trackers, tracker)
 	}
 
-	// Only fail if we have no working trackers
-	if len(trackers) == 0 {
-		return fmt.Errorf("no valid trackers found")
+	peers, err := magnetPeers(magnet, stub)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Fetching metadata from %d peers", len(peers))
+	info, err := fetchMetadata(stub, peers)
+	if err != nil {
+		return err
+	}
+	tor, err := magnet.TorrentFromInfo(info)
+	if err != nil {
+		return err
 	}
+	return DownloadTorrentFromInfo(tor)
+}
 
-	// Get the peers from the trackers
-	me := torrent.PeerMe()
-	peers := make(map[string]*torrent.Peer)
+// downloadTorrent downloads the content of tor, whose metainfo file is kept
+// at cachePath, into the download directory.
+func downloadTorrent(tor *torrent.Torrent, cachePath string) error {
+	// check the mainDB for the torrent, if not found, add it
+	dlModel, err := mainDB.CreateDownload(tor, cachePath)
+	if err != nil {
+		return err
+	}
 
-	wg := sync.WaitGroup{}
-	for trackerIndex, tracker := range trackers {
-		wg.Add(1)
-		go func(trIndex int, tr torrent.ITracker) {
-			defer wg.Done()
-			log.Info().Msg("Getting peers from tracker: " + tr.Announce())
-			tPeers, err := tr.GetPeers(tor, me)
-			trackerModel := &dlModel.Trackers[trIndex]
-			if err != nil {
-				log.Error().Err(err).Msg("Error getting peers from tracker")
-				trackerModel.Status = models.TrackerError
-				trackerModel.LastError = err.Error()
-				mainDB.UpdateTracker(trackerModel)
-				return
-			}
-			log.Info().Msgf("Got %d peers from tracker", len(tPeers))
-			trackerModel.Status = models.TrackerComplete
-			trackerModel.Seeders = tr.Seeders()
-			trackerModel.Leechers = tr.Leechers()
-
-			for _, peer := range tPeers {
-				if peer.String() == me.String() {
-					continue
-				}
-				if peer.IP == "0.0.0.0" {
-					continue
-				}
-
-				_, ok := peers[peer.String()]
-				if !ok {
-					peers[peer.String()] = peer
-					mainDB.CreatePeer(trackerModel, peer)
-				}
-			}
+	// Create destination directory
+	downloadPath := filepath.Join(config.Main.DownloadDir, torrent.SafeName(tor.Name))
+	err = os.MkdirAll(downloadPath, os.ModePerm)
+	if err != nil {
+		dlModel.Status = models.DownloadError
+		dlModel.LastError = fmt.Sprintf("Failed to create download directory: %s", err.Error())
+		mainDB.UpdateDownload(dlModel)
+		return err
+	}
 
-			trackerModel.LastCheck = time.Now().Unix()
-			mainDB.UpdateTracker(trackerModel)
-		}(trackerIndex, tracker)
+	// Start from the data already on disk, only the missing pieces are downloaded
+	wanted, partials, err := resumeDownload(tor, downloadPath, dlModel)
+	if err != nil {
+		return err
+	}
+	if wanted != nil && !slices.Contains(wanted, true) {
+		log.Info().Msg("All pieces are already on disk")
+		// the files without pieces and the attributes may still be missing
+		if err := finishFiles(tor, downloadPath); err != nil {
+			dlModel.Status = models.DownloadError
+			dlModel.LastError = err.Error()
+			mainDB.UpdateDownload(dlModel)
+			return err
+		}
+		dlModel.Status = models.DownloadComplete
+		dlModel.Progress = 100
+		dlModel.CompletedAt = time.Now().Unix()
+		mainDB.UpdateDownload(dlModel)
+		return nil
+	}
+
+	peers, err := findPeers(tor, dlModel)
+	if err != nil {
+		if len(tor.UrlList) == 0 {
+			return err
+		}
+		log.Warn().Err(err).Msg("Downloading from web seeds only")
 	}
-	wg.Wait()
 
 	// Update the download status
 	dlModel.Status = models.DownloadInProgress
 	mainDB.UpdateDownload(dlModel)
 
 	log.Info().Msgf("Found %d peers for download", len(peers))
-	if len(peers) == 0 {
+	if len(peers) == 0 && len(tor.UrlList) == 0 {
 		log.Warn().Msg("No peers found for download, will retry later")
 		return nil
 	}
 
-	// Create destination directory
-	downloadPath := filepath.Join(config.Main.DownloadDir, tor.Name)
-	err = os.MkdirAll(downloadPath, os.ModePerm)
-	if err != nil {
-		dlModel.Status = models.DownloadError
-		dlModel.LastError = fmt.Sprintf("Failed to create download directory: %s", err.Error())
-		mainDB.UpdateDownload(dlModel)
-		return err
-	}
-
 	// Initialize download manager and start download
 	log.Info().Msg("Starting download of pieces")
-	err = startDownloadFromPeers(tor, peers, downloadPath, dlModel)
+	err = startDownloadFromPeers(tor, peers, downloadPath, dlModel, wanted, partials)
 	if err != nil {
 		dlModel.Status = models.DownloadError
 		dlModel.LastError = err.Error()
@@ -142,3 +166,95 @@ func DownloadTorrent(torrentFile string) error {
 
 	return nil
 }
+
+// cacheTorrentFile copies the torrent file into the cache directory and
+// returns the path of the copy.
+func cacheTorrentFile(torrentFile string) (string, error) {
+	torrentFilename := filepath.Base(torrentFile)
+
+	// write the torrent file to the cacheDir
+	cachePath := filepath.Join(config.Main.CacheDir, torrentFilename)
+	err := utils.CopyFile(torrentFile, cachePath)
+	if err != nil {
+		return "", err
+	}
+	return cachePath, nil
+}
+
+// findPeers asks the trackers of the download for peers, tier by tier, and
+// saves what it learns about the trackers. It fails only if the download has
+// no usable tracker, the map of peers is empty then.
+func findPeers(tor *torrent.Torrent, dlModel *models.Download) (map[string]*torrent.Peer, error) {
+	// group the trackers in their tiers, in the order kept for this download
+	tiers := make([][]torrent.ITracker, 0)
+	trackerModels := make(map[torrent.ITracker]*models.Tracker)
+	for i := range dlModel.Trackers {
+		trackerModel := &dlModel.Trackers[i]
+		tracker, err := torrent.NewTracker(trackerModel.Announce)
+		if err != nil {
+			log.Warn().Err(err).Str("tracker", trackerModel.Announce).Msg("Failed to create tracker, skipping")
+			continue
+		}
+		for len(tiers) <= trackerModel.Tier {
+			tiers = append(tiers, make([]torrent.ITracker, 0))
+		}
+		tiers[trackerModel.Tier] = append(tiers[trackerModel.Tier], tracker)
+		trackerModels[tracker] = trackerModel
+	}
+
+	// Only fail if we have no working trackers
+	if len(trackerModels) == 0 {
+		return make(map[string]*torrent.Peer), fmt.Errorf("no valid trackers found")
+	}
+
+	// Get the peers from the first tracker that answers, tier by tier (BEP 12)
+	me := torrent.PeerMe()
+	peers := make(map[string]*torrent.Peer)
+	err := torrent.AnnounceTiers(tiers, func(tr torrent.ITracker) error {
+		trackerModel := trackerModels[tr]
+		log.Info().Msg("Getting peers from tracker: " + tr.Announce())
+		tPeers, err := tr.GetPeers(tor, me)
+		trackerModel.LastCheck = time.Now().Unix()
+		if err != nil {
+			log.Error().Err(err).Msg("Error getting peers from tracker")
+			trackerModel.Status = models.TrackerError
+			trackerModel.LastError = err.Error()
+			return err
+		}
+		log.Info().Msgf("Got %d peers from tracker", len(tPeers))
+		trackerModel.Status = models.TrackerComplete
+		trackerModel.LastError = ""
+		trackerModel.Seeders = tr.Seeders()
+		trackerModel.Leechers = tr.Leechers()
+
+		for _, peer := range tPeers {
+			if peer.String() == me.String() {
+				continue
+			}
+			if peer.IP == "0.0.0.0" {
+				continue
+			}
+
+			_, ok := peers[peer.String()]
+			if !ok {
+				peers[peer.String()] = peer
+				mainDB.CreatePeer(trackerModel, peer)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("No tracker answered")
+	}
+
+	// save the tier order, the tracker that answered is now first in its tier
+	for tierIndex, tier := range tiers {
+		for position, tr := range tier {
+			trackerModel := trackerModels[tr]
+			trackerModel.Tier = tierIndex
+			trackerModel.Position = position
+			mainDB.UpdateTracker(trackerModel)
+		}
+	}
+	return peers, nil
+}
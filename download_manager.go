@@ -1,15 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"gtorrent/db/models"
 	"gtorrent/torrent"
-	"io"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -23,11 +26,21 @@ import (
 //   - peers: Map of discovered peers
 //   - downloadPath: Path where downloaded content will be saved
 //   - dlModel: Database model for tracking download progress
+//   - wanted: Pieces to download, nil for every piece. The other pieces are
+//     taken as already on disk.
+//   - partials: Blocks of unfinished pieces already on disk. The fast-resume
+//     record of the download is kept up to date unless partials is nil.
 //
 // Returns an error if the download process fails.
-func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer, downloadPath string, dlModel *models.Download) error {
-	// Create files with zero bytes
-	err := createEmptyFiles(tor, downloadPath)
+func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer, downloadPath string, dlModel *models.Download, wanted []bool, partials map[int]*partialPiece) error {
+	// Resolve the files of the torrent below the download path
+	layout, err := torrent.NewLayout(tor, downloadPath)
+	if err != nil {
+		return err
+	}
+
+	// Create the missing files, keeping the data already on disk
+	err = prepareFiles(tor, layout)
 	if err != nil {
 		return fmt.Errorf("failed to create files: %w", err)
 	}
@@ -41,14 +54,53 @@ func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer
 	downloaded := make([]bool, totalPieces)
 	var downloadMutex sync.Mutex
 
+	// Unfinished pieces that no worker is downloading right now
+	keepResume := partials != nil
+	if partials == nil {
+		partials = make(map[int]*partialPiece)
+	}
+
 	// Create a channel to coordinate worker goroutines
 	pieceQueue := make(chan int, totalPieces)
-	// Fill the queue with piece indices
+	// Fill the queue with the indices of the wanted pieces
+	wantedPieces := 0
 	for i := 0; i < totalPieces; i++ {
+		if wanted != nil && !wanted[i] {
+			downloaded[i] = true
+			continue
+		}
 		pieceQueue <- i
+		wantedPieces++
+	}
+	if wantedPieces == 0 {
+		close(pieceQueue)
+	}
+	// Files that are already complete get their attributes now
+	applyCompleteAttributes(tor, layout, downloaded)
+
+	// Peers sent by other peers are added to the swarm while the download
+	// runs (BEP 11), except for private torrents
+	swarm := torrent.NewPeerSet(peers)
+	swarm.OnAdd = func(peer *torrent.Peer) {
+		if err := mainDB.CreateDownloadPeer(dlModel, peer); err != nil {
+			log.Warn().Err(err).Msgf("Failed to save peer %s", peer.String())
+		}
+	}
+
+	// Peers may connect to us while the download runs
+	if listener, err := listenForPeers(tor, swarm); err != nil {
+		log.Warn().Err(err).Msg("Not accepting connections from peers")
+	} else {
+		defer listener.close()
+	}
+
+	// Web seeds are asked for the pieces that no peer could send (BEP 19)
+	webSeeds := make([]*torrent.WebSeed, 0, len(tor.UrlList))
+	for _, url := range tor.UrlList {
+		webSeeds = append(webSeeds, torrent.NewWebSeed(url))
 	}
 
-	log.Info().Msgf("Starting download of %d pieces with %d peers", totalPieces, len(peers))
+	log.Info().Msgf("Starting download of %d pieces with %d peers and %d web seeds", wantedPieces, len(peers), len(webSeeds))
 
 	// Create worker pool based on available peers (max 5 connections per peer)
 	maxWorkers := len(peers) * 5
@@ -84,6 +136,14 @@ func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer
 				// Update progress in database
 				dlModel.Progress = int(progress)
 				mainDB.UpdateDownload(dlModel)
+				if keepResume {
+					downloadMutex.Lock()
+					err := saveResume(tor, layout, dlModel, downloaded, partials)
+					downloadMutex.Unlock()
+					if err != nil {
+						log.Warn().Err(err).Msg("Failed to save the fast-resume record")
+					}
+				}
 
 				log.Info().Msgf("Download progress: %.2f%% (%d/%d pieces)",
 					progress, completedPieces, totalPieces)
@@ -93,6 +153,26 @@ func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer
 		}
 	}()
 
+	// Save the fast-resume record before exiting on Ctrl-C or SIGTERM. The
+	// blocks of the pieces the workers are downloading right now are lost.
+	if keepResume {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		go func() {
+			select {
+			case sig := <-signals:
+				// keep the lock, no piece is marked downloaded after the record
+				downloadMutex.Lock()
+				if err := saveResume(tor, layout, dlModel, downloaded, partials); err != nil {
+					log.Warn().Err(err).Msg("Failed to save the fast-resume record")
+				}
+				log.Fatal().Msgf("Download interrupted by %v", sig)
+			case <-doneChan:
+			}
+		}()
+	}
+
 	// Start worker goroutines
 	for i := 0; i < maxWorkers; i++ {
 		wg.Add(1)
@@ -106,11 +186,25 @@ func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer
 					downloadMutex.Unlock()
 					continue
 				}
+
+				// Continue from the blocks received so far, if any
+				partial, ok := partials[pieceIndex]
+				delete(partials, pieceIndex)
 				downloadMutex.Unlock()
+				if !ok {
+					partial = newPartialPiece(tor.PieceSize(pieceIndex))
+				}
 
 				// Try to download piece from available peers
-				piece, err := downloadPieceFromPeers(tor, pieceIndex, peers)
+				piece, err := downloadPieceFromPeers(tor, pieceIndex, swarm, partial)
+				if err != nil && len(webSeeds) > 0 {
+					piece, err = downloadPieceFromWebSeeds(tor, pieceIndex, webSeeds)
+				}
 				if err != nil {
+					// Keep the blocks received so far for the next attempt
+					downloadMutex.Lock()
+					partials[pieceIndex] = partial
+					downloadMutex.Unlock()
 					errChan <- fmt.Errorf("worker %d failed to download piece %d: %w",
 						workerID, pieceIndex, err)
 					// Put the piece back in the queue for retry
@@ -119,11 +213,8 @@ func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer
 				}
 
 				// Verify the piece hash
-				expectedHash := tor.Pieces[pieceIndex]
 				hash := sha1.Sum(piece)
-				actualHash := fmt.Sprintf("%x", hash)
-
-				if actualHash != expectedHash {
+				if !bytes.Equal(hash[:], tor.Pieces[pieceIndex][:]) {
 					log.Warn().Msgf("Piece %d hash mismatch, retrying", pieceIndex)
 					// Put the piece back in the queue for retry
 					pieceQueue <- pieceIndex
@@ -131,7 +222,7 @@ func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer
 				}
 
 				// Write the piece to the correct file(s)
-				err = writePiece(tor, pieceIndex, piece, downloadPath)
+				err = writePiece(tor, layout, pieceIndex, piece)
 				if err != nil {
 					errChan <- fmt.Errorf("worker %d failed to write piece %d: %w",
 						workerID, pieceIndex, err)
@@ -143,6 +234,7 @@ func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer
 				// Mark the piece as downloaded
 				downloadMutex.Lock()
 				downloaded[pieceIndex] = true
+				completeFiles(tor, layout, pieceIndex, downloaded)
 				completedPieces := 0
 				for _, isDownloaded := range downloaded {
 					if isDownloaded {
@@ -181,6 +273,11 @@ func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer
 			break
 		}
 	}
+	if keepResume {
+		if err := saveResume(tor, layout, dlModel, downloaded, partials); err != nil {
+			log.Warn().Err(err).Msg("Failed to save the fast-resume record")
+		}
+	}
 	downloadMutex.Unlock()
 
 	if !allDownloaded {
@@ -197,11 +294,22 @@ func startDownloadFromPeers(tor *torrent.Torrent, peers map[string]*torrent.Peer
 	return nil
 }
 
-// createEmptyFiles creates empty files with the correct sizes as specified in the torrent.
-// This pre-allocates the space needed for the download.
-func createEmptyFiles(tor *torrent.Torrent, downloadPath string) error {
-	for _, file := range tor.FileList {
-		filePath := filepath.Join(downloadPath, file.Path)
+// prepareFiles creates the files of the torrent that are missing and extends
+// the ones that are too short, without touching the data already on disk.
+func prepareFiles(tor *torrent.Torrent, layout *torrent.Layout) error {
+	for fileIndex, file := range tor.FileList {
+		// Padding files are all zeros and never stored
+		if file.IsPadding() {
+			continue
+		}
+		// Symlinks have no content, and are complete right away
+		if file.IsSymlink() {
+			if err := layout.ApplyAttributes(fileIndex); err != nil {
+				log.Warn().Err(err).Msgf("Failed to create symlink %s", file.Path)
+			}
+			continue
+		}
+		filePath := layout.FilePath(fileIndex)
 
 		// Create directory structure if needed
 		err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
@@ -209,39 +317,301 @@ func createEmptyFiles(tor *torrent.Torrent, downloadPath string) error {
 			return err
 		}
 
-		// Create empty file with correct size
-		f, err := os.Create(filePath)
+		// Open the file, creating it if it does not exist
+		f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
 		if err != nil {
 			return err
 		}
-
-		// Pre-allocate space
-		err = f.Truncate(file.Length)
+		info, err := f.Stat()
+		if err == nil && info.Size() < file.Length {
+			// Only ever grow the file, longer files keep their extra data
+			err = f.Truncate(file.Length)
+		}
 		f.Close() // Close file regardless of error
 		if err != nil {
 			return err
 		}
+
+		// Empty files are complete as soon as they exist
+		if file.Length == 0 {
+			if err := layout.ApplyAttributes(fileIndex); err != nil {
+				log.Warn().Err(err).Msgf("Failed to apply the attributes of %s", file.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// applyCompleteAttributes applies the attributes of the files whose pieces
+// are all downloaded. Empty files and symlinks are handled by prepareFiles.
+func applyCompleteAttributes(tor *torrent.Torrent, layout *torrent.Layout, downloaded []bool) {
+	for fileIndex, file := range tor.FileList {
+		first, last := tor.FilePieces(fileIndex)
+		if file.IsPadding() || file.Length == 0 || slices.Contains(downloaded[first:last+1], false) {
+			continue
+		}
+		if err := layout.ApplyAttributes(fileIndex); err != nil {
+			log.Warn().Err(err).Msgf("Failed to apply the attributes of %s", file.Path)
+		}
+	}
+}
+
+// finishFiles creates the files of a torrent whose pieces are all on disk
+// below downloadPath, such as its empty files and symlinks, and applies the
+// attributes of every file.
+func finishFiles(tor *torrent.Torrent, downloadPath string) error {
+	layout, err := torrent.NewLayout(tor, downloadPath)
+	if err != nil {
+		return err
+	}
+	if err := prepareFiles(tor, layout); err != nil {
+		return fmt.Errorf("failed to create files: %w", err)
+	}
+	downloaded := make([]bool, len(tor.Pieces))
+	for i := range downloaded {
+		downloaded[i] = true
 	}
+	applyCompleteAttributes(tor, layout, downloaded)
 	return nil
 }
 
+// checkExistingData verifies the data already below downloadPath and returns
+// the pieces that still have to be downloaded, nil if the torrent has no v1
+// piece hashes to check against.
+func checkExistingData(tor *torrent.Torrent, downloadPath string) ([]bool, error) {
+	if len(tor.Pieces) == 0 {
+		return nil, nil
+	}
+	layout, err := torrent.NewLayout(tor, downloadPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("Checking the existing data of %d pieces", len(tor.Pieces))
+	report, err := layout.Verify(torrent.VerifyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	wanted := make([]bool, len(report.Pieces))
+	for i, state := range report.Pieces {
+		wanted[i] = state != torrent.PieceGood
+	}
+	log.Info().Msgf("Found %d of %d pieces on disk", report.Good, len(report.Pieces))
+	return wanted, nil
+}
+
+// completeFiles applies the attributes of the files that pieceIndex was the
+// last missing piece of, such as their executable bits.
+func completeFiles(tor *torrent.Torrent, layout *torrent.Layout, pieceIndex int, downloaded []bool) {
+	for _, span := range tor.PieceSpans(pieceIndex) {
+		file := tor.FileList[span.FileIndex]
+		if file.IsPadding() {
+			continue
+		}
+
+		first, last := tor.FilePieces(span.FileIndex)
+		complete := true
+		for i := first; i <= last; i++ {
+			if !downloaded[i] {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			if err := layout.ApplyAttributes(span.FileIndex); err != nil {
+				log.Warn().Err(err).Msgf("Failed to apply the attributes of %s", file.Path)
+			}
+		}
+	}
+}
+
+// selfPeerID is the peer ID sent in our handshakes.
+// TODO: Get our actual Peer ID
+var selfPeerID = [20]byte([]byte("-GT0001-000000000000")) // Placeholder Peer ID
+
 // peerConnectionState holds the state for a connection to a single peer
 // during a piece download attempt.
 type peerConnectionState struct {
 	peer       *torrent.Peer
+	tor        *torrent.Torrent // Torrent of the connection, its info dictionary is served to the peer
+	swarm      *torrent.PeerSet // Peers of the download, nil while fetching metadata
 	conn       net.Conn
 	bitfield   torrent.Bitfield
 	peerChoked bool
-	startTime  time.Time // To track connection duration/timeouts
+	startTime  time.Time                 // To track connection duration/timeouts
+	extensions *torrent.PeerExtensions   // Extensions of the peer, nil if it does not support the extension protocol
+	metadata   *torrent.MetadataDownload // Metadata download the peer sends pieces to, nil if none
+	fast       bool                      // Both sides support the Fast Extension (BEP 6)
+	allowed    map[int]bool              // Pieces the peer lets us download while choked
+	received   bool                      // A message other than KeepAlive was received after the handshake
+
+	extMu   sync.Mutex    // Guards extensions and extended messages against the Peer Exchange timer
+	stopPex chan struct{} // Stops the Peer Exchange timer, nil until it runs
 }
 
 // close closes the connection to the peer.
 func (pcs *peerConnectionState) close() {
+	if pcs.stopPex != nil {
+		close(pcs.stopPex)
+		pcs.stopPex = nil
+	}
 	if pcs.conn != nil {
 		pcs.conn.Close()
 	}
 }
 
+// negotiate sends what follows the handshake for the extensions both sides
+// support: HaveNone for the Fast Extension, as we do not serve pieces, and
+// our extended handshake.
+func (pcs *peerConnectionState) negotiate(res *torrent.Handshake, tor *torrent.Torrent) error {
+	if res.SupportsFast() {
+		pcs.fast = true
+		pcs.allowed = make(map[int]bool)
+		haveNone := torrent.Message{Type: torrent.MsgHaveNone}
+		if _, err := pcs.conn.Write(haveNone.Serialize()); err != nil {
+			return fmt.Errorf("failed to send HaveNone: %w", err)
+		}
+	}
+	if res.SupportsExtensions() {
+		pcs.extensions = torrent.NewPeerExtensions()
+		if err := pcs.sendExtendedHandshake(tor); err != nil {
+			return fmt.Errorf("failed to send extended handshake: %w", err)
+		}
+	}
+	return nil
+}
+
+// canRequest reports whether blocks of the piece may be requested from the
+// peer: always once it unchoked us, and while choked for its allowed fast
+// pieces.
+func (pcs *peerConnectionState) canRequest(pieceIndex int) bool {
+	return !pcs.peerChoked || pcs.allowed[pieceIndex]
+}
+
+// Extensions returns the extensions the peer announced in its extended handshakes.
+func (pcs *peerConnectionState) Extensions() *torrent.PeerExtensions {
+	return pcs.extensions
+}
+
+// SendExtended sends payload to the peer as a message of the extension name.
+func (pcs *peerConnectionState) SendExtended(name string, payload []byte) error {
+	if pcs.extensions == nil {
+		return fmt.Errorf("peer %s does not support the extension protocol", pcs.peer.String())
+	}
+	id, ok := pcs.extensions.ID(name)
+	if !ok {
+		return fmt.Errorf("peer %s does not support %s", pcs.peer.String(), name)
+	}
+	_, err := pcs.conn.Write(torrent.FormatExtended(id, payload).Serialize())
+	return err
+}
+
+// Addr returns the address of the peer.
+func (pcs *peerConnectionState) Addr() string {
+	return pcs.peer.String()
+}
+
+// InfoBytes returns the info dictionary served to the peer, nil if we do not have it yet.
+func (pcs *peerConnectionState) InfoBytes() []byte {
+	if pcs.tor == nil {
+		return nil
+	}
+	return pcs.tor.InfoBytes
+}
+
+// MetadataDownload returns the metadata download the peer sends pieces to.
+func (pcs *peerConnectionState) MetadataDownload() *torrent.MetadataDownload {
+	return pcs.metadata
+}
+
+// AddPeers adds the peers sent by the peer through Peer Exchange to the swarm.
+func (pcs *peerConnectionState) AddPeers(peers []*torrent.Peer) {
+	if !pcs.exchangesPeers() {
+		return
+	}
+	added, ok := pcs.swarm.AddFromPex(pcs.peer, peers, time.Now())
+	if !ok {
+		log.Debug().Msgf("Dropped the peers from %s, sent within %v of its last ones", pcs.peer.String(), torrent.PexInterval)
+		return
+	}
+	log.Debug().Msgf("Received %d peers from %s, %d of them new", len(peers), pcs.peer.String(), len(added))
+}
+
+// exchangesPeers reports whether peers are exchanged on the connection. Peer
+// Exchange is disabled for private torrents, whose peers only come from
+// their trackers (BEP 27).
+func (pcs *peerConnectionState) exchangesPeers() bool {
+	return pcs.swarm != nil && pcs.tor != nil && !pcs.tor.IsPrivate
+}
+
+// startPex sends the peers of the swarm to the peer every torrent.PexInterval
+// until the connection is closed, once the peer sent its extended handshake.
+func (pcs *peerConnectionState) startPex() {
+	if pcs.stopPex != nil || !pcs.exchangesPeers() {
+		return
+	}
+	stop := make(chan struct{})
+	pcs.stopPex = stop
+	go func() {
+		ticker := time.NewTicker(torrent.PexInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				pcs.extMu.Lock()
+				err := pcs.sendPex()
+				pcs.extMu.Unlock()
+				if err != nil {
+					log.Debug().Msgf("Failed to send peers to %s: %v", pcs.peer.String(), err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// sendPex sends the peers of the swarm the peer does not know yet, at most
+// once per torrent.PexInterval. It is called with pcs.extMu held.
+func (pcs *peerConnectionState) sendPex() error {
+	if !pcs.exchangesPeers() || pcs.extensions == nil {
+		return nil
+	}
+	if _, ok := pcs.extensions.ID(torrent.UtPex); !ok {
+		return nil
+	}
+	payload, ok, err := pcs.swarm.PexMessage(pcs.peer, time.Now())
+	if err != nil || !ok {
+		return err
+	}
+	return pcs.SendExtended(torrent.UtPex, payload)
+}
+
+// sendExtendedHandshake sends our extended handshake to the peer, announcing
+// the extensions we support.
+func (pcs *peerConnectionState) sendExtendedHandshake(tor *torrent.Torrent) error {
+	h := torrent.Extensions.Handshake()
+	if !pcs.exchangesPeers() {
+		delete(h.M, torrent.UtPex)
+	}
+	h.V = "gTorrent " + VERSION
+	h.P = listenPort
+	h.Reqq = torrent.MaxBacklog
+	h.MetadataSize = int64(len(tor.InfoBytes))
+	if ip := net.ParseIP(pcs.peer.IP); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		h.YourIP = ip
+	}
+	msg, err := h.Message()
+	if err != nil {
+		return err
+	}
+	_, err = pcs.conn.Write(msg.Serialize())
+	return err
+}
+
 // sendRequest sends a Request message to the peer.
 func (pcs *peerConnectionState) sendRequest(pieceIndex, begin, length uint32) error {
 	reqPayload := torrent.FormatRequest(pieceIndex, begin, length)
@@ -251,24 +621,15 @@ func (pcs *peerConnectionState) sendRequest(pieceIndex, begin, length uint32) er
 }
 
 // downloadPieceFromPeers attempts to download a specific piece from available peers.
-// It tries different peers until the piece is successfully downloaded.
-func downloadPieceFromPeers(tor *torrent.Torrent, pieceIndex int, peers map[string]*torrent.Peer) ([]byte, error) {
-	pieceLength := tor.PieceLength
-	if pieceIndex == len(tor.Pieces)-1 {
-		lastPieceSize := tor.Length % tor.PieceLength
-		if lastPieceSize > 0 {
-			pieceLength = lastPieceSize
-		}
-	}
-
-	// TODO: Get our actual Peer ID
-	var selfPeerID [20]byte
-	copy(selfPeerID[:], "-GT0001-000000000000") // Placeholder Peer ID
-
+// It tries different peers until the piece is successfully downloaded, asking
+// each one only for the blocks that are still missing from partial.
+func downloadPieceFromPeers(tor *torrent.Torrent, pieceIndex int, swarm *torrent.PeerSet, partial *partialPiece) ([]byte, error) {
 	// Iterate through available peers.
-	for _, peer := range peers {
+	for _, peer := range swarm.Peers() {
 		state := &peerConnectionState{
 			peer:       peer,
+			tor:        tor,
+			swarm:      swarm,
 			peerChoked: true, // Assume choked initially
 			startTime:  time.Now(),
 		}
@@ -276,25 +637,38 @@ func downloadPieceFromPeers(tor *torrent.Torrent, pieceIndex int, peers map[stri
 		log.Debug().Msgf("Attempting to download piece %d from peer %s", pieceIndex, peer.String())
 
 		// 3. Establish connection
-		conn, err := net.DialTimeout("tcp", peer.String(), 10*time.Second)
+		conn, err := torrent.DialPeer(peer, tor.InfoHash, outgoingEncryption, 10*time.Second)
 		if err != nil {
 			log.Warn().Msgf("Failed to connect to peer %s: %v", peer.String(), err)
+			swarm.SetConnected(peer, false)
 			continue // Try next peer
 		}
 		state.conn = conn
 		defer state.close() // Ensure connection is closed
 
 		// 4. Perform BitTorrent handshake
-		_, err = torrent.PerformHandshake(state.conn, tor, selfPeerID)
+		res, err := torrent.PerformHandshake(state.conn, tor, selfPeerID)
+		swarm.SetConnected(peer, err == nil)
 		if err != nil {
 			log.Warn().Msgf("Handshake failed with peer %s: %v", peer.String(), err)
 			continue // Try next peer
 		}
 		log.Debug().Msgf("Handshake successful with peer %s", peer.String())
 
+		if err := state.negotiate(res, tor); err != nil {
+			log.Warn().Msgf("Failed to negotiate extensions with %s: %v", peer.String(), err)
+			continue
+		}
+
 		// 5. Exchange messages (Bitfield, Interested, Unchoke)
-		// Read the first message, expecting Bitfield (or Have)
+		// Read the first message, expecting Bitfield (or Have, HaveAll or
+		// HaveNone). The extended handshake of the peer may come before it.
 		msg, err := readMessageWithTimeout(state.conn, 10*time.Second)
+		for err == nil && msg.Type == torrent.MsgExtended {
+			if err = handleMessage(state, msg, pieceIndex); err == nil {
+				msg, err = readMessageWithTimeout(state.conn, 10*time.Second)
+			}
+		}
 		if err != nil {
 			log.Warn().Msgf("Failed to read initial message from peer %s: %v", peer.String(), err)
 			continue
@@ -306,6 +680,7 @@ func downloadPieceFromPeers(tor *torrent.Torrent, pieceIndex int, peers map[stri
 				continue
 			}
 			state.bitfield = torrent.Bitfield(msg.Payload)
+			state.received = true
 			log.Debug().Msgf("Received Bitfield from %s", peer.String())
 		} else {
 			// If no bitfield, initialize an empty one and process the first message (likely Have)
@@ -333,7 +708,7 @@ func downloadPieceFromPeers(tor *torrent.Torrent, pieceIndex int, peers map[stri
 		log.Debug().Msgf("Sent Interested to %s", peer.String())
 
 		// 6 & 7. Request blocks and receive piece data
-		pieceData, err := downloadPieceFromChokedPeer(state, tor, pieceIndex, pieceLength)
+		err = downloadPieceFromChokedPeer(state, pieceIndex, partial)
 		if err != nil {
 			log.Warn().Msgf("Failed to download piece %d from %s: %v", pieceIndex, peer.String(), err)
 			continue // Try next peer
@@ -341,13 +716,28 @@ func downloadPieceFromPeers(tor *torrent.Torrent, pieceIndex int, peers map[stri
 
 		// 8. Piece successfully downloaded
 		log.Info().Msgf("Successfully downloaded piece %d from peer %s", pieceIndex, peer.String())
-		return pieceData, nil
+		return partial.data, nil
 	}
 
 	// 9. If piece could not be downloaded from any peer:
 	return nil, fmt.Errorf("failed to download piece %d from any available peer", pieceIndex)
 }
 
+// downloadPieceFromWebSeeds attempts to download a specific piece from the
+// web seeds of the torrent, in turn, until one of them sends it.
+func downloadPieceFromWebSeeds(tor *torrent.Torrent, pieceIndex int, webSeeds []*torrent.WebSeed) ([]byte, error) {
+	for _, webSeed := range webSeeds {
+		piece, err := webSeed.FetchPiece(tor, pieceIndex)
+		if err != nil {
+			log.Warn().Msgf("Failed to download piece %d from web seed %s: %v", pieceIndex, webSeed.URL, err)
+			continue
+		}
+		log.Info().Msgf("Successfully downloaded piece %d from web seed %s", pieceIndex, webSeed.URL)
+		return piece, nil
+	}
+	return nil, fmt.Errorf("failed to download piece %d from any web seed", pieceIndex)
+}
+
 // readMessageWithTimeout reads a message with a specific timeout.
 func readMessageWithTimeout(conn net.Conn, timeout time.Duration) (*torrent.Message, error) {
 	conn.SetReadDeadline(time.Now().Add(timeout))
@@ -356,16 +746,19 @@ func readMessageWithTimeout(conn net.Conn, timeout time.Duration) (*torrent.Mess
 }
 
 // downloadPieceFromChokedPeer handles the message loop for downloading a piece
-// after the initial handshake and bitfield exchange.
-func downloadPieceFromChokedPeer(state *peerConnectionState, tor *torrent.Torrent, pieceIndex int, pieceLength int64) ([]byte, error) {
-	pieceBuf := make([]byte, pieceLength)
-	downloadedBytes := int64(0)
-	requestedBlocks := 0
-	receivedBlocks := 0
+// after the initial handshake and bitfield exchange. Only the blocks missing
+// from partial are requested, and every block received is added to it, so a
+// failed attempt is not lost for the next peer. Blocks are requested once the
+// peer unchokes us, or right away if the piece is allowed fast.
+func downloadPieceFromChokedPeer(state *peerConnectionState, pieceIndex int, partial *partialPiece) error {
+	pieceLength := int64(len(partial.data))
+	nextBlock := 0 // First block that may still have to be requested
+	receivedBlocks := partial.receivedBlocks()
 	backlog := 0 // Number of requests currently pending
 
 	// Calculate total blocks needed
-	totalBlocks := int(pieceLength+torrent.BlockSize-1) / torrent.BlockSize
+	totalBlocks := len(partial.received)
+	pending := make([]bool, totalBlocks) // Blocks requested and not answered yet
 
 	// Timeout for the entire piece download from this peer
 	pieceDownloadTimeout := time.After(60 * time.Second)
@@ -373,26 +766,26 @@ func downloadPieceFromChokedPeer(state *peerConnectionState, tor *torrent.Torren
 	for receivedBlocks < totalBlocks {
 		select {
 		case <-pieceDownloadTimeout:
-			return nil, fmt.Errorf("piece download timed out")
+			return fmt.Errorf("piece download timed out")
 		default:
-			// Only send requests if not choked and backlog is low
-			if !state.peerChoked {
-				for backlog < torrent.MaxBacklog && requestedBlocks < totalBlocks {
-					blockOffset := int64(requestedBlocks) * torrent.BlockSize
-					blockSize := torrent.BlockSize
-					// Adjust size for the last block
-					if blockOffset+int64(blockSize) > pieceLength {
-						blockSize = int(pieceLength - blockOffset)
+			// Only send requests if allowed and backlog is low
+			if state.canRequest(pieceIndex) {
+				for backlog < torrent.MaxBacklog && nextBlock < totalBlocks {
+					if partial.received[nextBlock] || pending[nextBlock] {
+						nextBlock++
+						continue
 					}
+					blockOffset, blockSize := partial.blockRange(nextBlock)
 
 					err := state.sendRequest(uint32(pieceIndex), uint32(blockOffset), uint32(blockSize))
 					if err != nil {
-						return nil, fmt.Errorf("failed to send request: %w", err)
+						return fmt.Errorf("failed to send request: %w", err)
 					}
-					requestedBlocks++
+					pending[nextBlock] = true
+					nextBlock++
 					backlog++
 					log.Trace().Msgf("Requested block %d/%d (offset %d, size %d) for piece %d from %s",
-						requestedBlocks, totalBlocks, blockOffset, blockSize, pieceIndex, state.peer.String())
+						nextBlock, totalBlocks, blockOffset, blockSize, pieceIndex, state.peer.String())
 				}
 			}
 
@@ -404,48 +797,88 @@ func downloadPieceFromChokedPeer(state *peerConnectionState, tor *torrent.Torren
 			}
 			msg, err := readMessageWithTimeout(state.conn, readTimeout)
 			if err != nil {
-				return nil, fmt.Errorf("failed to read message: %w", err)
+				return fmt.Errorf("failed to read message: %w", err)
 			}
 
 			if err := handleMessage(state, msg, pieceIndex); err != nil {
-				return nil, fmt.Errorf("error handling message: %w", err)
+				return fmt.Errorf("error handling message: %w", err)
+			}
+
+			// A choking peer drops our pending requests, ask again once
+			// unchoked. With the Fast Extension it rejects each of them instead.
+			if msg.Type == torrent.MsgChoke && !state.fast {
+				clear(pending)
+				nextBlock = 0
+				backlog = 0
+			}
+
+			// A rejected block is requested again as soon as we may
+			if msg.Type == torrent.MsgRejectRequest {
+				index, begin, _, _ := torrent.ParseRequest(msg.Payload)
+				block := int(begin / torrent.BlockSize)
+				if int(index) != pieceIndex || block >= totalBlocks || !pending[block] {
+					continue // Not one of ours
+				}
+				pending[block] = false
+				backlog = max(backlog-1, 0)
+				nextBlock = min(nextBlock, block)
+				// a peer that could send the block refuses to, try another one
+				if state.canRequest(pieceIndex) {
+					return fmt.Errorf("peer rejected the request for block %d", block)
+				}
 			}
 
 			// Handle Piece message
 			if msg.Type == torrent.MsgPiece {
 				index, begin, data, err := torrent.ParsePiece(msg.Payload)
 				if err != nil {
-					return nil, fmt.Errorf("failed to parse piece message: %w", err)
+					return fmt.Errorf("failed to parse piece message: %w", err)
 				}
 				if int(index) != pieceIndex {
 					log.Warn().Msgf("Received piece message for wrong index %d (expected %d) from %s",
 						index, pieceIndex, state.peer.String())
 					continue // Ignore
 				}
-				if int64(begin)+int64(len(data)) > pieceLength {
-					return nil, fmt.Errorf("received block data exceeds piece length (begin %d, len %d, pieceLen %d)",
+				block := int(begin / torrent.BlockSize)
+				if block >= totalBlocks {
+					return fmt.Errorf("received block data exceeds piece length (begin %d, len %d, pieceLen %d)",
+						begin, len(data), pieceLength)
+				}
+				blockOffset, blockSize := partial.blockRange(block)
+				if int64(begin) != blockOffset || int64(len(data)) != blockSize {
+					return fmt.Errorf("received block does not match a requested block (begin %d, len %d, pieceLen %d)",
 						begin, len(data), pieceLength)
 				}
 
-				copy(pieceBuf[begin:], data)
-				downloadedBytes += int64(len(data))
+				if pending[block] {
+					pending[block] = false
+					backlog = max(backlog-1, 0)
+				}
+				if partial.received[block] {
+					continue // Duplicate
+				}
+				copy(partial.data[begin:], data)
+				partial.received[block] = true
 				receivedBlocks++
-				backlog--
-				log.Trace().Msgf("Received block (offset %d, size %d) for piece %d from %s. Total %d/%d blocks, %d/%d bytes",
-					begin, len(data), pieceIndex, state.peer.String(), receivedBlocks, totalBlocks, downloadedBytes, pieceLength)
+				log.Trace().Msgf("Received block (offset %d, size %d) for piece %d from %s. Total %d/%d blocks",
+					begin, len(data), pieceIndex, state.peer.String(), receivedBlocks, totalBlocks)
 			}
 		}
 	}
 
-	if downloadedBytes != pieceLength {
-		return nil, fmt.Errorf("downloaded size mismatch: expected %d, got %d", pieceLength, downloadedBytes)
-	}
-
-	return pieceBuf, nil
+	return nil
 }
 
 // handleMessage processes incoming messages from a peer.
 func handleMessage(state *peerConnectionState, msg *torrent.Message, currentPieceIndex int) error {
+	if fastMessageName(msg.Type) != "" && !state.fast {
+		return fmt.Errorf("received %s from %s, which did not announce the Fast Extension", fastMessageName(msg.Type), state.peer.String())
+	}
+	first := !state.received && msg.Type != torrent.MsgKeepAlive
+	if msg.Type != torrent.MsgKeepAlive {
+		state.received = true
+	}
+
 	switch msg.Type {
 	case torrent.MsgKeepAlive:
 		log.Trace().Msgf("Received KeepAlive from %s", state.peer.String())
@@ -477,7 +910,17 @@ func handleMessage(state *peerConnectionState, msg *torrent.Message, currentPiec
 		log.Warn().Msgf("Received unexpected Bitfield message from %s", state.peer.String())
 	case torrent.MsgRequest:
 		log.Trace().Msgf("Received Request from %s (ignoring)", state.peer.String())
-		// We are the downloader, typically don't fulfill requests
+		// We are the downloader, typically don't fulfill requests. With the
+		// Fast Extension, requests we do not serve have to be rejected.
+		if state.fast {
+			if _, _, _, err := torrent.ParseRequest(msg.Payload); err != nil {
+				return fmt.Errorf("failed to parse Request message from %s: %w", state.peer.String(), err)
+			}
+			reject := torrent.Message{Type: torrent.MsgRejectRequest, Payload: msg.Payload}
+			if _, err := state.conn.Write(reject.Serialize()); err != nil {
+				return fmt.Errorf("failed to send RejectRequest to %s: %w", state.peer.String(), err)
+			}
+		}
 	case torrent.MsgPiece:
 		// Handled in the downloadPieceFromChokedPeer loop
 		// No action needed here for MsgPiece, just prevents falling into default
@@ -486,66 +929,113 @@ func handleMessage(state *peerConnectionState, msg *torrent.Message, currentPiec
 		log.Trace().Msgf("Received Cancel from %s (ignoring)", state.peer.String())
 	case torrent.MsgPort:
 		log.Trace().Msgf("Received Port from %s (ignoring)", state.peer.String())
+	case torrent.MsgHaveAll, torrent.MsgHaveNone:
+		// like Bitfield, they may only be the first message after the handshake
+		if !first {
+			return fmt.Errorf("received %s from %s after other messages", fastMessageName(msg.Type), state.peer.String())
+		}
+		if state.bitfield == nil || state.tor == nil {
+			log.Warn().Msgf("Received unexpected %s message from %s", fastMessageName(msg.Type), state.peer.String())
+			break
+		}
+		log.Debug().Msgf("Received %s from %s", fastMessageName(msg.Type), state.peer.String())
+		if msg.Type == torrent.MsgHaveAll {
+			copy(state.bitfield, torrent.HaveAll(len(state.tor.Pieces)))
+		} else {
+			clear(state.bitfield)
+		}
+	case torrent.MsgSuggestPiece:
+		index, err := torrent.ParseHave(msg.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to parse SuggestPiece message from %s: %w", state.peer.String(), err)
+		}
+		log.Trace().Msgf("Received SuggestPiece for piece %d from %s (ignoring)", index, state.peer.String())
+	case torrent.MsgAllowedFast:
+		index, err := torrent.ParseHave(msg.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to parse AllowedFast message from %s: %w", state.peer.String(), err)
+		}
+		log.Trace().Msgf("Received AllowedFast for piece %d from %s", index, state.peer.String())
+		state.allowed[int(index)] = true
+	case torrent.MsgRejectRequest:
+		if _, _, _, err := torrent.ParseRequest(msg.Payload); err != nil {
+			return fmt.Errorf("failed to parse RejectRequest message from %s: %w", state.peer.String(), err)
+		}
+		// Handled in the downloadPieceFromChokedPeer loop
+		log.Debug().Msgf("Received RejectRequest from %s", state.peer.String())
+	case torrent.MsgExtended:
+		if state.extensions == nil {
+			return fmt.Errorf("received Extended message from %s, which did not announce the extension protocol", state.peer.String())
+		}
+		state.extMu.Lock()
+		if err := torrent.Extensions.HandleMessage(state, msg.Payload); err != nil {
+			log.Debug().Msgf("Failed to handle Extended message from %s: %v", state.peer.String(), err)
+		}
+		err := state.sendPex()
+		state.extMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to send peers to %s: %w", state.peer.String(), err)
+		}
+		state.startPex()
 	default:
 		log.Warn().Msgf("Received unknown message type %d from %s", msg.Type, state.peer.String())
 	}
 	return nil
 }
 
+// fastMessageName returns the name of a Fast Extension message type, and an
+// empty string for the other message types.
+func fastMessageName(t torrent.MessageType) string {
+	switch t {
+	case torrent.MsgSuggestPiece:
+		return "SuggestPiece"
+	case torrent.MsgHaveAll:
+		return "HaveAll"
+	case torrent.MsgHaveNone:
+		return "HaveNone"
+	case torrent.MsgRejectRequest:
+		return "RejectRequest"
+	case torrent.MsgAllowedFast:
+		return "AllowedFast"
+	}
+	return ""
+}
+
 // writePiece writes a downloaded piece to the correct position in the file(s).
 // A single piece may span multiple files in a multi-file torrent.
-func writePiece(tor *torrent.Torrent, pieceIndex int, pieceData []byte, downloadPath string) error {
-	pieceOffset := int64(pieceIndex) * tor.PieceLength
-	pieceLength := int64(len(pieceData))
-
-	// Find the file(s) this piece belongs to
-	var currentOffset int64 = 0
-	for _, file := range tor.FileList {
-		filePath := filepath.Join(downloadPath, file.Path)
-
-		fileStart := currentOffset
-		fileEnd := currentOffset + file.Length
-
-		// Check if this piece overlaps with the current file
-		if pieceOffset < fileEnd && pieceOffset+pieceLength > fileStart {
-			// Calculate the overlap
-			pieceStartInFile := int64(0)
-			if pieceOffset > fileStart {
-				pieceStartInFile = pieceOffset - fileStart
-			}
-
-			fileStartInPiece := int64(0)
-			if fileStart > pieceOffset {
-				fileStartInPiece = fileStart - pieceOffset
-			}
-
-			bytesToWrite := pieceLength - fileStartInPiece
-			if fileEnd < pieceOffset+pieceLength {
-				bytesToWrite = fileEnd - (pieceOffset + fileStartInPiece)
-			}
+func writePiece(tor *torrent.Torrent, layout *torrent.Layout, pieceIndex int, pieceData []byte) error {
+	return writePieceRange(tor, layout, pieceIndex, 0, pieceData)
+}
 
-			// Open the file for writing
-			f, err := os.OpenFile(filePath, os.O_WRONLY, 0644)
-			if err != nil {
-				return err
-			}
+// writePieceRange writes data found at offset begin of a piece to the correct
+// position in the file(s).
+func writePieceRange(tor *torrent.Torrent, layout *torrent.Layout, pieceIndex int, begin int64, data []byte) error {
+	end := begin + int64(len(data))
+	for _, span := range tor.PieceSpans(pieceIndex) {
+		// Padding files are not stored
+		if tor.FileList[span.FileIndex].IsPadding() {
+			continue
+		}
 
-			// Seek to the correct position
-			_, err = f.Seek(pieceStartInFile, io.SeekStart)
-			if err != nil {
-				f.Close()
-				return err
-			}
+		// Only the part of the span that overlaps the range
+		spanBegin := max(begin, span.PieceOffset)
+		spanEnd := min(end, span.PieceOffset+span.Length)
+		if spanBegin >= spanEnd {
+			continue
+		}
 
-			// Write the piece data
-			_, err = f.Write(pieceData[fileStartInPiece : fileStartInPiece+bytesToWrite])
-			f.Close() // Close file regardless of error
-			if err != nil {
-				return err
-			}
+		// Open the file for writing
+		f, err := os.OpenFile(layout.FilePath(span.FileIndex), os.O_WRONLY, 0644)
+		if err != nil {
+			return err
 		}
 
-		currentOffset += file.Length
+		// Write the part of the range that belongs to this file
+		_, err = f.WriteAt(data[spanBegin-begin:spanEnd-begin], span.FileOffset+spanBegin-span.PieceOffset)
+		f.Close() // Close file regardless of error
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -3,18 +3,21 @@ module gtorrent
 go 1.21.5
 
 require (
-	github.com/alecthomas/kong v0.9.0 // indirect
-	github.com/go-resty/resty/v2 v2.12.0 // indirect
+	github.com/alecthomas/kong v0.9.0
+	github.com/go-resty/resty/v2 v2.12.0
+	github.com/joho/godotenv v1.5.1
+	github.com/rs/zerolog v1.32.0
+	gorm.io/driver/sqlite v1.5.5
+	gorm.io/gorm v1.25.10
+)
+
+require (
 	github.com/gofrs/uuid v4.4.0+incompatible // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-sqlite3 v1.14.17 // indirect
-	github.com/rs/zerolog v1.32.0 // indirect
 	golang.org/x/net v0.22.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
-	gorm.io/driver/sqlite v1.5.5 // indirect
-	gorm.io/gorm v1.25.10 // indirect
 )
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"gtorrent/torrent"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// listenPort is the port peers connect to, the one announced to trackers by
+// torrent.PeerMe.
+const listenPort = 6881
+
+// peerListener accepts the connections peers open to us while a torrent is
+// downloaded. We do not serve pieces: requests are rejected, but the info
+// dictionary and the peers of the swarm are shared, and the peers that
+// connect are added to the swarm.
+type peerListener struct {
+	tor      *torrent.Torrent
+	swarm    *torrent.PeerSet
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// listenForPeers starts accepting the connections of peers to tor, until
+// the listener is closed.
+func listenForPeers(tor *torrent.Torrent, swarm *torrent.PeerSet) (*peerListener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", listenPort))
+	if err != nil {
+		return nil, err
+	}
+	pl := &peerListener{tor: tor, swarm: swarm, listener: l, conns: make(map[net.Conn]bool)}
+	go pl.accept()
+	return pl, nil
+}
+
+// close stops accepting connections and closes the ones accepted so far.
+func (pl *peerListener) close() {
+	pl.listener.Close()
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for conn := range pl.conns {
+		conn.Close()
+	}
+}
+
+func (pl *peerListener) accept() {
+	for {
+		conn, err := pl.listener.Accept()
+		if err != nil {
+			return // closed
+		}
+		pl.mu.Lock()
+		pl.conns[conn] = true
+		pl.mu.Unlock()
+		go func() {
+			if err := pl.serve(conn); err != nil {
+				log.Debug().Msgf("Incoming connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			pl.mu.Lock()
+			delete(pl.conns, conn)
+			pl.mu.Unlock()
+		}()
+	}
+}
+
+// serve answers the handshake of a peer that connected to us following the
+// incoming encryption policy, then handles its messages until it hangs up
+// or stays silent for two minutes.
+func (pl *peerListener) serve(raw net.Conn) error {
+	addr, ok := raw.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("not a TCP connection")
+	}
+	conn, _, err := torrent.AcceptEncryption(raw, [][20]byte{pl.tor.InfoHash}, incomingEncryption)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	res, err := torrent.ReadHandshake(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read handshake: %w", err)
+	}
+	if res.Pstr != torrent.ProtocolIdentifier || res.InfoHash != pl.tor.InfoHash {
+		return fmt.Errorf("handshake for another torrent")
+	}
+	if _, err := conn.Write(torrent.NewHandshake(pl.tor.InfoHash, selfPeerID).Serialize()); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the port of the connection is not the one the peer listens on
+	state := &peerConnectionState{
+		peer:       &torrent.Peer{IP: addr.IP.String(), Port: uint16(addr.Port), Source: torrent.PeerFromIncoming},
+		tor:        pl.tor,
+		swarm:      pl.swarm,
+		conn:       conn,
+		bitfield:   make(torrent.Bitfield, (len(pl.tor.Pieces)+7)/8),
+		peerChoked: true,
+		startTime:  time.Now(),
+	}
+	defer state.close()
+	log.Debug().Msgf("Accepted a connection from %s", state.peer.String())
+	if err := state.negotiate(res, pl.tor); err != nil {
+		return err
+	}
+
+	added := false
+	for {
+		msg, err := readMessageWithTimeout(conn, 2*time.Minute)
+		if err != nil {
+			return err
+		}
+		if msg.Type == torrent.MsgBitfield && !state.received {
+			if len(msg.Payload) != len(state.bitfield) {
+				return fmt.Errorf("invalid bitfield length")
+			}
+			copy(state.bitfield, msg.Payload)
+			state.received = true
+			continue
+		}
+		if err := handleMessage(state, msg, -1); err != nil {
+			return err
+		}
+		// the extended handshake tells the port the peer listens on
+		if !added && state.extensions != nil && state.extensions.Port != 0 {
+			added = true
+			pl.swarm.Add(&torrent.Peer{IP: state.peer.IP, Port: state.extensions.Port, Source: torrent.PeerFromIncoming})
+		}
+	}
+}
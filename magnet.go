@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"gtorrent/torrent"
+	"os"
+)
+
+// printMagnet prints the magnet link of the torrent file at path on standard output.
+func printMagnet(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tor, err := torrent.TorrentFromBytes(content)
+	if err != nil {
+		return err
+	}
+	fmt.Println(tor.MagnetURI())
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"gtorrent/db"
 	"gtorrent/torrent"
 	"os"
+	"strings"
 
 	"github.com/alecthomas/kong"
 	"github.com/rs/zerolog/log"
@@ -14,15 +15,51 @@ const VERSION = "0.1.0"
 
 var CLI struct {
 	Verify struct {
-		Torrent     string `arg:"" help:"Torrent file to verify." type:"existingfile"`
-		ContentPath string `arg:"" optional:"" help:"Path to the content files." type:"existingdir"`
+		Torrent     string   `arg:"" help:"Torrent file to verify." type:"existingfile"`
+		ContentPath string   `arg:"" optional:"" help:"Path to the content files." type:"existingdir"`
+		JSON        bool     `name:"json" help:"Print the report as JSON."`
+		Files       []string `sep:"none" help:"Only check files matching this path or pattern, can be repeated."`
+		Repair      bool     `help:"Download the bad and missing pieces again, then verify once more."`
 	} `cmd:"" help:"Verify a torrent file."`
 	Download struct {
-		Torrent string `arg:"" help:"Torrent file to download."`
-	} `cmd:"" help:"Download a torrent file."`
+		Torrent string `arg:"" help:"Torrent file or magnet link to download."`
+	} `cmd:"" help:"Download a torrent file or a magnet link."`
+	Create struct {
+		Path        string   `arg:"" help:"File or directory to share." type:"existingpath"`
+		Output      string   `short:"o" help:"Torrent file to write, <name>.torrent if not set."`
+		Announce    []string `short:"a" sep:"none" help:"Tracker tier, repeat for more tiers. Separate trackers of the same tier with commas."`
+		WebSeed     []string `short:"w" sep:"none" help:"Web seed URL, can be repeated."`
+		PieceLength int64    `help:"Piece length in bytes, chosen automatically if not set."`
+		Private     bool     `help:"Mark the torrent as private."`
+		Comment     string   `help:"Comment to store in the torrent."`
+		CreatedBy   string   `help:"Creator to store in the torrent, gTorrent and its version if not set."`
+		NoDate      bool     `help:"Leave out the creation date."`
+	} `cmd:"" help:"Create a torrent file."`
+	CheckMeta struct {
+		Torrent string `arg:"" help:"Torrent file to check." type:"existingfile"`
+	} `cmd:"" help:"Check the metainfo of a torrent file and list its problems."`
+	Magnet struct {
+		Torrent string `arg:"" help:"Torrent file to print a magnet link for." type:"existingfile"`
+	} `cmd:"" help:"Print the magnet link of a torrent file."`
+	Bencode struct {
+		Dump struct {
+			File   string `arg:"" help:"Bencoded file to dump, such as a .torrent file." type:"existingfile"`
+			Base64 bool   `name:"base64" help:"Write binary strings as base64 instead of hex."`
+		} `cmd:"" help:"Print a bencoded file as JSON."`
+		Build struct {
+			JSON   string `arg:"" name:"json" help:"JSON file in the format written by dump." type:"existingfile"`
+			Output string `short:"o" help:"File to write, standard output if not set."`
+		} `cmd:"" help:"Encode a JSON file back into bencode."`
+	} `cmd:"" help:"Inspect and hand-craft bencoded files."`
 }
 var mainDB *db.Database
 
+// outgoingEncryption is the encryption policy of the connections we open to peers.
+var outgoingEncryption torrent.EncryptionPolicy
+
+// incomingEncryption is the encryption policy of the connections peers open to us.
+var incomingEncryption torrent.EncryptionPolicy
+
 func main() {
 	println("goTorrent v" + VERSION)
 	initConfig()
@@ -32,19 +69,56 @@ func main() {
 	cmd := ctx.Command()
 	switch cmd {
 	case "verify <torrent> <content-path>":
-		err := torrent.VerifyTorrent(CLI.Verify.Torrent, CLI.Verify.ContentPath)
+		err := verifyContent(CLI.Verify.Torrent, CLI.Verify.ContentPath, CLI.Verify.Files, CLI.Verify.JSON, CLI.Verify.Repair)
 		if err != nil {
 			log.Error().Err(err).Msg("Error verifying torrent")
-			return
+			// let scripts tell incomplete content apart
+			shutdownLogging()
+			os.Exit(1)
 		}
 		println("Torrent verified successfully.")
 	case "download <torrent>":
 		initDB()
-		err := DownloadTorrent(CLI.Download.Torrent)
+		var err error
+		if strings.HasPrefix(CLI.Download.Torrent, "magnet:") {
+			err = DownloadMagnet(CLI.Download.Torrent)
+		} else {
+			err = DownloadTorrent(CLI.Download.Torrent)
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("Error downloading torrent")
 			return
 		}
+	case "create <path>":
+		err := createTorrent()
+		if err != nil {
+			log.Error().Err(err).Msg("Error creating torrent")
+			return
+		}
+	case "check-meta <torrent>":
+		err := checkMeta(CLI.CheckMeta.Torrent)
+		if err != nil {
+			log.Error().Err(err).Msg("Error checking torrent")
+			return
+		}
+	case "magnet <torrent>":
+		err := printMagnet(CLI.Magnet.Torrent)
+		if err != nil {
+			log.Error().Err(err).Msg("Error creating magnet link")
+			return
+		}
+	case "bencode dump <file>":
+		err := dumpBencode(CLI.Bencode.Dump.File, CLI.Bencode.Dump.Base64)
+		if err != nil {
+			log.Error().Err(err).Msg("Error dumping bencoded file")
+			return
+		}
+	case "bencode build <json>":
+		err := buildBencode(CLI.Bencode.Build.JSON, CLI.Bencode.Build.Output)
+		if err != nil {
+			log.Error().Err(err).Msg("Error building bencoded file")
+			return
+		}
 	default:
 		ctx.PrintUsage(false)
 	}
@@ -61,6 +135,15 @@ func initConfig() {
 	if err := os.MkdirAll(config.Main.DownloadDir, os.ModePerm); err != nil {
 		log.Fatal().Err(err).Str("path", config.Main.DownloadDir).Msg("Failed to create download directory")
 	}
+
+	// check the encryption policies
+	var err error
+	if outgoingEncryption, err = torrent.ParseEncryptionPolicy(config.Main.Encryption.Outgoing); err != nil {
+		log.Fatal().Err(err).Msg("Invalid ENCRYPTION_OUTGOING")
+	}
+	if incomingEncryption, err = torrent.ParseEncryptionPolicy(config.Main.Encryption.Incoming); err != nil {
+		log.Fatal().Err(err).Msg("Invalid ENCRYPTION_INCOMING")
+	}
 }
 
 func initDB() {
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gtorrent/torrent"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxMetadataPeers is the number of peers metadata is downloaded from at once.
+const maxMetadataPeers = 8
+
+// magnetPeers asks every tracker of the magnet link for peers. stub stands
+// for the torrent while its info dictionary is unknown.
+func magnetPeers(magnet *torrent.Magnet, stub *torrent.Torrent) (map[string]*torrent.Peer, error) {
+	if len(magnet.Trackers) == 0 {
+		return nil, fmt.Errorf("magnet link has no trackers")
+	}
+	me := torrent.PeerMe()
+	peers := make(map[string]*torrent.Peer)
+	for _, announce := range magnet.Trackers {
+		tracker, err := torrent.NewTracker(announce)
+		if err != nil {
+			log.Warn().Err(err).Str("tracker", announce).Msg("Failed to create tracker, skipping")
+			continue
+		}
+		log.Info().Msg("Getting peers from tracker: " + announce)
+		tPeers, err := tracker.GetPeers(stub, me)
+		if err != nil {
+			log.Error().Err(err).Msg("Error getting peers from tracker")
+			continue
+		}
+		log.Info().Msgf("Got %d peers from tracker", len(tPeers))
+		for _, peer := range tPeers {
+			if peer.String() == me.String() || peer.IP == "0.0.0.0" {
+				continue
+			}
+			peers[peer.String()] = peer
+		}
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers found for the magnet link")
+	}
+	return peers, nil
+}
+
+// fetchMetadata downloads the info dictionary of stub from several peers at
+// once with the ut_metadata extension (BEP 9). The info dictionary returned
+// matches the info hash of stub.
+func fetchMetadata(stub *torrent.Torrent, peers map[string]*torrent.Peer) ([]byte, error) {
+	download := torrent.NewMetadataDownload(stub.InfoHash)
+	slots := make(chan struct{}, maxMetadataPeers)
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		select {
+		case <-download.Done():
+		case slots <- struct{}{}:
+			wg.Add(1)
+			go func(peer *torrent.Peer) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				if err := fetchMetadataFromPeer(stub, peer, download); err != nil {
+					log.Warn().Msgf("Failed to get metadata from peer %s: %v", peer.String(), err)
+				}
+			}(peer)
+		}
+	}
+	wg.Wait()
+
+	info := download.Info()
+	if info == nil {
+		return nil, fmt.Errorf("no peer sent the metadata")
+	}
+	log.Info().Msgf("Received %d bytes of metadata", len(info))
+	return info, nil
+}
+
+// fetchMetadataFromPeer requests metadata pieces from peer, one at a time,
+// until the metadata download is complete.
+func fetchMetadataFromPeer(stub *torrent.Torrent, peer *torrent.Peer, download *torrent.MetadataDownload) error {
+	state := &peerConnectionState{
+		peer:       peer,
+		peerChoked: true,
+		startTime:  time.Now(),
+		metadata:   download,
+	}
+	conn, err := torrent.DialPeer(peer, stub.InfoHash, outgoingEncryption, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	state.conn = conn
+	defer state.close()
+
+	res, err := torrent.PerformHandshake(state.conn, stub, selfPeerID)
+	if err != nil {
+		return err
+	}
+	if !res.SupportsExtensions() {
+		return fmt.Errorf("peer does not support the extension protocol")
+	}
+	if err := state.negotiate(res, stub); err != nil {
+		return err
+	}
+
+	timeout := time.After(60 * time.Second)
+	requested := -1 // piece waiting for an answer
+	for {
+		select {
+		case <-download.Done():
+			return nil
+		case <-timeout:
+			return fmt.Errorf("metadata download timed out")
+		default:
+		}
+		if requested >= 0 && download.Has(state.Addr(), requested) {
+			requested = -1
+		}
+		if requested < 0 && state.extensions.MetadataSize > 0 {
+			if err := download.SetSize(state.Addr(), state.extensions.MetadataSize); err != nil {
+				return err
+			}
+			piece, ok := download.Request(state.Addr())
+			if !ok {
+				return nil
+			}
+			payload, err := torrent.FormatMetadata(&torrent.MetadataMessage{Type: torrent.MetadataRequest, Piece: int64(piece)}, nil)
+			if err != nil {
+				return err
+			}
+			if err := state.SendExtended(torrent.UtMetadata, payload); err != nil {
+				return err
+			}
+			requested = piece
+		}
+
+		msg, err := readMessageWithTimeout(state.conn, 10*time.Second)
+		if err != nil {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+		// only extended messages matter until we have the metadata
+		if msg.Type != torrent.MsgExtended {
+			continue
+		}
+		err = torrent.Extensions.HandleMessage(state, msg.Payload)
+		if errors.Is(err, torrent.ErrMetadataMismatch) && !download.Banned(state.Addr()) {
+			// the pieces came from several peers, ask for them again
+			log.Warn().Msgf("Metadata from %s and other peers failed the hash check: %v", peer.String(), err)
+			requested = -1
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error handling message: %w", err)
+		}
+		// the first extended message is the extended handshake
+		if _, ok := state.extensions.ID(torrent.UtMetadata); !ok || state.extensions.MetadataSize == 0 {
+			return fmt.Errorf("peer does not share metadata")
+		}
+	}
+}
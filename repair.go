@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"gtorrent/db/models"
+	"gtorrent/torrent"
+
+	"github.com/rs/zerolog/log"
+)
+
+// repairContent downloads the pieces that report found bad or missing again
+// from the peers and web seeds of the torrent, and writes them in place below
+// contentPath. The good pieces are left as they are.
+func repairContent(torrentFile string, tor *torrent.Torrent, contentPath string, report *torrent.VerifyReport) error {
+	wanted := make([]bool, len(report.Pieces))
+	wantedPieces := 0
+	for i, state := range report.Pieces {
+		if state == torrent.PieceBad || state == torrent.PieceMissing {
+			wanted[i] = true
+			wantedPieces++
+		}
+	}
+	log.Info().Msgf("Repairing %d pieces of %s", wantedPieces, tor.Name)
+
+	initDB()
+	cachePath, err := cacheTorrentFile(torrentFile)
+	if err != nil {
+		return err
+	}
+	dlModel, err := mainDB.CreateDownload(tor, cachePath)
+	if err != nil {
+		return err
+	}
+	peers, err := findPeers(tor, dlModel)
+	if err != nil && len(tor.UrlList) == 0 {
+		return err
+	}
+	if len(peers) == 0 && len(tor.UrlList) == 0 {
+		return fmt.Errorf("no peers found to repair %s", tor.Name)
+	}
+
+	dlModel.Status = models.DownloadInProgress
+	mainDB.UpdateDownload(dlModel)
+	err = startDownloadFromPeers(tor, peers, contentPath, dlModel, wanted, nil)
+	if err != nil {
+		dlModel.Status = models.DownloadError
+		dlModel.LastError = err.Error()
+		mainDB.UpdateDownload(dlModel)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gtorrent/db/models"
+	"gtorrent/torrent"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// partialPiece holds the blocks of a piece received so far. It is carried from
+// peer to peer while the piece is downloaded, and written to disk with the
+// fast-resume record when the piece is left unfinished.
+type partialPiece struct {
+	data     []byte
+	received []bool
+}
+
+func newPartialPiece(size int64) *partialPiece {
+	return &partialPiece{
+		data:     make([]byte, size),
+		received: make([]bool, (size+torrent.BlockSize-1)/torrent.BlockSize),
+	}
+}
+
+// blockRange returns the offset and the length of block b of the piece.
+func (p *partialPiece) blockRange(b int) (int64, int64) {
+	begin := int64(b) * torrent.BlockSize
+	return begin, min(torrent.BlockSize, int64(len(p.data))-begin)
+}
+
+// receivedBlocks returns the number of blocks received so far.
+func (p *partialPiece) receivedBlocks() int {
+	count := 0
+	for _, received := range p.received {
+		if received {
+			count++
+		}
+	}
+	return count
+}
+
+// resumeDownload returns the pieces of the download that are still wanted
+// and the unfinished pieces already on disk. The fast-resume record of the
+// download is trusted for the files on disk that still match it, the pieces
+// of the other files are checked again, as is all the existing data without
+// a record. A new record is saved afterwards.
+func resumeDownload(tor *torrent.Torrent, downloadPath string, dlModel *models.Download) ([]bool, map[int]*partialPiece, error) {
+	layout, err := torrent.NewLayout(tor, downloadPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	wanted, partials, ok := loadResume(tor, layout, dlModel)
+	if ok {
+		log.Info().Msg("Resuming from the fast-resume record")
+	} else {
+		wanted, err = checkExistingData(tor, downloadPath)
+		if err != nil || wanted == nil {
+			return wanted, nil, err
+		}
+		partials = make(map[int]*partialPiece)
+	}
+	downloaded := make([]bool, len(wanted))
+	for i := range wanted {
+		downloaded[i] = !wanted[i]
+	}
+	if err := saveResume(tor, layout, dlModel, downloaded, partials); err != nil {
+		log.Warn().Err(err).Msg("Failed to save the fast-resume record")
+	}
+	return wanted, partials, nil
+}
+
+// statFiles returns the size and modification time of every file of the
+// torrent on disk. Padding files are never stored and are left empty.
+func statFiles(tor *torrent.Torrent, layout *torrent.Layout) []models.ResumeFile {
+	files := make([]models.ResumeFile, len(tor.FileList))
+	for fileIndex, file := range tor.FileList {
+		files[fileIndex].Index = fileIndex
+		if file.IsPadding() {
+			continue
+		}
+		info, err := os.Lstat(layout.FilePath(fileIndex))
+		if err != nil {
+			files[fileIndex].Size = -1
+			continue
+		}
+		files[fileIndex].Size = info.Size()
+		files[fileIndex].ModTime = info.ModTime().UnixNano()
+	}
+	return files
+}
+
+// loadResume reads the fast-resume record of the download. The pieces of
+// the files that changed since the record was saved are checked on disk
+// again, the others are taken from the record. ok is false if there is no
+// record for the torrent.
+func loadResume(tor *torrent.Torrent, layout *torrent.Layout, dlModel *models.Download) (wanted []bool, partials map[int]*partialPiece, ok bool) {
+	if len(tor.Pieces) == 0 || len(dlModel.Pieces) != len(tor.Pieces) || len(dlModel.ResumeFiles) != len(tor.FileList) {
+		return nil, nil, false
+	}
+	changed := make([]int, 0)
+	for i, file := range statFiles(tor, layout) {
+		saved := dlModel.ResumeFiles[i]
+		if saved.Index != i {
+			return nil, nil, false
+		}
+		if saved.Size != file.Size || saved.ModTime != file.ModTime {
+			log.Info().Msgf("%s changed since the fast-resume record was saved", tor.FileList[i].Path)
+			changed = append(changed, i)
+		}
+	}
+
+	wanted = make([]bool, len(tor.Pieces))
+	partials = make(map[int]*partialPiece)
+	for i, piece := range dlModel.Pieces {
+		if piece.Index != i || !bytes.Equal(piece.Hash, tor.Pieces[i][:]) {
+			return nil, nil, false
+		}
+		wanted[i] = !piece.IsDownloaded
+		if piece.IsDownloaded || len(piece.Blocks) == 0 {
+			continue
+		}
+		// read back the blocks of the unfinished piece
+		partial := newPartialPiece(tor.PieceSize(i))
+		if _, err := layout.ReadPiece(i, partial.data); err != nil {
+			continue
+		}
+		for b := range partial.received {
+			partial.received[b] = torrent.Bitfield(piece.Blocks).HasPiece(b)
+		}
+		partials[i] = partial
+	}
+	if len(changed) == 0 {
+		return wanted, partials, true
+	}
+
+	// the record of the pieces in the changed files no longer holds
+	report, err := layout.Verify(torrent.VerifyOptions{Files: changed})
+	if err != nil {
+		return nil, nil, false
+	}
+	for i, state := range report.Pieces {
+		if state == torrent.PieceSkipped {
+			continue
+		}
+		wanted[i] = state != torrent.PieceGood
+		delete(partials, i)
+	}
+	log.Info().Msgf("Found %d of %d pieces of the changed files on disk", report.Good, report.Good+report.Bad+report.Missing)
+	return wanted, partials, true
+}
+
+// saveResume saves the fast-resume record of the download: the pieces
+// downloaded so far, the unfinished pieces, whose blocks are written to disk
+// first, and the state of the files afterwards.
+func saveResume(tor *torrent.Torrent, layout *torrent.Layout, dlModel *models.Download, downloaded []bool, partials map[int]*partialPiece) error {
+	if len(dlModel.Pieces) != len(tor.Pieces) {
+		return fmt.Errorf("download has %d pieces, torrent has %d", len(dlModel.Pieces), len(tor.Pieces))
+	}
+	changed := make([]*models.Piece, 0)
+	for i := range dlModel.Pieces {
+		piece := &dlModel.Pieces[i]
+		var blocks []byte
+		if partial, ok := partials[i]; ok && !downloaded[i] && partial.receivedBlocks() > 0 {
+			blocks = make(torrent.Bitfield, (len(partial.received)+7)/8)
+			for b, received := range partial.received {
+				if received {
+					torrent.Bitfield(blocks).SetPiece(b)
+				}
+			}
+			if !bytes.Equal(piece.Blocks, blocks) {
+				if err := writePartialPiece(tor, layout, i, partial); err != nil {
+					return err
+				}
+			}
+		}
+		if piece.Index != i || !bytes.Equal(piece.Hash, tor.Pieces[i][:]) || piece.IsDownloaded != downloaded[i] || !bytes.Equal(piece.Blocks, blocks) {
+			piece.Index = i
+			piece.Hash = tor.Pieces[i][:]
+			piece.IsDownloaded = downloaded[i]
+			piece.Blocks = blocks
+			changed = append(changed, piece)
+		}
+	}
+	dlModel.ResumeFiles = statFiles(tor, layout)
+	return mainDB.SaveResume(dlModel, changed)
+}
+
+// writePartialPiece writes the blocks of an unfinished piece received so far
+// to the correct position in the file(s).
+func writePartialPiece(tor *torrent.Torrent, layout *torrent.Layout, pieceIndex int, partial *partialPiece) error {
+	for b, received := range partial.received {
+		if !received {
+			continue
+		}
+		begin, length := partial.blockRange(b)
+		if err := writePieceRange(tor, layout, pieceIndex, begin, partial.data[begin:begin+length]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"gtorrent/bencode"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsPadding reports whether the file is a BEP 47 padding file. Padding files
+// only align the next file to a piece boundary, they are all zeros and are
+// never stored on disk.
+func (f *File) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+// IsExecutable reports whether the file should be marked executable.
+func (f *File) IsExecutable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+// IsHidden reports whether the file should be hidden. Only Windows has a
+// hidden attribute, elsewhere hidden files are simply named with a leading dot.
+func (f *File) IsHidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+// IsSymlink reports whether the file is a symbolic link to SymlinkPath.
+func (f *File) IsSymlink() bool {
+	return strings.Contains(f.Attr, "l")
+}
+
+// readFileAttributes reads the BEP 47 keys of a file dictionary, or of the
+// info dictionary of a single-file torrent.
+func readFileAttributes(r *metainfoReader, dict map[string]*bencode.Data, field string, file *File) {
+	if attr, ok := r.str(dict, field, "attr", false); ok {
+		file.Attr = attr
+	}
+	if sum, ok := r.value(dict, field, "sha1", bencode.STRING, false); ok {
+		if len(sum.AsBytes()) != 20 {
+			r.addf(joinField(field, "sha1"), "length %d, expected 20", len(sum.AsBytes()))
+		} else {
+			file.SHA1 = bytes.Clone(sum.AsBytes())
+		}
+	}
+	if file.IsSymlink() {
+		target, ok := r.list(dict, field, "symlink path", true)
+		if ok {
+			file.SymlinkPath = strings.Join(r.strings(target, joinField(field, "symlink path")), "/")
+		}
+		if file.Length != 0 {
+			r.addf(joinField(field, "length"), "symlinks have no content, got length %d", file.Length)
+		}
+	}
+	if file.IsPadding() && file.IsSymlink() {
+		r.addf(joinField(field, "attr"), "a file cannot be both padding and a symlink")
+	}
+}
+
+// SymlinkTarget returns the target of the symlink at index i, relative to the
+// directory of the link. Targets are sanitized like file paths, so a link can
+// only point inside the root of the layout.
+func (l *Layout) SymlinkTarget(i int) (string, error) {
+	file := l.tor.FileList[i]
+	components := sanitizePath(file.SymlinkPath, l.windows)
+	if len(components) == 0 {
+		return "", fmt.Errorf("symlink %q has no target", file.Path)
+	}
+	target := filepath.Join(l.Root, filepath.Join(components...))
+	return filepath.Rel(filepath.Dir(l.paths[i]), target)
+}
+
+// ApplyAttributes applies the attributes of the file at index i once its
+// content is complete: symlinks are created and executable files get their
+// execute bits.
+func (l *Layout) ApplyAttributes(i int) error {
+	file := l.tor.FileList[i]
+	path := l.paths[i]
+	if file.IsSymlink() {
+		target, err := l.SymlinkTarget(i)
+		if err != nil {
+			return err
+		}
+		if existing, err := os.Readlink(path); err == nil && existing == target {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return err
+		}
+		// replace an empty placeholder file or an old link, but never data
+		if info, err := os.Lstat(path); err == nil && (info.IsDir() || info.Mode().IsRegular() && info.Size() > 0) {
+			return fmt.Errorf("symlink %q: %s is in the way", file.Path, path)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(target, path)
+	}
+	if file.IsExecutable() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		// execute permission for whoever may read the file
+		return os.Chmod(path, info.Mode()|(info.Mode()&0444)>>2)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"gtorrent/bencode"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseFileAttributes(t *testing.T) {
+	d := bencode.NewData
+	type dict = map[string]*bencode.Data
+	sum := bytes.Repeat([]byte{0xab}, 20)
+	files := []*bencode.Data{
+		d(dict{"length": d(100), "path": d([]*bencode.Data{d("bin"), d("run.sh")}), "attr": d("x"), "sha1": d(sum)}),
+		d(dict{"length": d(16284), "path": d([]*bencode.Data{d(".pad"), d("16284")}), "attr": d("p")}),
+		d(dict{"length": d(0), "path": d([]*bencode.Data{d("link")}), "attr": d("l"),
+			"symlink path": d([]*bencode.Data{d("bin"), d("run.sh")})}),
+		d(dict{"length": d(10), "path": d([]*bencode.Data{d(".hidden")}), "attr": d("h")}),
+	}
+	info := dict{
+		"name":         d("attrs"),
+		"piece length": d(16384),
+		"pieces":       d(make([]byte, 40)),
+		"files":        d(files),
+	}
+	tor, err := TorrentFromBytes(bencode.Encode(d(dict{"info": d(info)})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exe, pad, link, hidden := tor.FileList[0], tor.FileList[1], tor.FileList[2], tor.FileList[3]
+	if !exe.IsExecutable() || !bytes.Equal(exe.SHA1, sum) || exe.IsPadding() {
+		t.Errorf("executable file got = %+v", exe)
+	}
+	if !pad.IsPadding() || pad.IsExecutable() {
+		t.Errorf("padding file got = %+v", pad)
+	}
+	if !link.IsSymlink() || link.SymlinkPath != "bin/run.sh" {
+		t.Errorf("symlink got = %+v", link)
+	}
+	if !hidden.IsHidden() {
+		t.Errorf("hidden file got = %+v", hidden)
+	}
+
+	// a symlink with content or without a target is invalid
+	files[2] = d(dict{"length": d(5), "path": d([]*bencode.Data{d("link")}), "attr": d("l")})
+	files[0].AsDict()["sha1"] = d("short")
+	info["pieces"] = d(make([]byte, 40))
+	_, err = TorrentFromBytes(bencode.Encode(d(dict{"info": d(info)})))
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 3 {
+		t.Errorf("TorrentFromBytes() error = %v, want 3 problems", err)
+	}
+}
+
+func TestPaddingReadsAsZeros(t *testing.T) {
+	tor := NewTorrent()
+	tor.PieceLength = 1024
+	pad := NewFile(1000, ".pad/1000")
+	pad.Attr = "p"
+	tor.FileList = append(tor.FileList, NewFile(24, "a"), pad)
+	tor.Length = 1024
+	setFileOffsets(tor)
+	layout, err := NewLayout(tor, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(layout.FilePath(0), bytes.Repeat([]byte{1}, 24), 0644); err != nil {
+		t.Fatal(err)
+	}
+	piece, err := layout.ReadPiece(0, bytes.Repeat([]byte{0xff}, 1024))
+	want := append(bytes.Repeat([]byte{1}, 24), make([]byte, 1000)...)
+	if err != nil || !bytes.Equal(piece, want) {
+		t.Errorf("ReadPiece() got %d bytes, err %v, want the file followed by 1000 zeros", len(piece), err)
+	}
+	if _, err := os.Stat(layout.FilePath(1)); !os.IsNotExist(err) {
+		t.Errorf("padding file was created on disk: %v", err)
+	}
+}
+
+func TestApplyAttributes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and execute bits need a POSIX file system")
+	}
+	root := t.TempDir()
+	tor := NewTorrent()
+	exe := NewFile(4, "bin/run.sh")
+	exe.Attr = "x"
+	link := NewFile(0, "docs/link")
+	link.Attr = "l"
+	link.SymlinkPath = "bin/run.sh"
+	escape := NewFile(0, "escape")
+	escape.Attr = "l"
+	escape.SymlinkPath = "../../../etc/passwd"
+	tor.FileList = append(tor.FileList, exe, link, escape)
+
+	layout, err := NewLayout(tor, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(layout.FilePath(0)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(layout.FilePath(0), []byte("echo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	for i := range tor.FileList {
+		if err := layout.ApplyAttributes(i); err != nil {
+			t.Fatalf("ApplyAttributes(%d) error = %v", i, err)
+		}
+	}
+
+	info, err := os.Stat(layout.FilePath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("executable mode got = %v, want %v", info.Mode().Perm(), os.FileMode(0750))
+	}
+	if target, err := os.Readlink(layout.FilePath(1)); err != nil || target != filepath.Join("..", "bin", "run.sh") {
+		t.Errorf("symlink target got = %q, err %v", target, err)
+	}
+	if content, err := os.ReadFile(layout.FilePath(1)); err != nil || string(content) != "echo" {
+		t.Errorf("reading through the symlink got = %q, err %v", content, err)
+	}
+	target, err := os.Readlink(layout.FilePath(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved := filepath.Join(root, target); !isBelow(root, resolved) {
+		t.Errorf("symlink escapes the download directory: %s", resolved)
+	}
+
+	// applying again is a no-op
+	if err := layout.ApplyAttributes(1); err != nil {
+		t.Errorf("ApplyAttributes() again error = %v", err)
+	}
+
+	// an empty placeholder is replaced, a file with data is kept
+	for _, content := range []string{"", "data"} {
+		os.Remove(layout.FilePath(1))
+		if err := os.WriteFile(layout.FilePath(1), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := layout.ApplyAttributes(1)
+		if (err != nil) != (content != "") {
+			t.Errorf("ApplyAttributes() over a file with %q error = %v", content, err)
+		}
+		info, _ := os.Lstat(layout.FilePath(1))
+		if isLink := info != nil && info.Mode()&os.ModeSymlink != 0; isLink != (content == "") {
+			t.Errorf("ApplyAttributes() over a file with %q made a symlink = %v", content, isLink)
+		}
+	}
+	if data, _ := os.ReadFile(layout.FilePath(1)); string(data) != "data" {
+		t.Errorf("file in the way of a symlink got = %q, want %q", data, "data")
+	}
+}
@@ -0,0 +1,280 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"gtorrent/bencode"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Piece length bounds used when CreateOptions.PieceLength is not set.
+const (
+	minAutoPieceLength = 16 * 1024
+	maxAutoPieceLength = 16 * 1024 * 1024
+	targetPieceCount   = 1500
+)
+
+// CreateOptions describes a torrent to be created by Create.
+type CreateOptions struct {
+	Path          string     // file or directory to share
+	Name          string     // name of the torrent, the base name of Path if empty
+	PieceLength   int64      // piece length in bytes, a power of two; chosen automatically if zero
+	AnnounceTiers [][]string // tracker tiers (BEP 12), the first tracker also becomes "announce"
+	WebSeeds      []string   // web seed URLs written to "url-list" (BEP 19)
+	Private       bool       // set the private flag (BEP 27)
+	Comment       string
+	CreatedBy     string
+	CreationDate  time.Time // left out of the torrent when zero
+	Workers       int       // number of hashing goroutines, runtime.NumCPU() if zero
+}
+
+// sourceFile is a file that goes into a torrent being created.
+type sourceFile struct {
+	fsPath string   // path on disk
+	path   []string // path components inside the torrent
+	length int64
+	offset int64 // offset of the file in the concatenated content
+}
+
+// Create walks the file or directory in opts.Path, hashes its pieces in
+// parallel and returns the bencoded .torrent file.
+func Create(opts CreateOptions) ([]byte, error) {
+	files, err := collectFiles(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	var totalLength int64
+	for _, file := range files {
+		totalLength += file.length
+	}
+	if totalLength == 0 {
+		return nil, fmt.Errorf("no content to share in %s", opts.Path)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = AutoPieceLength(totalLength)
+	}
+	if pieceLength < BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d must be a power of two of at least %d", pieceLength, BlockSize)
+	}
+
+	pieces, err := hashPieces(files, totalLength, pieceLength, opts.Workers)
+	if err != nil {
+		return nil, err
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = filepath.Base(filepath.Clean(opts.Path))
+	}
+	info := map[string]*bencode.Data{
+		"name":         bencode.NewData(name),
+		"piece length": bencode.NewData(pieceLength),
+		"pieces":       bencode.NewData(pieces),
+	}
+	if opts.Private {
+		info["private"] = bencode.NewData(1)
+	}
+	if len(files) == 1 && len(files[0].path) == 0 {
+		info["length"] = bencode.NewData(files[0].length)
+	} else {
+		fileList := make([]*bencode.Data, 0, len(files))
+		for _, file := range files {
+			path := make([]*bencode.Data, len(file.path))
+			for i, component := range file.path {
+				path[i] = bencode.NewData(component)
+			}
+			fileList = append(fileList, bencode.NewData(map[string]*bencode.Data{
+				"length": bencode.NewData(file.length),
+				"path":   bencode.NewData(path),
+			}))
+		}
+		info["files"] = bencode.NewData(fileList)
+	}
+
+	root := map[string]*bencode.Data{
+		"info": bencode.NewData(info),
+	}
+	tiers := make([]*bencode.Data, 0, len(opts.AnnounceTiers))
+	trackerCount := 0
+	for _, tier := range opts.AnnounceTiers {
+		if len(tier) == 0 {
+			continue
+		}
+		urls := make([]*bencode.Data, len(tier))
+		for i, announce := range tier {
+			urls[i] = bencode.NewData(announce)
+		}
+		tiers = append(tiers, bencode.NewData(urls))
+		trackerCount += len(tier)
+	}
+	if len(tiers) > 0 {
+		root["announce"] = tiers[0].AsList()[0]
+		if trackerCount > 1 {
+			root["announce-list"] = bencode.NewData(tiers)
+		}
+	}
+	if len(opts.WebSeeds) > 0 {
+		urlList := make([]*bencode.Data, len(opts.WebSeeds))
+		for i, url := range opts.WebSeeds {
+			urlList[i] = bencode.NewData(url)
+		}
+		root["url-list"] = bencode.NewData(urlList)
+	}
+	if opts.Comment != "" {
+		root["comment"] = bencode.NewData(opts.Comment)
+	}
+	if opts.CreatedBy != "" {
+		root["created by"] = bencode.NewData(opts.CreatedBy)
+	}
+	if !opts.CreationDate.IsZero() {
+		root["creation date"] = bencode.NewData(opts.CreationDate.Unix())
+	}
+
+	return bencode.Encode(bencode.NewData(root)), nil
+}
+
+// AutoPieceLength picks a power of two piece length that keeps the number of
+// pieces around 1500, between 16 KiB and 16 MiB.
+func AutoPieceLength(totalLength int64) int64 {
+	pieceLength := int64(minAutoPieceLength)
+	for pieceLength < maxAutoPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// collectFiles lists the regular files under root in lexical order. A single
+// file yields one entry with an empty path, as used by single-file torrents.
+func collectFiles(root string) ([]*sourceFile, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return []*sourceFile{{fsPath: root, length: stat.Size()}}, nil
+	}
+
+	files := make([]*sourceFile, 0)
+	var offset int64
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &sourceFile{
+			fsPath: path,
+			path:   strings.Split(filepath.ToSlash(rel), "/"),
+			length: info.Size(),
+			offset: offset,
+		})
+		offset += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files found in %s", root)
+	}
+	return files, nil
+}
+
+// hashPieces computes the concatenated SHA-1 piece hashes of files, hashing
+// pieces on several goroutines.
+func hashPieces(files []*sourceFile, totalLength, pieceLength int64, workers int) ([]byte, error) {
+	pieceCount := int((totalLength + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, pieceCount*sha1.Size)
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	jobs := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for index := range jobs {
+				start := int64(index) * pieceLength
+				length := min(pieceLength, totalLength-start)
+				if err := readContent(files, start, buf[:length]); err != nil {
+					errs <- err
+					return
+				}
+				hash := sha1.Sum(buf[:length])
+				copy(pieces[index*sha1.Size:], hash[:])
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for i := 0; i < pieceCount; i++ {
+		select {
+		case jobs <- i:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pieces, nil
+}
+
+// readContent fills buf with the concatenated content of files starting at offset.
+func readContent(files []*sourceFile, offset int64, buf []byte) error {
+	for _, file := range files {
+		if len(buf) == 0 {
+			break
+		}
+		if offset >= file.offset+file.length || file.length == 0 {
+			continue
+		}
+		n := min(int64(len(buf)), file.offset+file.length-offset)
+		f, err := os.Open(file.fsPath)
+		if err != nil {
+			return err
+		}
+		_, err = f.ReadAt(buf[:n], offset-file.offset)
+		f.Close()
+		if err == io.EOF {
+			err = fmt.Errorf("%s changed size while hashing", file.fsPath)
+		}
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+		offset += n
+	}
+	return nil
+}
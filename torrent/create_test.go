@@ -0,0 +1,131 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCreateMatchesExistingTorrent(t *testing.T) {
+	content, err := os.ReadFile("../example/meditations_marcus_aurelius.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := TorrentFromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := Create(CreateOptions{
+		Path:          "../example/Meditations - Marcus Aurelius.txt",
+		PieceLength:   want.PieceLength,
+		Private:       true,
+		AnnounceTiers: [][]string{{"http://tracker.best-torrents.net:6969/announce"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := TorrentFromBytes(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InfoHash != want.InfoHash {
+		t.Errorf("Expected InfoHash to be %x, got %x", want.InfoHash, got.InfoHash)
+	}
+	if !slices.Equal(got.AnnounceList, []string{"http://tracker.best-torrents.net:6969/announce"}) {
+		t.Errorf("Unexpected AnnounceList %v", got.AnnounceList)
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "release")
+	files := map[string]int{
+		"a.bin":         40000,
+		"sub/b.bin":     1,
+		"sub/c/d.bin":   70000,
+		"sub/empty.txt": 0,
+	}
+	for name, size := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created, err := Create(CreateOptions{
+		Path:          dir,
+		PieceLength:   32768,
+		AnnounceTiers: [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+		WebSeeds:      []string{"https://example.com/release/"},
+		Comment:       "build artifacts",
+		CreatedBy:     "gTorrent",
+		CreationDate:  time.Unix(1714777334, 0),
+		Workers:       3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err := TorrentFromBytes(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tor.Name != "release" || tor.Length != 110001 || len(tor.FileList) != 4 {
+		t.Errorf("Unexpected torrent %s", tor.String())
+	}
+	if tor.FileList[2].Path != "sub/c/d.bin" {
+		t.Errorf("Expected files in lexical order, got %s", tor.FileList[2].Path)
+	}
+	if tor.Comment != "build artifacts" || tor.CreatedAt != 1714777334 || !slices.Equal(tor.UrlList, []string{"https://example.com/release/"}) {
+		t.Errorf("Unexpected metadata %s", tor.String())
+	}
+	if len(tor.AnnounceList) != 3 {
+		t.Errorf("Expected 3 trackers, got %v", tor.AnnounceList)
+	}
+
+	// pieces run across file boundaries over the concatenated content
+	var stream []byte
+	for _, file := range tor.FileList {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, data...)
+	}
+	if len(tor.Pieces) != 4 {
+		t.Fatalf("Expected 4 pieces, got %d", len(tor.Pieces))
+	}
+	for i, piece := range tor.Pieces {
+		end := min(int64(i+1)*tor.PieceLength, int64(len(stream)))
+		if hash := sha1.Sum(stream[int64(i)*tor.PieceLength : end]); !bytes.Equal(hash[:], piece[:]) {
+			t.Errorf("Expected piece %d to be %x, got %x", i, hash, piece)
+		}
+	}
+}
+
+func TestAutoPieceLength(t *testing.T) {
+	tests := []struct {
+		length int64
+		want   int64
+	}{
+		{length: 1, want: 16 * 1024},
+		{length: 100 << 20, want: 128 * 1024},
+		{length: 4 << 30, want: 4 << 20},
+		{length: 1 << 40, want: 16 << 20},
+	}
+	for _, tt := range tests {
+		if got := AutoPieceLength(tt.length); got != tt.want {
+			t.Errorf("AutoPieceLength(%d) = %d, want %d", tt.length, got, tt.want)
+		}
+	}
+}
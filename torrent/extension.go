@@ -0,0 +1,233 @@
+package torrent
+
+import (
+	"fmt"
+	"gtorrent/bencode"
+	"net"
+	"sort"
+	"sync"
+)
+
+// ExtendedHandshakeID is the extended message ID of the extended handshake.
+// Every other MsgExtended message starts with the ID the receiver assigned
+// to its extension in its extended handshake.
+const ExtendedHandshakeID = 0
+
+// SupportsExtensions reports whether the handshake announces the extension protocol.
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
+// ExtendedHandshake is the dictionary exchanged in the extended handshake.
+type ExtendedHandshake struct {
+	M            map[string]int64 `bencode:"m"`                       // extended message ID of every supported extension, 0 to disable one
+	V            string           `bencode:"v,omitempty"`             // client name and version
+	P            int64            `bencode:"p,omitempty"`             // TCP port the client listens on
+	Reqq         int64            `bencode:"reqq,omitempty"`          // number of outstanding requests the client accepts
+	YourIP       []byte           `bencode:"yourip,omitempty"`        // the IP address of the receiver as the sender sees it, 4 or 16 bytes
+	MetadataSize int64            `bencode:"metadata_size,omitempty"` // size of the info dictionary (BEP 9)
+}
+
+// Message returns the extended handshake as a message.
+func (h *ExtendedHandshake) Message() (*Message, error) {
+	payload, err := bencode.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return FormatExtended(ExtendedHandshakeID, payload), nil
+}
+
+// ParseExtendedHandshake parses the dictionary of an extended handshake.
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	h := &ExtendedHandshake{}
+	if err := bencode.Unmarshal(payload, h); err != nil {
+		return nil, fmt.Errorf("invalid extended handshake: %w", err)
+	}
+	return h, nil
+}
+
+// FormatExtended creates an extended message with the given extended message ID.
+func FormatExtended(id uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &Message{Type: MsgExtended, Payload: buf}
+}
+
+// ParseExtended splits the payload of an extended message into its extended
+// message ID and the payload of the extension.
+func ParseExtended(payload []byte) (id uint8, data []byte, err error) {
+	if len(payload) < 1 {
+		err = fmt.Errorf("extended payload too short: %d bytes", len(payload))
+		return
+	}
+	return payload[0], payload[1:], nil
+}
+
+// PeerExtensions is what a peer announced in its extended handshakes. Each
+// connection keeps its own.
+type PeerExtensions struct {
+	IDs          map[string]uint8 // extended message ID to use for each extension the peer supports
+	Client       string
+	Port         uint16
+	RequestQueue int
+	YourIP       net.IP // our address as the peer sees it
+	MetadataSize int64
+}
+
+// NewPeerExtensions returns the extensions of a peer that did not send its
+// extended handshake yet.
+func NewPeerExtensions() *PeerExtensions {
+	return &PeerExtensions{IDs: make(map[string]uint8)}
+}
+
+// ID returns the extended message ID the peer wants for the extension name,
+// ok is false if the peer does not support it.
+func (p *PeerExtensions) ID(name string) (id uint8, ok bool) {
+	id, ok = p.IDs[name]
+	return
+}
+
+// Update applies an extended handshake. A handshake may be sent again at any
+// time: it only changes the keys it carries, and an ID of 0 disables an
+// extension.
+func (p *PeerExtensions) Update(h *ExtendedHandshake) {
+	for name, id := range h.M {
+		if id <= 0 || id > 255 {
+			delete(p.IDs, name)
+			continue
+		}
+		p.IDs[name] = uint8(id)
+	}
+	if h.V != "" {
+		p.Client = h.V
+	}
+	if h.P > 0 && h.P <= 65535 {
+		p.Port = uint16(h.P)
+	}
+	if h.Reqq > 0 {
+		p.RequestQueue = int(h.Reqq)
+	}
+	if len(h.YourIP) == net.IPv4len || len(h.YourIP) == net.IPv6len {
+		p.YourIP = net.IP(h.YourIP)
+	}
+	if h.MetadataSize > 0 {
+		p.MetadataSize = h.MetadataSize
+	}
+}
+
+// ExtendedPeer is the side of a connection that extensions talk to.
+type ExtendedPeer interface {
+	// Extensions returns what the peer announced in its extended handshakes.
+	Extensions() *PeerExtensions
+	// SendExtended sends payload to the peer as a message of the extension name.
+	SendExtended(name string, payload []byte) error
+}
+
+// ExtensionHandler handles the payload of an extended message received from peer.
+type ExtensionHandler func(peer ExtendedPeer, payload []byte) error
+
+// ExtensionRegistry holds the extensions a client supports. Extensions plug
+// in by name and get the extended message ID peers use to reach them.
+type ExtensionRegistry struct {
+	mu       sync.RWMutex
+	names    []string // extension of every ID, starting at ID 1
+	handlers map[string]ExtensionHandler
+}
+
+// NewExtensionRegistry returns an empty registry.
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{handlers: make(map[string]ExtensionHandler)}
+}
+
+// Extensions is the registry of the extensions gtorrent supports.
+var Extensions = NewExtensionRegistry()
+
+// Register adds the extension name and returns the extended message ID peers
+// have to use for it. Registering a name again replaces its handler.
+func (r *ExtensionRegistry) Register(name string, handler ExtensionHandler) (uint8, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name == "" {
+		return 0, fmt.Errorf("extension name cannot be empty")
+	}
+	if handler == nil {
+		return 0, fmt.Errorf("extension %s has no handler", name)
+	}
+	if _, ok := r.handlers[name]; !ok {
+		if len(r.names) == 255 {
+			return 0, fmt.Errorf("too many extensions")
+		}
+		r.names = append(r.names, name)
+	}
+	r.handlers[name] = handler
+	return r.id(name), nil
+}
+
+func (r *ExtensionRegistry) id(name string) uint8 {
+	for i, n := range r.names {
+		if n == name {
+			return uint8(i + 1)
+		}
+	}
+	return 0
+}
+
+// ID returns the extended message ID of the extension name, ok is false if
+// it is not registered.
+func (r *ExtensionRegistry) ID(name string) (id uint8, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id = r.id(name)
+	return id, id != 0
+}
+
+// Names returns the names of the registered extensions in lexical order.
+func (r *ExtensionRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := append([]string(nil), r.names...)
+	sort.Strings(names)
+	return names
+}
+
+// Handshake returns an extended handshake announcing every registered
+// extension. The caller fills in the other keys.
+func (r *ExtensionRegistry) Handshake() *ExtendedHandshake {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h := &ExtendedHandshake{M: make(map[string]int64, len(r.names))}
+	for i, name := range r.names {
+		h.M[name] = int64(i + 1)
+	}
+	return h
+}
+
+// HandleMessage handles the payload of an extended message from peer: an
+// extended handshake updates the extensions of the peer, other messages go
+// to the handler of their extension. Messages for unknown IDs are an error.
+func (r *ExtensionRegistry) HandleMessage(peer ExtendedPeer, payload []byte) error {
+	id, data, err := ParseExtended(payload)
+	if err != nil {
+		return err
+	}
+	if id == ExtendedHandshakeID {
+		h, err := ParseExtendedHandshake(data)
+		if err != nil {
+			return err
+		}
+		peer.Extensions().Update(h)
+		return nil
+	}
+
+	r.mu.RLock()
+	var handler ExtensionHandler
+	if int(id) <= len(r.names) {
+		handler = r.handlers[r.names[id-1]]
+	}
+	r.mu.RUnlock()
+	if handler == nil {
+		return fmt.Errorf("extended message for unknown ID %d", id)
+	}
+	return handler(peer, data)
+}
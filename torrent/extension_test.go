@@ -0,0 +1,150 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// testExtendedPeer records the extended messages sent to it.
+type testExtendedPeer struct {
+	extensions *PeerExtensions
+	sent       map[string][]byte
+}
+
+func (p *testExtendedPeer) Extensions() *PeerExtensions {
+	return p.extensions
+}
+
+func (p *testExtendedPeer) SendExtended(name string, payload []byte) error {
+	p.sent[name] = payload
+	return nil
+}
+
+func TestHandshakeReserved(t *testing.T) {
+	var infoHash, peerID [20]byte
+	h := NewHandshake(infoHash, peerID)
+	read, err := ReadHandshake(bytes.NewReader(h.Serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Reserved != h.Reserved || !read.SupportsExtensions() {
+		t.Errorf("ReadHandshake() reserved got = %x, want %x", read.Reserved, h.Reserved)
+	}
+}
+
+func TestExtendedHandshake(t *testing.T) {
+	h := &ExtendedHandshake{
+		M:            map[string]int64{"ut_metadata": 1, "ut_pex": 2},
+		V:            "gTorrent 0.1.0",
+		Reqq:         250,
+		YourIP:       []byte{10, 0, 0, 1},
+		MetadataSize: 31235,
+	}
+	msg, err := h.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != MsgExtended {
+		t.Errorf("Message() type got = %v, want %v", msg.Type, MsgExtended)
+	}
+	id, payload, err := ParseExtended(msg.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != ExtendedHandshakeID {
+		t.Errorf("ParseExtended() id got = %v, want %v", id, ExtendedHandshakeID)
+	}
+	got, err := ParseExtendedHandshake(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, h) {
+		t.Errorf("ParseExtendedHandshake() got = %+v, want %+v", got, h)
+	}
+
+	if _, err := ParseExtendedHandshake([]byte("d1:mi1ee")); err == nil {
+		t.Errorf("ParseExtendedHandshake() with an integer m got no error")
+	}
+	if _, _, err := ParseExtended(nil); err == nil {
+		t.Errorf("ParseExtended() of an empty payload got no error")
+	}
+}
+
+func TestPeerExtensionsUpdate(t *testing.T) {
+	ext := NewPeerExtensions()
+	ext.Update(&ExtendedHandshake{
+		M:      map[string]int64{"ut_metadata": 3, "ut_pex": 1, "bad": 300},
+		V:      "Other 1.0",
+		P:      6881,
+		YourIP: net.ParseIP("2001:db8::1"),
+	})
+	// a later handshake only changes what it carries
+	ext.Update(&ExtendedHandshake{M: map[string]int64{"ut_pex": 0}, MetadataSize: 100})
+
+	want := &PeerExtensions{
+		IDs:          map[string]uint8{"ut_metadata": 3},
+		Client:       "Other 1.0",
+		Port:         6881,
+		YourIP:       net.ParseIP("2001:db8::1"),
+		MetadataSize: 100,
+	}
+	if !reflect.DeepEqual(ext, want) {
+		t.Errorf("Update() got = %+v, want %+v", ext, want)
+	}
+	if _, ok := ext.ID("ut_pex"); ok {
+		t.Errorf("ID() of a disabled extension got ok")
+	}
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	r := NewExtensionRegistry()
+	var received []byte
+	metadataID, err := r.Register("ut_metadata", func(peer ExtendedPeer, payload []byte) error {
+		received = payload
+		return peer.SendExtended("ut_metadata", []byte("reply"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pex := func(peer ExtendedPeer, payload []byte) error { return nil }
+	pexID, _ := r.Register("ut_pex", pex)
+	if again, _ := r.Register("ut_pex", pex); again != pexID {
+		t.Errorf("Register() again got id %d, want %d", again, pexID)
+	}
+	if _, err := r.Register("", pex); err == nil {
+		t.Errorf("Register() without a name got no error")
+	}
+	if _, err := r.Register("lt_donthave", nil); err == nil {
+		t.Errorf("Register() without a handler got no error")
+	}
+
+	want := map[string]int64{"ut_metadata": int64(metadataID), "ut_pex": int64(pexID)}
+	if got := r.Handshake().M; !reflect.DeepEqual(got, want) {
+		t.Errorf("Handshake() m got = %v, want %v", got, want)
+	}
+	if id, ok := r.ID("ut_pex"); !ok || id != pexID {
+		t.Errorf("ID() got = %d, %v, want %d, true", id, ok, pexID)
+	}
+
+	peer := &testExtendedPeer{extensions: NewPeerExtensions(), sent: map[string][]byte{}}
+	handshake, _ := (&ExtendedHandshake{M: map[string]int64{"ut_metadata": 7}}).Message()
+	if err := r.HandleMessage(peer, handshake.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := peer.extensions.ID("ut_metadata"); id != 7 {
+		t.Errorf("HandleMessage() of a handshake got peer id %d, want 7", id)
+	}
+
+	// the peer reaches our extension with the id we assigned to it
+	if err := r.HandleMessage(peer, FormatExtended(metadataID, []byte("request")).Payload); err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "request" || string(peer.sent["ut_metadata"]) != "reply" {
+		t.Errorf("HandleMessage() got payload %q and reply %q", received, peer.sent["ut_metadata"])
+	}
+	if err := r.HandleMessage(peer, FormatExtended(42, nil).Payload); err == nil {
+		t.Errorf("HandleMessage() with an unknown id got no error")
+	}
+}
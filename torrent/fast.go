@@ -0,0 +1,33 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SupportsFast reports whether the handshake announces the Fast Extension (BEP 6).
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[7]&0x04 != 0
+}
+
+// ParseRequest extracts index, begin and length from the payload of a
+// Request, Cancel or RejectRequest message.
+func ParseRequest(payload []byte) (index, begin, length uint32, err error) {
+	if len(payload) != 12 {
+		err = fmt.Errorf("request payload invalid length: %d", len(payload))
+		return
+	}
+	index = binary.BigEndian.Uint32(payload[0:4])
+	begin = binary.BigEndian.Uint32(payload[4:8])
+	length = binary.BigEndian.Uint32(payload[8:12])
+	return
+}
+
+// HaveAll returns a bitfield of numPieces pieces with every piece set.
+func HaveAll(numPieces int) Bitfield {
+	bf := make(Bitfield, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	return bf
+}
@@ -0,0 +1,29 @@
+package torrent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFastMessages(t *testing.T) {
+	var infoHash, peerID [20]byte
+	h, err := ReadHandshake(bytes.NewReader(NewHandshake(infoHash, peerID).Serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.SupportsFast() {
+		t.Errorf("SupportsFast() of our handshake got false")
+	}
+
+	index, begin, length, err := ParseRequest(FormatRequest(3, 16384, 1000))
+	if err != nil || index != 3 || begin != 16384 || length != 1000 {
+		t.Errorf("ParseRequest() got = %d %d %d %v, want 3 16384 1000", index, begin, length, err)
+	}
+	if _, _, _, err := ParseRequest(make([]byte, 8)); err == nil {
+		t.Errorf("ParseRequest() of a short payload got no error")
+	}
+
+	if got, want := HaveAll(10), (Bitfield{0xff, 0xc0}); !bytes.Equal(got, want) {
+		t.Errorf("HaveAll(10) got = %08b, want %08b", got, want)
+	}
+}
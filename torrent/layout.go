@@ -0,0 +1,181 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxComponentLength is the longest file name, in bytes, that common file systems accept.
+const maxComponentLength = 255
+
+// Layout maps the files of a torrent to paths on disk below a root directory.
+// File paths come from the torrent and cannot be trusted: every component is
+// sanitized so that no file of the torrent can end up outside the root.
+type Layout struct {
+	Root    string
+	tor     *Torrent
+	paths   []string
+	windows bool
+}
+
+// NewLayout resolves the files of tor below root. It fails if two files end up
+// at the same path, or a file at the path of another file's directory.
+func NewLayout(tor *Torrent, root string) (*Layout, error) {
+	return newLayout(tor, root, runtime.GOOS == "windows")
+}
+
+func newLayout(tor *Torrent, root string, windows bool) (*Layout, error) {
+	root = filepath.Clean(root)
+	layout := &Layout{
+		Root:    root,
+		tor:     tor,
+		paths:   make([]string, len(tor.FileList)),
+		windows: windows,
+	}
+	files := make(map[string]int, len(tor.FileList))
+	dirs := make(map[string]bool)
+	for i, file := range tor.FileList {
+		components := sanitizePath(file.Path, windows)
+		if len(components) == 0 {
+			return nil, fmt.Errorf("file %d has an empty path", i)
+		}
+		rel := filepath.Join(components...)
+		fullPath := filepath.Join(root, rel)
+		if !isBelow(root, fullPath) {
+			return nil, fmt.Errorf("file %q resolves outside of %s", file.Path, root)
+		}
+		layout.paths[i] = fullPath
+		if file.IsPadding() {
+			// padding files may share a name, they are never stored
+			continue
+		}
+		if file.IsSymlink() {
+			if _, err := layout.SymlinkTarget(i); err != nil {
+				return nil, err
+			}
+		}
+
+		key := rel
+		if windows {
+			key = strings.ToLower(key)
+		}
+		if first, ok := files[key]; ok {
+			return nil, fmt.Errorf("files %q and %q both resolve to %s", tor.FileList[first].Path, file.Path, rel)
+		}
+		if dirs[key] {
+			return nil, fmt.Errorf("file %q resolves to %s, which is also a directory", file.Path, rel)
+		}
+		for dir := filepath.Dir(key); dir != "."; dir = filepath.Dir(dir) {
+			if first, ok := files[dir]; ok {
+				return nil, fmt.Errorf("file %q needs %q to be a directory", file.Path, tor.FileList[first].Path)
+			}
+			dirs[dir] = true
+		}
+		files[key] = i
+	}
+	return layout, nil
+}
+
+// FilePath returns the path on disk of the file at index i of the torrent's FileList.
+func (l *Layout) FilePath(i int) string {
+	return l.paths[i]
+}
+
+// SafeName returns name made safe to use as a single file or directory name,
+// such as the directory a torrent is downloaded into.
+func SafeName(name string) string {
+	components := sanitizePath(strings.ReplaceAll(name, "/", "_"), runtime.GOOS == "windows")
+	if len(components) == 0 {
+		return "_"
+	}
+	return components[0]
+}
+
+// sanitizePath splits a "/" separated torrent path into components that are
+// safe to join below a directory. Empty and "." components are dropped.
+func sanitizePath(path string, windows bool) []string {
+	components := make([]string, 0)
+	for _, component := range strings.Split(path, "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		components = append(components, sanitizeComponent(component, windows))
+	}
+	return components
+}
+
+// Names that Windows reserves for devices, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeComponent rewrites a single path component so that it is a plain
+// file name: separators, control characters and invalid UTF-8 are replaced
+// with "_", ".." becomes "_", and over-long names are truncated. On Windows
+// reserved characters, device names and trailing dots and spaces are
+// rewritten as well.
+func sanitizeComponent(component string, windows bool) string {
+	original := component
+	component = strings.ToValidUTF8(component, "_")
+	component = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f || r == '/' || r == '\\':
+			return '_'
+		case windows && strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, component)
+
+	if component == ".." {
+		component = "_"
+	}
+	if windows {
+		if trimmed := strings.TrimRight(component, ". "); trimmed != component {
+			component = trimmed + "_"
+		}
+		stem, _, _ := strings.Cut(component, ".")
+		if windowsReservedNames[strings.ToUpper(stem)] {
+			component = "_" + component
+		}
+	}
+	return truncateComponent(component, original)
+}
+
+// truncateComponent shortens component to maxComponentLength bytes. The
+// extension is kept and a hash of the original name is added, so that two long
+// names sharing a prefix still map to different files, the same ones every time.
+func truncateComponent(component, original string) string {
+	if len(component) <= maxComponentLength {
+		return component
+	}
+	sum := sha1.Sum([]byte(original))
+	suffix := "~" + hex.EncodeToString(sum[:4])
+	ext := filepath.Ext(component)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	stem := component[:len(component)-len(ext)]
+	keep := maxComponentLength - len(suffix) - len(ext)
+	// cut on a rune boundary
+	for keep > 0 && !utf8.RuneStart(stem[keep]) {
+		keep--
+	}
+	return stem[:keep] + suffix + ext
+}
+
+// isBelow reports whether path is inside root, both being clean paths.
+func isBelow(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,159 @@
+package torrent
+
+import (
+	"gtorrent/bencode"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		windows bool
+		want    []string
+	}{
+		{"dir/file.txt", false, []string{"dir", "file.txt"}},
+		{"../../etc/passwd", false, []string{"_", "_", "etc", "passwd"}},
+		{"/etc/passwd", false, []string{"etc", "passwd"}},
+		{"a/./b//c", false, []string{"a", "b", "c"}},
+		{"..", false, []string{"_"}},
+		{"...", false, []string{"..."}},
+		{`a\..\..\b`, false, []string{`a_.._.._b`}},
+		{"nul\x00byte\nnewline", false, []string{"nul_byte_newline"}},
+		{"bad\xffutf8", false, []string{"bad_utf8"}},
+		{"what: a file?", false, []string{"what: a file?"}},
+		{"what: a file?", true, []string{"what_ a file_"}},
+		{`C:\Windows\system32`, true, []string{"C__Windows_system32"}},
+		{"CON", true, []string{"_CON"}},
+		{"dir/com1.txt", true, []string{"dir", "_com1.txt"}},
+		{"console.txt", true, []string{"console.txt"}},
+		{"trailing. ", true, []string{"trailing_"}},
+		{"CON", false, []string{"CON"}},
+	}
+	for _, tt := range tests {
+		got := sanitizePath(tt.path, tt.windows)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sanitizePath(%q, %v) got = %q, want %q", tt.path, tt.windows, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateComponent(t *testing.T) {
+	long := strings.Repeat("a", 300) + ".mkv"
+	other := strings.Repeat("a", 299) + "b.mkv"
+	got := sanitizeComponent(long, false)
+	if len(got) != maxComponentLength || !strings.HasSuffix(got, ".mkv") {
+		t.Errorf("sanitizeComponent() got %d bytes %q, want %d bytes ending in .mkv", len(got), got, maxComponentLength)
+	}
+	if again := sanitizeComponent(long, false); again != got {
+		t.Errorf("sanitizeComponent() is not deterministic: %q and %q", got, again)
+	}
+	if otherGot := sanitizeComponent(other, false); otherGot == got {
+		t.Errorf("sanitizeComponent() truncated two different names to %q", got)
+	}
+
+	// multi-byte runes are never cut in half
+	runes := strings.Repeat("é", 200)
+	got = sanitizeComponent(runes, false)
+	if len(got) > maxComponentLength || !strings.HasPrefix(runes, strings.Split(got, "~")[0]) {
+		t.Errorf("sanitizeComponent() got = %q", got)
+	}
+}
+
+func TestLayout(t *testing.T) {
+	newTorrent := func(paths ...string) *Torrent {
+		tor := NewTorrent()
+		for _, path := range paths {
+			tor.FileList = append(tor.FileList, NewFile(1, path))
+		}
+		return tor
+	}
+	root := filepath.Join(t.TempDir(), "download")
+
+	tests := []struct {
+		name    string
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{"plain", []string{"a/b.txt", "c.txt"}, []string{"a/b.txt", "c.txt"}, false},
+		{"traversal", []string{"../../outside", "/abs/file"}, []string{"_/_/outside", "abs/file"}, false},
+		{"same file", []string{"a/b", "a//b"}, nil, true},
+		{"file and directory", []string{"a", "a/b"}, nil, true},
+		{"directory and file", []string{"a/b", "a"}, nil, true},
+		{"empty path", []string{"./"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := newLayout(newTorrent(tt.paths...), root, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newLayout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for i, want := range tt.want {
+				got := layout.FilePath(i)
+				if got != filepath.Join(root, filepath.FromSlash(want)) {
+					t.Errorf("FilePath(%d) got = %s, want %s", i, got, want)
+				}
+				if !isBelow(root, got) {
+					t.Errorf("FilePath(%d) = %s is outside of %s", i, got, root)
+				}
+			}
+		})
+	}
+
+	// padding files may share a path
+	tor := newTorrent("a", ".pad/16384", "b", ".pad/16384")
+	tor.FileList[1].Attr = "p"
+	tor.FileList[3].Attr = "p"
+	if _, err := newLayout(tor, root, false); err != nil {
+		t.Errorf("newLayout() with repeated padding files error = %v", err)
+	}
+
+	// on Windows names differing only in case are the same file
+	if _, err := newLayout(newTorrent("Readme.txt", "README.TXT"), root, true); err == nil {
+		t.Error("newLayout() accepted files differing only in case on Windows")
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	tests := map[string]string{
+		"My Torrent": "My Torrent",
+		"../..":      ".._..",
+		"..":         "_",
+		"":           "_",
+		"a/b":        "a_b",
+	}
+	for name, want := range tests {
+		if got := SafeName(name); got != want {
+			t.Errorf("SafeName(%q) got = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestUTF8PathKeys(t *testing.T) {
+	d := bencode.NewData
+	file := d(map[string]*bencode.Data{
+		"length":     d(10),
+		"path":       d([]*bencode.Data{d("\xe9t\xe9.txt")}),
+		"path.utf-8": d([]*bencode.Data{d("été.txt")}),
+	})
+	info := map[string]*bencode.Data{
+		"name":         d("caf\xe9"),
+		"name.utf-8":   d("café"),
+		"piece length": d(16384),
+		"pieces":       d(make([]byte, 20)),
+		"files":        d([]*bencode.Data{file}),
+	}
+	tor, err := TorrentFromBytes(bencode.Encode(d(map[string]*bencode.Data{"info": d(info)})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tor.Name != "café" || tor.FileList[0].Path != "été.txt" {
+		t.Errorf("TorrentFromBytes() got name %q and path %q, want the UTF-8 versions", tor.Name, tor.FileList[0].Path)
+	}
+}
@@ -0,0 +1,212 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Multihash prefix of a SHA-256 digest, as used by "urn:btmh:" (BEP 52)
+	btmhSHA256Prefix = "1220"
+	// Upper bound on the number of file indices a "so" parameter may expand to
+	maxSelectOnly = 1 << 16
+)
+
+// Magnet is the content of a magnet link (BEP 9, BEP 53).
+type Magnet struct {
+	InfoHash   [20]byte // v1 info hash, zero if the link only carries a v2 hash
+	InfoHashV2 [32]byte // v2 info hash from "urn:btmh:", zero if absent
+	Name       string   // display name (dn)
+	Trackers   []string // tracker URLs (tr)
+	WebSeeds   []string // web seed URLs (ws)
+	Length     int64    // exact length in bytes (xl), zero if unknown
+	SelectOnly []int    // indices of the files to download (so), all files if empty
+}
+
+// HasV1 reports whether the magnet carries a v1 info hash.
+func (m *Magnet) HasV1() bool {
+	return m.InfoHash != [20]byte{}
+}
+
+// HasV2 reports whether the magnet carries a v2 info hash.
+func (m *Magnet) HasV2() bool {
+	return m.InfoHashV2 != [32]byte{}
+}
+
+// ParseMagnet parses a magnet URI. At least one v1 (hex or base32) or v2
+// info hash is required, every other parameter is optional. Indexed
+// parameters such as "tr.1" are accepted like their plain forms and unknown
+// parameters are ignored.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("invalid magnet link: scheme is %q", u.Scheme)
+	}
+
+	magnet := &Magnet{
+		Trackers: make([]string, 0),
+		WebSeeds: make([]string, 0),
+	}
+	// the query is walked by hand, url.ParseQuery would lose the order of the trackers
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnet link: %w", err)
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnet link: %w", err)
+		}
+		// "tr.1", "xt.2" and so on are indexed forms of "tr" and "xt"
+		if base, index, ok := strings.Cut(key, "."); ok {
+			if _, err := strconv.Atoi(index); err == nil {
+				key = base
+			}
+		}
+		switch key {
+		case "xt":
+			if err := magnet.parseExactTopic(value); err != nil {
+				return nil, err
+			}
+		case "dn":
+			magnet.Name = value
+		case "tr":
+			magnet.Trackers = append(magnet.Trackers, value)
+		case "ws":
+			magnet.WebSeeds = append(magnet.WebSeeds, value)
+		case "xl":
+			length, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid magnet link: bad exact length %q", value)
+			}
+			magnet.Length = length
+		case "so":
+			selection, err := parseSelectOnly(value)
+			if err != nil {
+				return nil, err
+			}
+			magnet.SelectOnly = append(magnet.SelectOnly, selection...)
+		}
+	}
+
+	if !magnet.HasV1() && !magnet.HasV2() {
+		return nil, fmt.Errorf("invalid magnet link: no BitTorrent info hash")
+	}
+	return magnet, nil
+}
+
+// parseExactTopic reads a "urn:btih:" or "urn:btmh:" info hash. Other topics
+// are ignored, a magnet link may point to the same content on other networks.
+func (m *Magnet) parseExactTopic(value string) error {
+	switch {
+	case strings.HasPrefix(value, "urn:btih:"):
+		hash := value[len("urn:btih:"):]
+		var b []byte
+		var err error
+		switch len(hash) {
+		case 40:
+			b, err = hex.DecodeString(hash)
+		case 32:
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("length %d", len(hash))
+		}
+		if err != nil {
+			return fmt.Errorf("invalid magnet link: bad info hash %q: %w", hash, err)
+		}
+		copy(m.InfoHash[:], b)
+	case strings.HasPrefix(value, "urn:btmh:"):
+		hash := value[len("urn:btmh:"):]
+		if !strings.HasPrefix(hash, btmhSHA256Prefix) || len(hash) != len(btmhSHA256Prefix)+64 {
+			return fmt.Errorf("invalid magnet link: unsupported multihash %q", hash)
+		}
+		b, err := hex.DecodeString(hash[len(btmhSHA256Prefix):])
+		if err != nil {
+			return fmt.Errorf("invalid magnet link: bad v2 info hash %q: %w", hash, err)
+		}
+		copy(m.InfoHashV2[:], b)
+	}
+	return nil
+}
+
+// parseSelectOnly parses a BEP 53 file selection such as "0,2,4-6".
+func parseSelectOnly(value string) ([]int, error) {
+	selection := make([]int, 0)
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid magnet link: bad file selection %q", value)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start || end-start >= maxSelectOnly-len(selection) {
+				return nil, fmt.Errorf("invalid magnet link: bad file selection %q", value)
+			}
+		}
+		for i := start; i <= end; i++ {
+			selection = append(selection, i)
+		}
+	}
+	return selection, nil
+}
+
+// String returns the magnet URI. The v1 info hash comes first, so that
+// clients without v2 support can still use links to hybrid torrents.
+func (m *Magnet) String() string {
+	params := make([]string, 0)
+	if m.HasV1() {
+		params = append(params, "xt=urn:btih:"+hex.EncodeToString(m.InfoHash[:]))
+	}
+	if m.HasV2() {
+		params = append(params, "xt=urn:btmh:"+btmhSHA256Prefix+hex.EncodeToString(m.InfoHashV2[:]))
+	}
+	if m.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(m.Name))
+	}
+	if m.Length > 0 {
+		params = append(params, "xl="+strconv.FormatInt(m.Length, 10))
+	}
+	for _, tracker := range m.Trackers {
+		params = append(params, "tr="+url.QueryEscape(tracker))
+	}
+	for _, webSeed := range m.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(webSeed))
+	}
+	if len(m.SelectOnly) > 0 {
+		indices := make([]string, len(m.SelectOnly))
+		for i, index := range m.SelectOnly {
+			indices[i] = strconv.Itoa(index)
+		}
+		params = append(params, "so="+strings.Join(indices, ","))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// MagnetURI returns a magnet link to the torrent with its name, trackers and web seeds.
+func (t *Torrent) MagnetURI() string {
+	magnet := &Magnet{
+		Name:     t.Name,
+		Trackers: t.AnnounceList,
+		WebSeeds: t.UrlList,
+	}
+	if t.HasV1() {
+		magnet.InfoHash = t.InfoHash
+	}
+	if t.HasV2() {
+		magnet.InfoHashV2 = t.InfoHashV2
+	}
+	return magnet.String()
+}
@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestParseMagnet(t *testing.T) {
+	const v1Hex = "c9e15763f722f23e98a29decdfae341b98d53056"
+	const v2Hex = "caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+	var v1 [20]byte
+	copy(v1[:], mustHex(v1Hex))
+	var v2 [32]byte
+	copy(v2[:], mustHex(v2Hex))
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    *Magnet
+		wantErr bool
+	}{
+		{
+			name: "hex info hash",
+			uri:  "magnet:?xt=urn:btih:" + v1Hex + "&dn=Some+Name&tr=udp%3A%2F%2Ftracker.example%3A6969&tr=http://b.example/announce",
+			want: &Magnet{
+				InfoHash: v1,
+				Name:     "Some Name",
+				Trackers: []string{"udp://tracker.example:6969", "http://b.example/announce"},
+				WebSeeds: []string{},
+			},
+		},
+		{
+			name: "base32 info hash",
+			uri:  "magnet:?xt=urn:btih:ZHQVOY7XELZD5GFCTXWN7LRUDOMNKMCW",
+			want: &Magnet{InfoHash: v1, Trackers: []string{}, WebSeeds: []string{}},
+		},
+		{
+			name: "hybrid with every parameter",
+			uri: "magnet:?xt=urn:btih:" + v1Hex + "&xt=urn:btmh:1220" + v2Hex +
+				"&xl=12345&ws=https%3A%2F%2Fmirror.example%2Ffile&tr.1=http://a.example&tr.2=http://b.example&so=0,2,4-6&x.pe=1.2.3.4:5",
+			want: &Magnet{
+				InfoHash:   v1,
+				InfoHashV2: v2,
+				Length:     12345,
+				Trackers:   []string{"http://a.example", "http://b.example"},
+				WebSeeds:   []string{"https://mirror.example/file"},
+				SelectOnly: []int{0, 2, 4, 5, 6},
+			},
+		},
+		{
+			name: "v2 only",
+			uri:  "magnet:?xt=urn:btmh:1220" + v2Hex,
+			want: &Magnet{InfoHashV2: v2, Trackers: []string{}, WebSeeds: []string{}},
+		},
+		{name: "not a magnet", uri: "http://example.com/?xt=urn:btih:" + v1Hex, wantErr: true},
+		{name: "no info hash", uri: "magnet:?dn=name", wantErr: true},
+		{name: "short info hash", uri: "magnet:?xt=urn:btih:c9e157", wantErr: true},
+		{name: "bad hex", uri: "magnet:?xt=urn:btih:z9e15763f722f23e98a29decdfae341b98d53056", wantErr: true},
+		{name: "unknown multihash", uri: "magnet:?xt=urn:btmh:1114" + v1Hex, wantErr: true},
+		{name: "bad length", uri: "magnet:?xt=urn:btih:" + v1Hex + "&xl=-1", wantErr: true},
+		{name: "bad selection", uri: "magnet:?xt=urn:btih:" + v1Hex + "&so=3-1", wantErr: true},
+		{name: "huge selection", uri: "magnet:?xt=urn:btih:" + v1Hex + "&so=0-999999999", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMagnet(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMagnet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMagnet() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMagnetRoundTrip(t *testing.T) {
+	tor := NewTorrent()
+	tor.Name = "name with spaces & symbols"
+	tor.AnnounceList = []string{"udp://tracker.example:6969/announce", "http://b.example/announce?key=a&b=c"}
+	tor.UrlList = []string{"https://mirror.example/content/"}
+	tor.MetaVersion = 1
+	copy(tor.InfoHash[:], mustHex("c9e15763f722f23e98a29decdfae341b98d53056"))
+
+	uri := tor.MagnetURI()
+	want := "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&dn=name+with+spaces+%26+symbols" +
+		"&tr=udp%3A%2F%2Ftracker.example%3A6969%2Fannounce&tr=http%3A%2F%2Fb.example%2Fannounce%3Fkey%3Da%26b%3Dc" +
+		"&ws=https%3A%2F%2Fmirror.example%2Fcontent%2F"
+	if uri != want {
+		t.Errorf("MagnetURI() got = %s, want %s", uri, want)
+	}
+
+	magnet, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magnet.InfoHash != tor.InfoHash || magnet.Name != tor.Name ||
+		!reflect.DeepEqual(magnet.Trackers, tor.AnnounceList) || !reflect.DeepEqual(magnet.WebSeeds, tor.UrlList) {
+		t.Errorf("ParseMagnet(MagnetURI()) got = %+v", magnet)
+	}
+}
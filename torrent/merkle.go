@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// V2BlockSize is the size of the leaves of the BitTorrent v2 merkle trees (BEP 52).
+const V2BlockSize = 16 * 1024
+
+// hashPair returns the parent of two nodes of a merkle tree.
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// nextPowerOfTwo returns the smallest power of two that is at least n, and 1 for n <= 1.
+func nextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// zeroSubtreeRoot returns the root of a tree of leaves zero leaves, leaves
+// being a power of two.
+func zeroSubtreeRoot(leaves int) [32]byte {
+	var hash [32]byte
+	for ; leaves > 1; leaves /= 2 {
+		hash = hashPair(hash, hash)
+	}
+	return hash
+}
+
+// merkleRoot computes the root over nodes padded up to width nodes with pad,
+// width being a power of two not smaller than len(nodes).
+func merkleRoot(nodes [][32]byte, width int, pad [32]byte) [32]byte {
+	if len(nodes) == 0 {
+		return [32]byte{}
+	}
+	layer := make([][32]byte, width)
+	copy(layer, nodes)
+	for i := len(nodes); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			layer[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = layer[:len(layer)/2]
+		pad = hashPair(pad, pad)
+	}
+	return layer[0]
+}
+
+// blockHashes hashes the 16 KiB blocks of the length bytes read from r.
+func blockHashes(r io.Reader, length int64) ([][32]byte, error) {
+	count := int((length + V2BlockSize - 1) / V2BlockSize)
+	hashes := make([][32]byte, 0, count)
+	buf := make([]byte, V2BlockSize)
+	for remaining := length; remaining > 0; {
+		n := min(remaining, V2BlockSize)
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, sha256.Sum256(buf[:n]))
+		remaining -= n
+	}
+	return hashes, nil
+}
+
+// v2FileHashes computes the piece layer and the pieces root of a file of the
+// given length read from r. The piece layer is nil for files that are not
+// larger than a piece, their root is computed straight from the blocks.
+func v2FileHashes(r io.Reader, length, pieceLength int64) (layer [][32]byte, root [32]byte, err error) {
+	if length == 0 {
+		return nil, [32]byte{}, nil
+	}
+	if pieceLength < V2BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, root, fmt.Errorf("invalid v2 piece length %d", pieceLength)
+	}
+	blocks, err := blockHashes(r, length)
+	if err != nil {
+		return nil, root, err
+	}
+	if length <= pieceLength {
+		return nil, merkleRoot(blocks, nextPowerOfTwo(len(blocks)), [32]byte{}), nil
+	}
+
+	blocksPerPiece := int(pieceLength / V2BlockSize)
+	for start := 0; start < len(blocks); start += blocksPerPiece {
+		end := min(start+blocksPerPiece, len(blocks))
+		layer = append(layer, merkleRoot(blocks[start:end], blocksPerPiece, [32]byte{}))
+	}
+	return layer, piecesRootFromLayer(layer, pieceLength), nil
+}
+
+// piecesRootFromLayer computes the pieces root of a file from its piece layer.
+func piecesRootFromLayer(layer [][32]byte, pieceLength int64) [32]byte {
+	pad := zeroSubtreeRoot(int(pieceLength / V2BlockSize))
+	return merkleRoot(layer, nextPowerOfTwo(len(layer)), pad)
+}
+
+// splitHashes splits a concatenation of SHA-256 hashes.
+func splitHashes(b []byte) ([][32]byte, error) {
+	if len(b)%32 != 0 {
+		return nil, fmt.Errorf("hash list length %d is not a multiple of 32", len(b))
+	}
+	hashes := make([][32]byte, len(b)/32)
+	for i := range hashes {
+		copy(hashes[i][:], b[i*32:])
+	}
+	return hashes, nil
+}
@@ -0,0 +1,328 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"gtorrent/bencode"
+	"slices"
+	"sync"
+)
+
+const (
+	UtMetadata        = "ut_metadata" // name of the metadata extension (BEP 9)
+	MetadataPieceSize = 16 * 1024     // metadata is exchanged in pieces of 16 KiB
+	MaxMetadataSize   = 16 << 20      // largest metadata_size accepted from a peer
+)
+
+// Message types of the metadata extension.
+const (
+	MetadataRequest int64 = 0
+	MetadataData    int64 = 1
+	MetadataReject  int64 = 2
+)
+
+var (
+	// ErrMetadataRejected is returned when a peer rejects a request for metadata.
+	ErrMetadataRejected = errors.New("peer rejected the metadata request")
+	// ErrMetadataMismatch is returned when the metadata put together does not
+	// match the info hash.
+	ErrMetadataMismatch = errors.New("metadata does not match the info hash")
+	// ErrMetadataBanned is returned for a peer that sent bad metadata.
+	ErrMetadataBanned = errors.New("peer sent bad metadata")
+)
+
+// MetadataMessage is the dictionary at the start of every ut_metadata
+// message. The data of a piece follows the dictionary in MetadataData
+// messages.
+type MetadataMessage struct {
+	Type      int64 `bencode:"msg_type"`
+	Piece     int64 `bencode:"piece"`
+	TotalSize int64 `bencode:"total_size,omitempty"` // only in MetadataData messages
+}
+
+// FormatMetadata creates the payload of a ut_metadata message, data is
+// appended to the dictionary.
+func FormatMetadata(msg *MetadataMessage, data []byte) ([]byte, error) {
+	dict, err := bencode.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(dict, data...), nil
+}
+
+// ParseMetadata parses the payload of a ut_metadata message into its
+// dictionary and the data that follows it.
+func ParseMetadata(payload []byte) (*MetadataMessage, []byte, error) {
+	dict, n, err := bencode.Decode(payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid metadata message: %w", err)
+	}
+	msg := &MetadataMessage{}
+	if err := bencode.UnmarshalData(dict, msg); err != nil {
+		return nil, nil, fmt.Errorf("invalid metadata message: %w", err)
+	}
+	if msg.Piece < 0 {
+		return nil, nil, fmt.Errorf("invalid metadata message: piece %d", msg.Piece)
+	}
+	return msg, payload[n:], nil
+}
+
+// MetadataPieces returns the number of pieces of metadata of size bytes.
+func MetadataPieces(size int64) int {
+	return int((size + MetadataPieceSize - 1) / MetadataPieceSize)
+}
+
+// MetadataDownload puts together the info dictionary of a torrent from the
+// pieces sent by several peers. Peers may announce different sizes: the
+// pieces of each size are put together apart, and the first that matches the
+// info hash wins. A peer whose data fails the hash check on its own is
+// banned. It is safe for concurrent use.
+type MetadataDownload struct {
+	InfoHash [20]byte
+
+	mu        sync.Mutex
+	sizes     map[string]int64           // size announced by each peer
+	buffers   map[string]*metadataBuffer // by size, or by peer for the sizes in exclusive
+	exclusive map[int64]bool             // sizes whose shared buffer failed the hash check
+	banned    map[string]bool
+	info      []byte
+	done      chan struct{}
+}
+
+// metadataBuffer holds the pieces of metadata of one size.
+type metadataBuffer struct {
+	key       string
+	size      int64
+	pieces    [][]byte // nil until received
+	senders   []string // peer that sent each piece
+	requests  []int    // number of times each piece was requested
+	remaining int
+}
+
+// NewMetadataDownload returns a download of the info dictionary with the info hash.
+func NewMetadataDownload(infoHash [20]byte) *MetadataDownload {
+	return &MetadataDownload{
+		InfoHash:  infoHash,
+		sizes:     make(map[string]int64),
+		buffers:   make(map[string]*metadataBuffer),
+		exclusive: make(map[int64]bool),
+		banned:    make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+}
+
+// SetSize sets the size of the metadata announced by peer in its extended
+// handshake. The pieces it sends are put together with the ones of the peers
+// that announced the same size.
+func (d *MetadataDownload) SetSize(peer string, size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.banned[peer] {
+		return fmt.Errorf("%w: %s", ErrMetadataBanned, peer)
+	}
+	if size <= 0 || size > MaxMetadataSize {
+		return fmt.Errorf("invalid metadata size %d", size)
+	}
+	d.sizes[peer] = size
+	return nil
+}
+
+// buffer returns the buffer the pieces of peer go to, nil if its size is not
+// known. It is called with d.mu held.
+func (d *MetadataDownload) buffer(peer string) *metadataBuffer {
+	size := d.sizes[peer]
+	if size == 0 {
+		return nil
+	}
+	key := fmt.Sprint(size)
+	if d.exclusive[size] {
+		key = peer
+	}
+	b, ok := d.buffers[key]
+	if !ok {
+		count := MetadataPieces(size)
+		b = &metadataBuffer{
+			key:       key,
+			size:      size,
+			pieces:    make([][]byte, count),
+			senders:   make([]string, count),
+			requests:  make([]int, count),
+			remaining: count,
+		}
+		d.buffers[key] = b
+	}
+	return b
+}
+
+// Request returns the next piece to request from peer: the missing piece of
+// its size requested the least so far, so peers share the pieces between
+// them and a piece requested from a slow peer is asked again from another
+// one. ok is false if the size of peer is not known yet, if it is banned or
+// if the metadata is complete.
+func (d *MetadataDownload) Request(peer string) (piece int, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.info != nil || d.banned[peer] {
+		return 0, false
+	}
+	b := d.buffer(peer)
+	if b == nil {
+		return 0, false
+	}
+	piece = -1
+	for i := range b.pieces {
+		if b.pieces[i] == nil && (piece < 0 || b.requests[i] < b.requests[piece]) {
+			piece = i
+		}
+	}
+	if piece < 0 {
+		return 0, false
+	}
+	b.requests[piece]++
+	return piece, true
+}
+
+// Has reports whether the piece requested from peer was received.
+func (d *MetadataDownload) Has(peer string, piece int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.info != nil {
+		return true
+	}
+	b := d.buffer(peer)
+	return b != nil && piece >= 0 && piece < len(b.pieces) && b.pieces[piece] != nil
+}
+
+// Banned reports whether peer sent metadata that does not match the info hash.
+func (d *MetadataDownload) Banned(peer string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.banned[peer]
+}
+
+// Receive adds a piece sent by peer. Once every piece of a size is received,
+// the metadata is checked against the info hash. If it does not match, the
+// pieces are dropped and ErrMetadataMismatch is returned: a peer that sent
+// them all is banned, otherwise each peer of that size starts over on its
+// own, so the next failure tells which peer sent bad data.
+func (d *MetadataDownload) Receive(peer string, piece int, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.info != nil {
+		return nil
+	}
+	if d.banned[peer] {
+		return fmt.Errorf("%w: %s", ErrMetadataBanned, peer)
+	}
+	b := d.buffer(peer)
+	if b == nil {
+		return fmt.Errorf("metadata size of %s is unknown", peer)
+	}
+	if piece < 0 || piece >= len(b.pieces) {
+		return fmt.Errorf("metadata piece %d out of range", piece)
+	}
+	want := min(MetadataPieceSize, b.size-int64(piece)*MetadataPieceSize)
+	if int64(len(data)) != want {
+		return fmt.Errorf("metadata piece %d has %d bytes, expected %d", piece, len(data), want)
+	}
+	if b.pieces[piece] != nil {
+		return nil // duplicate
+	}
+	b.pieces[piece] = append([]byte(nil), data...)
+	b.senders[piece] = peer
+	b.remaining--
+	if b.remaining > 0 {
+		return nil
+	}
+
+	info := make([]byte, 0, b.size)
+	for _, p := range b.pieces {
+		info = append(info, p...)
+	}
+	if sha1.Sum(info) == d.InfoHash {
+		d.info = info
+		close(d.done)
+		return nil
+	}
+
+	delete(d.buffers, b.key)
+	if !slices.ContainsFunc(b.senders, func(sender string) bool { return sender != peer }) {
+		d.banned[peer] = true
+	} else {
+		d.exclusive[b.size] = true
+	}
+	return fmt.Errorf("%w %x", ErrMetadataMismatch, d.InfoHash)
+}
+
+// Done returns a channel closed once the metadata is complete.
+func (d *MetadataDownload) Done() <-chan struct{} {
+	return d.done
+}
+
+// Info returns the info dictionary, nil until it is complete.
+func (d *MetadataDownload) Info() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.info
+}
+
+// MetadataPeer is a peer that exchanges metadata with us.
+type MetadataPeer interface {
+	ExtendedPeer
+	// InfoBytes returns the info dictionary we serve to the peer, nil if we
+	// do not have it.
+	InfoBytes() []byte
+	// MetadataDownload returns the download the pieces sent by the peer go
+	// to, nil if we are not downloading metadata.
+	MetadataDownload() *MetadataDownload
+	// Addr returns the address the metadata download knows the peer by.
+	Addr() string
+}
+
+// HandleMetadata handles a ut_metadata message: requests are answered from
+// our info dictionary and pieces go to the metadata download of the peer.
+func HandleMetadata(peer ExtendedPeer, payload []byte) error {
+	mp, ok := peer.(MetadataPeer)
+	if !ok {
+		return fmt.Errorf("peer does not exchange metadata")
+	}
+	msg, data, err := ParseMetadata(payload)
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case MetadataRequest:
+		info := mp.InfoBytes()
+		reply := &MetadataMessage{Type: MetadataReject, Piece: msg.Piece}
+		var piece []byte
+		if msg.Piece < int64(MetadataPieces(int64(len(info)))) {
+			begin := msg.Piece * MetadataPieceSize
+			reply.Type = MetadataData
+			reply.TotalSize = int64(len(info))
+			piece = info[begin:min(begin+MetadataPieceSize, int64(len(info)))]
+		}
+		payload, err := FormatMetadata(reply, piece)
+		if err != nil {
+			return err
+		}
+		return peer.SendExtended(UtMetadata, payload)
+	case MetadataData:
+		download := mp.MetadataDownload()
+		if download == nil {
+			return nil // we did not ask for it
+		}
+		return download.Receive(mp.Addr(), int(msg.Piece), data)
+	case MetadataReject:
+		return fmt.Errorf("piece %d: %w", msg.Piece, ErrMetadataRejected)
+	}
+	// unknown message types are ignored
+	return nil
+}
+
+func init() {
+	if _, err := Extensions.Register(UtMetadata, HandleMetadata); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,226 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testMetadataPeer serves info and sends the pieces it receives to download.
+type testMetadataPeer struct {
+	testExtendedPeer
+	info     []byte
+	download *MetadataDownload
+}
+
+func (p *testMetadataPeer) InfoBytes() []byte {
+	return p.info
+}
+
+func (p *testMetadataPeer) MetadataDownload() *MetadataDownload {
+	return p.download
+}
+
+func (p *testMetadataPeer) Addr() string {
+	return "10.0.0.1:6881"
+}
+
+func TestParseMetadata(t *testing.T) {
+	tests := []struct {
+		msg  *MetadataMessage
+		data []byte
+	}{
+		{&MetadataMessage{Type: MetadataRequest, Piece: 0}, nil},
+		{&MetadataMessage{Type: MetadataData, Piece: 2, TotalSize: 40000}, []byte("d4:spami3ee")},
+		{&MetadataMessage{Type: MetadataReject, Piece: 1}, nil},
+	}
+	for _, tt := range tests {
+		payload, err := FormatMetadata(tt.msg, tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, data, err := ParseMetadata(payload)
+		if err != nil {
+			t.Fatalf("ParseMetadata(%q) error = %v", payload, err)
+		}
+		if !reflect.DeepEqual(msg, tt.msg) || !bytes.Equal(data, tt.data) {
+			t.Errorf("ParseMetadata(%q) got = %+v %q, want %+v %q", payload, msg, data, tt.msg, tt.data)
+		}
+	}
+
+	if _, _, err := ParseMetadata([]byte("d8:msg_typei0e5:piecei-1ee")); err == nil {
+		t.Errorf("ParseMetadata() of a negative piece got no error")
+	}
+	if _, _, err := ParseMetadata([]byte("le")); err == nil {
+		t.Errorf("ParseMetadata() of a list got no error")
+	}
+}
+
+func TestMetadataDownload(t *testing.T) {
+	info := bytes.Repeat([]byte("0123456789"), 4000) // three pieces, the last one short
+	download := NewMetadataDownload(sha1.Sum(info))
+	if _, ok := download.Request("a"); ok {
+		t.Errorf("Request() before the size is known got ok")
+	}
+	if err := download.SetSize("a", 0); err == nil {
+		t.Errorf("SetSize() of 0 bytes got no error")
+	}
+	for _, peer := range []string{"a", "b"} {
+		if err := download.SetSize(peer, int64(len(info))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pieces are shared between peers of the same size before any is asked twice
+	requested := make([]int, 0)
+	for _, peer := range []string{"a", "b", "a", "b"} {
+		piece, _ := download.Request(peer)
+		requested = append(requested, piece)
+	}
+	if want := []int{0, 1, 2, 0}; !reflect.DeepEqual(requested, want) {
+		t.Errorf("Request() got = %v, want %v", requested, want)
+	}
+
+	if err := download.Receive("a", 2, info[2*MetadataPieceSize:]); err != nil {
+		t.Fatal(err)
+	}
+	if !download.Has("b", 2) {
+		t.Errorf("Has() of a piece sent by another peer of the same size got false")
+	}
+	if err := download.Receive("a", 1, info[:MetadataPieceSize-1]); err == nil {
+		t.Errorf("Receive() of a short piece got no error")
+	}
+	if err := download.Receive("a", 3, nil); err == nil {
+		t.Errorf("Receive() of a piece out of range got no error")
+	}
+	if err := download.Receive("c", 0, info[:MetadataPieceSize]); err == nil {
+		t.Errorf("Receive() from a peer of unknown size got no error")
+	}
+
+	for i := 0; i < MetadataPieces(int64(len(info))); i++ {
+		end := min((i+1)*MetadataPieceSize, len(info))
+		if err := download.Receive("b", i, info[i*MetadataPieceSize:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-download.Done():
+	default:
+		t.Errorf("Done() is not closed after the last piece")
+	}
+	if !bytes.Equal(download.Info(), info) {
+		t.Errorf("Info() does not match the metadata")
+	}
+	if _, ok := download.Request("a"); ok {
+		t.Errorf("Request() after the metadata is complete got ok")
+	}
+}
+
+// receiveAll sends every piece of data to download from peer, and returns
+// the error of the last one.
+func receiveAll(download *MetadataDownload, peer string, data []byte) error {
+	var err error
+	for i := 0; i < MetadataPieces(int64(len(data))); i++ {
+		end := min((i+1)*MetadataPieceSize, len(data))
+		err = download.Receive(peer, i, data[i*MetadataPieceSize:end])
+	}
+	return err
+}
+
+func TestMetadataDownloadBadPeers(t *testing.T) {
+	info := bytes.Repeat([]byte("0123456789"), 4000)
+	bad := bytes.Clone(info)
+	bad[MetadataPieceSize] ^= 1
+
+	// a peer announcing another size does not hold back the others
+	download := NewMetadataDownload(sha1.Sum(info))
+	download.SetSize("liar", int64(len(info))+1)
+	download.SetSize("good", int64(len(info)))
+	if err := receiveAll(download, "liar", append(bytes.Clone(info), 0)); !errors.Is(err, ErrMetadataMismatch) {
+		t.Errorf("Receive() of metadata of the wrong size error = %v, want %v", err, ErrMetadataMismatch)
+	}
+	if !download.Banned("liar") || download.Banned("good") {
+		t.Errorf("Banned() got %v for liar and %v for good, want true and false", download.Banned("liar"), download.Banned("good"))
+	}
+	if err := download.SetSize("liar", int64(len(info))); !errors.Is(err, ErrMetadataBanned) {
+		t.Errorf("SetSize() of a banned peer error = %v, want %v", err, ErrMetadataBanned)
+	}
+	if err := receiveAll(download, "good", info); err != nil || !bytes.Equal(download.Info(), info) {
+		t.Errorf("Receive() of the good metadata error = %v", err)
+	}
+
+	// bad data from one of two peers: they start over on their own, and the
+	// next failure tells the bad peer
+	download = NewMetadataDownload(sha1.Sum(info))
+	download.SetSize("bad", int64(len(info)))
+	download.SetSize("good", int64(len(info)))
+	download.Receive("bad", 1, bad[MetadataPieceSize:2*MetadataPieceSize])
+	download.Receive("good", 0, info[:MetadataPieceSize])
+	if err := download.Receive("good", 2, info[2*MetadataPieceSize:]); !errors.Is(err, ErrMetadataMismatch) {
+		t.Errorf("Receive() of metadata with a bad piece error = %v, want %v", err, ErrMetadataMismatch)
+	}
+	if download.Banned("bad") || download.Banned("good") || download.Has("good", 0) {
+		t.Errorf("Receive() banned a peer or kept the pieces of shared bad metadata")
+	}
+	if err := receiveAll(download, "bad", bad); !errors.Is(err, ErrMetadataMismatch) || !download.Banned("bad") {
+		t.Errorf("Receive() of bad metadata from one peer error = %v, banned %v", err, download.Banned("bad"))
+	}
+	if err := receiveAll(download, "good", info); err != nil || !bytes.Equal(download.Info(), info) {
+		t.Errorf("Receive() of the good metadata error = %v", err)
+	}
+}
+
+func TestHandleMetadata(t *testing.T) {
+	info := bytes.Repeat([]byte("abcdefghij"), 2000) // two pieces
+	seed := &testMetadataPeer{
+		testExtendedPeer: testExtendedPeer{extensions: NewPeerExtensions(), sent: map[string][]byte{}},
+		info:             info,
+	}
+	leech := &testMetadataPeer{
+		testExtendedPeer: testExtendedPeer{extensions: NewPeerExtensions(), sent: map[string][]byte{}},
+		download:         NewMetadataDownload(sha1.Sum(info)),
+	}
+	leech.download.SetSize(leech.Addr(), int64(len(info)))
+
+	// the seed answers each request and the leech puts the answers together
+	for piece := int64(0); piece < 2; piece++ {
+		request, _ := FormatMetadata(&MetadataMessage{Type: MetadataRequest, Piece: piece}, nil)
+		if err := HandleMetadata(seed, request); err != nil {
+			t.Fatal(err)
+		}
+		msg, _, err := ParseMetadata(seed.sent[UtMetadata])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != MetadataData || msg.Piece != piece || msg.TotalSize != int64(len(info)) {
+			t.Errorf("HandleMetadata() of a request got = %+v", msg)
+		}
+		if err := HandleMetadata(leech, seed.sent[UtMetadata]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(leech.download.Info(), info) {
+		t.Errorf("HandleMetadata() did not put the metadata together")
+	}
+
+	// pieces past the end, or any piece without metadata, are rejected
+	request, _ := FormatMetadata(&MetadataMessage{Type: MetadataRequest, Piece: 2}, nil)
+	for _, peer := range []*testMetadataPeer{seed, leech} {
+		if err := HandleMetadata(peer, request); err != nil {
+			t.Fatal(err)
+		}
+		msg, _, _ := ParseMetadata(peer.sent[UtMetadata])
+		if msg.Type != MetadataReject {
+			t.Errorf("HandleMetadata() of a request it cannot serve got = %+v", msg)
+		}
+		if err := HandleMetadata(seed, peer.sent[UtMetadata]); !errors.Is(err, ErrMetadataRejected) {
+			t.Errorf("HandleMetadata() of a reject error = %v, want %v", err, ErrMetadataRejected)
+		}
+	}
+
+	if id, ok := Extensions.ID(UtMetadata); !ok || id == 0 {
+		t.Errorf("%s is not registered", UtMetadata)
+	}
+}
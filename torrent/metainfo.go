@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"gtorrent/bencode"
+	"os"
+	"path/filepath"
+)
+
+// metainfoFile is the smallest metainfo file that holds an info dictionary:
+// its trackers and web seeds around the info dictionary, kept byte for byte.
+type metainfoFile struct {
+	Announce     string             `bencode:"announce,omitempty"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+	Info         bencode.RawMessage `bencode:"info"`
+	UrlList      []string           `bencode:"url-list,omitempty"`
+}
+
+func encodeMetainfo(info []byte, tiers [][]string, webSeeds []string) ([]byte, error) {
+	file := metainfoFile{Info: info, UrlList: webSeeds}
+	trackerCount := 0
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		if file.Announce == "" {
+			file.Announce = tier[0]
+		}
+		file.AnnounceList = append(file.AnnounceList, tier)
+		trackerCount += len(tier)
+	}
+	if trackerCount < 2 {
+		file.AnnounceList = nil
+	}
+	return bencode.Marshal(file)
+}
+
+// FromInfoBytes builds a torrent from a raw info dictionary, such as one
+// received from peers through a magnet link, and the trackers to announce it
+// to, all in one tier. The info dictionary is kept byte for byte, so the info
+// hash of the torrent is the hash of info, which must be expected.
+func FromInfoBytes(info []byte, expected [20]byte, trackers []string) (*Torrent, error) {
+	if hash := sha1.Sum(info); hash != expected {
+		return nil, fmt.Errorf("info dictionary has info hash %x, expected %x", hash, expected)
+	}
+	data, n, err := bencode.Decode(info)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding info dictionary: %s", err.Error())
+	}
+	if n != len(info) || data.Type != bencode.DICT {
+		return nil, fmt.Errorf("info is not a single bencoded dictionary")
+	}
+	tiers := [][]string{}
+	if len(trackers) > 0 {
+		tiers = append(tiers, trackers)
+	}
+	content, err := encodeMetainfo(info, tiers, nil)
+	if err != nil {
+		return nil, err
+	}
+	return TorrentFromBytes(content)
+}
+
+// TorrentFromInfo builds the torrent of the magnet link from its info
+// dictionary, with the trackers and web seeds of the link. It fails if the
+// info dictionary does not match the info hashes of the link.
+func (m *Magnet) TorrentFromInfo(info []byte) (*Torrent, error) {
+	expected := m.InfoHash
+	if !m.HasV1() {
+		// only the v2 info hash below can be checked
+		expected = sha1.Sum(info)
+	}
+	tor, err := FromInfoBytes(info, expected, m.Trackers)
+	if err != nil {
+		return nil, err
+	}
+	if m.HasV2() && (!tor.HasV2() || tor.InfoHashV2 != m.InfoHashV2) {
+		return nil, fmt.Errorf("info dictionary has v2 info hash %x, expected %x", tor.InfoHashV2, m.InfoHashV2)
+	}
+	tor.UrlList = append(tor.UrlList, m.WebSeeds...)
+	return tor, nil
+}
+
+// Metainfo returns a standalone metainfo file for the torrent, with its
+// trackers, web seeds and info dictionary. Other keys of the file the torrent
+// was read from, such as its comment, are left out.
+func (t *Torrent) Metainfo() ([]byte, error) {
+	if len(t.InfoBytes) == 0 {
+		return nil, fmt.Errorf("torrent has no info dictionary")
+	}
+	tiers := t.AnnounceTiers
+	if len(tiers) == 0 && len(t.AnnounceList) > 0 {
+		tiers = [][]string{t.AnnounceList}
+	}
+	return encodeMetainfo(t.InfoBytes, tiers, t.UrlList)
+}
+
+// WriteTorrentFile writes the metainfo of the torrent into dir, named after
+// its info hash, and returns the path of the file.
+func (t *Torrent) WriteTorrentFile(dir string) (string, error) {
+	content, err := t.Metainfo()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, t.InfoHashString()+".torrent")
+	// an existing file with the same content is left as it is
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, content) {
+		return path, nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, content, 0644)
+}
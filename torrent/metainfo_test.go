@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFromInfoBytes(t *testing.T) {
+	content, err := os.ReadFile("../example/meditations_marcus_aurelius.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := TorrentFromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trackers := []string{"udp://a.example:6969", "http://b.example/announce"}
+	tor, err := FromInfoBytes(original.InfoBytes, original.InfoHash, trackers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tor.InfoHash != original.InfoHash {
+		t.Errorf("FromInfoBytes() info hash got = %x, want %x", tor.InfoHash, original.InfoHash)
+	}
+	if !reflect.DeepEqual(tor.AnnounceTiers, [][]string{trackers}) {
+		t.Errorf("FromInfoBytes() tiers got = %v, want %v", tor.AnnounceTiers, [][]string{trackers})
+	}
+	if tor.Name != original.Name || tor.Length != original.Length || !reflect.DeepEqual(tor.Pieces, original.Pieces) {
+		t.Errorf("FromInfoBytes() got %s of %d bytes, want %s of %d bytes", tor.Name, tor.Length, original.Name, original.Length)
+	}
+
+	other := original.InfoHash
+	other[0] ^= 1
+	if _, err := FromInfoBytes(original.InfoBytes, other, nil); err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Errorf("FromInfoBytes() with another info hash error = %v", err)
+	}
+	trailing := append(original.InfoBytes[:len(original.InfoBytes):len(original.InfoBytes)], 'x')
+	if _, err := FromInfoBytes(trailing, sha1.Sum(trailing), nil); err == nil {
+		t.Errorf("FromInfoBytes() with trailing data got no error")
+	}
+	if _, err := FromInfoBytes([]byte("li1ee"), sha1.Sum([]byte("li1ee")), nil); err == nil {
+		t.Errorf("FromInfoBytes() of a list got no error")
+	}
+}
+
+func TestMagnetTorrentFromInfo(t *testing.T) {
+	content, err := os.ReadFile("../example/meditations_marcus_aurelius.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := TorrentFromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	magnet := &Magnet{
+		InfoHash: original.InfoHash,
+		Trackers: []string{"udp://a.example:6969"},
+		WebSeeds: []string{"http://seed.example/"},
+	}
+	tor, err := magnet.TorrentFromInfo(original.InfoBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tor.AnnounceList, magnet.Trackers) || !reflect.DeepEqual(tor.UrlList, magnet.WebSeeds) {
+		t.Errorf("TorrentFromInfo() got trackers %v and web seeds %v", tor.AnnounceList, tor.UrlList)
+	}
+
+	magnet.InfoHash[0] ^= 1
+	if _, err := magnet.TorrentFromInfo(original.InfoBytes); err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Errorf("TorrentFromInfo() with another info hash error = %v", err)
+	}
+}
+
+func TestWriteTorrentFile(t *testing.T) {
+	content, err := os.ReadFile("../example/meditations_marcus_aurelius.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := mustInfoBytes(t, content)
+	tor, err := FromInfoBytes(info, sha1.Sum(info), []string{"http://a.example/announce", "http://b.example/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.UrlList = []string{"http://seed.example/"}
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	path, err := tor.WriteTorrentFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, tor.InfoHashString()+".torrent"); path != want {
+		t.Errorf("WriteTorrentFile() path got = %v, want %v", path, want)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := TorrentFromBytes(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.InfoHash != tor.InfoHash || !reflect.DeepEqual(read.AnnounceTiers, tor.AnnounceTiers) || !reflect.DeepEqual(read.UrlList, tor.UrlList) {
+		t.Errorf("WriteTorrentFile() wrote %x %v %v, want %x %v %v", read.InfoHash, read.AnnounceTiers, read.UrlList, tor.InfoHash, tor.AnnounceTiers, tor.UrlList)
+	}
+}
+
+func mustInfoBytes(t *testing.T, content []byte) []byte {
+	tor, err := TorrentFromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tor.InfoBytes
+}
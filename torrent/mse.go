@@ -0,0 +1,428 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EncryptionPolicy tells when peer connections are encrypted with Message
+// Stream Encryption (MSE/PE).
+type EncryptionPolicy int
+
+const (
+	EncryptionDisabled EncryptionPolicy = iota // plaintext connections only
+	EncryptionPrefer                           // encrypted connections, plaintext with peers that do not support them
+	EncryptionRequire                          // encrypted connections only
+)
+
+// ParseEncryptionPolicy parses "disabled", "prefer" or "require".
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	switch strings.ToLower(s) {
+	case "disabled":
+		return EncryptionDisabled, nil
+	case "prefer":
+		return EncryptionPrefer, nil
+	case "require":
+		return EncryptionRequire, nil
+	}
+	return EncryptionDisabled, fmt.Errorf("invalid encryption policy %q, expected disabled, prefer or require", s)
+}
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionDisabled:
+		return "disabled"
+	case EncryptionPrefer:
+		return "prefer"
+	case EncryptionRequire:
+		return "require"
+	}
+	return fmt.Sprintf("EncryptionPolicy(%d)", int(p))
+}
+
+// Methods of crypto_provide and crypto_select.
+const (
+	CryptoPlaintext uint32 = 0x01 // only the handshake is encrypted
+	CryptoRC4       uint32 = 0x02 // the whole stream is encrypted
+)
+
+const (
+	mseKeySize   = 96   // size of the public keys and of the shared secret
+	mseMaxPad    = 512  // largest padding allowed by the protocol
+	mseDiscard   = 1024 // bytes of RC4 keystream dropped before use
+	mseTimeout   = 10 * time.Second
+	btHandshake0 = "\x13BitTorrent protocol"
+)
+
+var (
+	// the prime of the Diffie-Hellman key exchange, the generator is 2
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG    = big.NewInt(2)
+	mseVC   = make([]byte, 8) // verification constant
+)
+
+// EncryptedConn is a peer connection after the MSE handshake. Reads and
+// writes go through RC4 when it was selected, and data received during the
+// handshake is read first.
+type EncryptedConn struct {
+	net.Conn
+	Method uint32 // CryptoPlaintext or CryptoRC4
+
+	readMu  sync.Mutex
+	pending []byte // initial payload of the peer, already decrypted
+	reader  io.Reader
+	decrypt *rc4.Cipher
+	writeMu sync.Mutex
+	encrypt *rc4.Cipher
+}
+
+// Read reads and decrypts data from the connection.
+func (c *EncryptedConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.reader.Read(b)
+	if c.decrypt != nil {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write encrypts and writes data to the connection.
+func (c *EncryptedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.encrypt.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// DialPeer connects to peer following the encryption policy. With
+// EncryptionPrefer, a peer that fails the encrypted handshake is connected
+// to again in plaintext.
+func DialPeer(peer *Peer, infoHash [20]byte, policy EncryptionPolicy, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", peer.String(), timeout)
+	if err != nil || policy == EncryptionDisabled {
+		return conn, err
+	}
+	provide := CryptoRC4
+	if policy == EncryptionPrefer {
+		provide |= CryptoPlaintext
+	}
+	encrypted, err := InitiateEncryption(conn, infoHash, provide)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if policy == EncryptionRequire {
+		return nil, fmt.Errorf("encrypted handshake failed: %w", err)
+	}
+	return net.DialTimeout("tcp", peer.String(), timeout)
+}
+
+// InitiateEncryption performs the MSE handshake on an outgoing connection for
+// the torrent with infoHash, offering the methods of provide. RC4 is used if
+// the peer selects it.
+func InitiateEncryption(conn net.Conn, infoHash [20]byte, provide uint32) (*EncryptedConn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	private, public, err := newMSEKeys()
+	if err != nil {
+		return nil, err
+	}
+	pad, err := msePad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(public, pad...)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	peerPublic := make([]byte, mseKeySize)
+	if _, err := io.ReadFull(r, peerPublic); err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	secret, err := mseSecret(private, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	encrypt := mseCipher("keyA", secret, infoHash)
+	decrypt := mseCipher("keyB", secret, infoHash)
+
+	// HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA))
+	msg := mseHash("req1", secret)
+	req2, req3 := mseHash("req2", infoHash[:]), mseHash("req3", secret)
+	for i := range req2 {
+		msg = append(msg, req2[i]^req3[i])
+	}
+	plain := append(append([]byte(nil), mseVC...), 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(plain[8:], provide)
+	encrypted := make([]byte, len(plain))
+	encrypt.XORKeyStream(encrypted, plain)
+	if _, err := conn.Write(append(msg, encrypted...)); err != nil {
+		return nil, err
+	}
+
+	// the answer starts with the encrypted VC, after the padding of the peer
+	vc := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(vc, mseVC)
+	if err := mseSync(r, vc, mseMaxPad); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header)
+	if (selected != CryptoPlaintext && selected != CryptoRC4) || selected&provide == 0 {
+		return nil, fmt.Errorf("peer selected unsupported crypto method %#x", selected)
+	}
+	padLength := int(binary.BigEndian.Uint16(header[4:]))
+	if padLength > mseMaxPad {
+		return nil, fmt.Errorf("padding of %d bytes is too long", padLength)
+	}
+	// padD is encrypted too, so it goes through the cipher to keep it in step
+	padD := make([]byte, padLength)
+	if _, err := io.ReadFull(r, padD); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(padD, padD)
+
+	c := &EncryptedConn{Conn: conn, Method: selected, reader: r}
+	if selected == CryptoRC4 {
+		c.encrypt, c.decrypt = encrypt, decrypt
+	}
+	return c, nil
+}
+
+// AcceptEncryption handles the start of an incoming connection following the
+// encryption policy. A plaintext BitTorrent handshake is let through unless
+// encryption is required, otherwise the MSE handshake is performed for one of
+// the torrents of infoHashes, which is returned. The BitTorrent handshake of
+// the peer is read from the returned connection in both cases.
+func AcceptEncryption(conn net.Conn, infoHashes [][20]byte, policy EncryptionPolicy) (net.Conn, [20]byte, error) {
+	padLength, err := msePadLength()
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	return acceptEncryption(conn, infoHashes, policy, padLength)
+}
+
+// acceptEncryption is AcceptEncryption with padD of padLength bytes.
+func acceptEncryption(conn net.Conn, infoHashes [][20]byte, policy EncryptionPolicy, padLength int) (net.Conn, [20]byte, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var infoHash [20]byte
+	r := bufio.NewReader(conn)
+	start, err := r.Peek(len(btHandshake0))
+	if err != nil {
+		return nil, infoHash, err
+	}
+	if string(start) == btHandshake0 {
+		if policy == EncryptionRequire {
+			return nil, infoHash, fmt.Errorf("plaintext connection refused, encryption is required")
+		}
+		return &EncryptedConn{Conn: conn, Method: CryptoPlaintext, reader: r}, infoHash, nil
+	}
+	if policy == EncryptionDisabled {
+		return nil, infoHash, fmt.Errorf("encrypted connection refused, encryption is disabled")
+	}
+
+	peerPublic := make([]byte, mseKeySize)
+	if _, err := io.ReadFull(r, peerPublic); err != nil {
+		return nil, infoHash, fmt.Errorf("failed to read public key: %w", err)
+	}
+	private, public, err := newMSEKeys()
+	if err != nil {
+		return nil, infoHash, err
+	}
+	pad, err := msePad()
+	if err != nil {
+		return nil, infoHash, err
+	}
+	if _, err := conn.Write(append(public, pad...)); err != nil {
+		return nil, infoHash, err
+	}
+	secret, err := mseSecret(private, peerPublic)
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	// the rest starts with HASH('req1', S), after the padding of the peer
+	if err := mseSync(r, mseHash("req1", secret), mseMaxPad); err != nil {
+		return nil, infoHash, err
+	}
+	skey := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, skey); err != nil {
+		return nil, infoHash, err
+	}
+	req3 := mseHash("req3", secret)
+	found := false
+	for _, candidate := range infoHashes {
+		req2 := mseHash("req2", candidate[:])
+		for i := range req2 {
+			req2[i] ^= req3[i]
+		}
+		if bytes.Equal(req2, skey) {
+			infoHash, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, infoHash, fmt.Errorf("peer asked for an unknown torrent")
+	}
+	decrypt := mseCipher("keyA", secret, infoHash)
+	encrypt := mseCipher("keyB", secret, infoHash)
+
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, infoHash, err
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], mseVC) {
+		return nil, infoHash, fmt.Errorf("invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:])
+	padCLength := int(binary.BigEndian.Uint16(header[12:]))
+	if padCLength > mseMaxPad {
+		return nil, infoHash, fmt.Errorf("padding of %d bytes is too long", padCLength)
+	}
+	padAndLength := make([]byte, padCLength+2)
+	if _, err := io.ReadFull(r, padAndLength); err != nil {
+		return nil, infoHash, err
+	}
+	decrypt.XORKeyStream(padAndLength, padAndLength)
+	initial := make([]byte, binary.BigEndian.Uint16(padAndLength[padCLength:]))
+	if _, err := io.ReadFull(r, initial); err != nil {
+		return nil, infoHash, err
+	}
+	decrypt.XORKeyStream(initial, initial)
+
+	var selected uint32
+	switch {
+	case provide&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case provide&CryptoPlaintext != 0 && policy != EncryptionRequire:
+		selected = CryptoPlaintext
+	default:
+		return nil, infoHash, fmt.Errorf("no acceptable crypto method in %#x", provide)
+	}
+
+	// ENCRYPT(VC, crypto_select, len(padD), padD), padD is zeros
+	answer := append(append([]byte(nil), mseVC...), make([]byte, 6+padLength)...)
+	binary.BigEndian.PutUint32(answer[8:], selected)
+	binary.BigEndian.PutUint16(answer[12:], uint16(padLength))
+	encrypt.XORKeyStream(answer, answer)
+	if _, err := conn.Write(answer); err != nil {
+		return nil, infoHash, err
+	}
+
+	c := &EncryptedConn{Conn: conn, Method: selected, pending: initial, reader: r}
+	if selected == CryptoRC4 {
+		c.encrypt, c.decrypt = encrypt, decrypt
+	}
+	return c, infoHash, nil
+}
+
+// newMSEKeys returns a random private key of 160 bits and its public key.
+func newMSEKeys() (*big.Int, []byte, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(mseG, private, mseP)
+	return private, public.FillBytes(make([]byte, mseKeySize)), nil
+}
+
+// mseSecret returns the shared secret of the private key and the public key of the peer.
+func mseSecret(private *big.Int, peerPublic []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(peerPublic)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(mseP, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	secret := new(big.Int).Exp(y, private, mseP)
+	return secret.FillBytes(make([]byte, mseKeySize)), nil
+}
+
+// msePadLength returns a random padding length between 0 and 512 bytes.
+func msePadLength() (int, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(n[:])) % (mseMaxPad + 1), nil
+}
+
+// msePad returns between 0 and 512 random bytes of padding.
+func msePad() ([]byte, error) {
+	n, err := msePadLength()
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, n)
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+func mseHash(prefix string, data ...[]byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(prefix))
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// mseCipher returns the RC4 cipher of one direction, its first 1024 bytes of
+// keystream are discarded.
+func mseCipher(name string, secret []byte, infoHash [20]byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(mseHash(name, secret, infoHash[:]))
+	discard := make([]byte, mseDiscard)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+// mseSync reads from r until it has read pattern, with at most maxSkip bytes
+// before it.
+func mseSync(r *bufio.Reader, pattern []byte, maxSkip int) error {
+	window := make([]byte, len(pattern))
+	if _, err := io.ReadFull(r, window); err != nil {
+		return err
+	}
+	for skipped := 0; !bytes.Equal(window, pattern); skipped++ {
+		if skipped == maxSkip {
+			return fmt.Errorf("encrypted handshake not found")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		copy(window, window[1:])
+		window[len(window)-1] = b
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connPair returns both ends of a TCP connection on the loopback interface.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	out, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := <-accepted
+	if in == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		out.Close()
+		in.Close()
+	})
+	return out, in
+}
+
+func TestParseEncryptionPolicy(t *testing.T) {
+	for _, p := range []EncryptionPolicy{EncryptionDisabled, EncryptionPrefer, EncryptionRequire} {
+		if got, err := ParseEncryptionPolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParseEncryptionPolicy(%q) got = %v, want %v", p.String(), got, p)
+		}
+	}
+	if _, err := ParseEncryptionPolicy("always"); err == nil {
+		t.Errorf("ParseEncryptionPolicy(\"always\") got no error")
+	}
+}
+
+func TestMSECipher(t *testing.T) {
+	secret, infoHash := bytes.Repeat([]byte{1}, mseKeySize), [20]byte{2}
+	plain := []byte("BitTorrent")
+	got := make([]byte, len(plain))
+	mseCipher("keyA", secret, infoHash).XORKeyStream(got, plain)
+
+	// the first 1024 bytes of keystream are not used
+	want := make([]byte, mseDiscard+len(plain))
+	copy(want[mseDiscard:], plain)
+	c, _ := rc4.NewCipher(mseHash("keyA", secret, infoHash[:]))
+	c.XORKeyStream(want, want)
+	if !bytes.Equal(got, want[mseDiscard:]) {
+		t.Errorf("mseCipher() got = %x, want %x", got, want[mseDiscard:])
+	}
+}
+
+func TestEncryptionHandshake(t *testing.T) {
+	infoHash := [20]byte{0xaa}
+	tests := []struct {
+		name    string
+		provide uint32
+		policy  EncryptionPolicy
+		padD    int
+		want    uint32
+		wantErr bool
+	}{
+		{"rc4", CryptoRC4, EncryptionPrefer, 0, CryptoRC4, false},
+		{"rc4 with padD", CryptoRC4, EncryptionPrefer, 7, CryptoRC4, false},
+		{"rc4 preferred", CryptoRC4 | CryptoPlaintext, EncryptionPrefer, mseMaxPad, CryptoRC4, false},
+		{"plaintext", CryptoPlaintext, EncryptionPrefer, 0, CryptoPlaintext, false},
+		{"plaintext with padD", CryptoPlaintext, EncryptionPrefer, 7, CryptoPlaintext, false},
+		{"plaintext refused", CryptoPlaintext, EncryptionRequire, 0, 0, true},
+		{"encryption disabled", CryptoRC4, EncryptionDisabled, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, in := connPair(t)
+			type result struct {
+				conn     net.Conn
+				infoHash [20]byte
+				err      error
+			}
+			done := make(chan result, 1)
+			go func() {
+				conn, got, err := acceptEncryption(in, [][20]byte{{0xbb}, infoHash}, tt.policy, tt.padD)
+				if err != nil {
+					in.Close()
+				}
+				done <- result{conn, got, err}
+			}()
+			conn, err := InitiateEncryption(out, infoHash, tt.provide)
+			accepted := <-done
+			if (err != nil || accepted.err != nil) != tt.wantErr {
+				t.Fatalf("InitiateEncryption() error = %v, acceptEncryption() error = %v, wantErr %v", err, accepted.err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if conn.Method != tt.want || accepted.conn.(*EncryptedConn).Method != tt.want {
+				t.Errorf("selected methods got = %d and %d, want %d", conn.Method, accepted.conn.(*EncryptedConn).Method, tt.want)
+			}
+			if accepted.infoHash != infoHash {
+				t.Errorf("acceptEncryption() info hash got = %x, want %x", accepted.infoHash, infoHash)
+			}
+
+			// a BitTorrent handshake each way, and a message after it; a
+			// cipher out of step reads garbage lengths, so do not wait forever
+			conn.SetDeadline(time.Now().Add(time.Second))
+			accepted.conn.SetDeadline(time.Now().Add(time.Second))
+			var peerID [20]byte
+			go func() {
+				conn.Write(NewHandshake(infoHash, peerID).Serialize())
+				conn.Write((&Message{Type: MsgHave, Payload: []byte{0, 0, 0, 5}}).Serialize())
+			}()
+			h, err := ReadHandshake(accepted.conn)
+			if err != nil || h.InfoHash != infoHash {
+				t.Fatalf("ReadHandshake() got = %v, error %v", h, err)
+			}
+			msg, err := ReadMessage(accepted.conn)
+			if err != nil || msg.Type != MsgHave {
+				t.Fatalf("ReadMessage() got = %v, error %v", msg, err)
+			}
+			go accepted.conn.Write(NewHandshake(infoHash, peerID).Serialize())
+			if h, err := ReadHandshake(conn); err != nil || h.InfoHash != infoHash {
+				t.Fatalf("ReadHandshake() got = %v, error %v", h, err)
+			}
+		})
+	}
+}
+
+func TestEncryptionWireData(t *testing.T) {
+	infoHash := [20]byte{0xaa}
+	out, in := connPair(t)
+	done := make(chan net.Conn, 1)
+	go func() {
+		conn, _, _ := AcceptEncryption(in, [][20]byte{infoHash}, EncryptionRequire)
+		done <- conn
+	}()
+	conn, err := InitiateEncryption(out, infoHash, CryptoRC4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := <-done
+	if accepted == nil {
+		t.Fatal("AcceptEncryption() failed")
+	}
+
+	// the raw connection must not carry the plaintext
+	plain := []byte(btHandshake0)
+	go conn.Write(plain)
+	raw := make([]byte, len(plain))
+	if _, err := io.ReadFull(accepted.(*EncryptedConn).Conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(raw, plain) {
+		t.Errorf("RC4 connection sent plaintext %q", raw)
+	}
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	var infoHash, peerID [20]byte
+	tests := []struct {
+		policy  EncryptionPolicy
+		wantErr bool
+	}{
+		{EncryptionDisabled, false},
+		{EncryptionPrefer, false},
+		{EncryptionRequire, true},
+	}
+	for _, tt := range tests {
+		out, in := connPair(t)
+		go out.Write(NewHandshake(infoHash, peerID).Serialize())
+		conn, _, err := acceptEncryption(in, [][20]byte{infoHash}, tt.policy, 0)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("acceptEncryption() with policy %v error = %v, wantErr %v", tt.policy, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := ReadHandshake(conn); err != nil {
+			t.Errorf("ReadHandshake() after acceptEncryption() with policy %v error = %v", tt.policy, err)
+		}
+	}
+}
+
+func TestDialPeerFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// a peer without encryption support hangs up on the encrypted handshake
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			acceptEncryption(conn, nil, EncryptionDisabled, 0)
+			conn.Close()
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	peer := &Peer{IP: addr.IP.String(), Port: uint16(addr.Port)}
+
+	conn, err := DialPeer(peer, [20]byte{}, EncryptionPrefer, mseTimeout)
+	if err != nil {
+		t.Fatalf("DialPeer() with policy prefer error = %v", err)
+	}
+	if _, ok := conn.(*EncryptedConn); ok {
+		t.Errorf("DialPeer() with policy prefer got an encrypted connection, want plaintext")
+	}
+	conn.Close()
+	if _, err := DialPeer(peer, [20]byte{}, EncryptionRequire, mseTimeout); err == nil {
+		t.Errorf("DialPeer() with policy require got no error")
+	}
+}
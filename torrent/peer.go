@@ -2,15 +2,26 @@ package torrent
 
 import (
 	"crypto/rand"
-	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+)
+
+// PeerSource tells where a peer was learned from.
+type PeerSource = string
+
+const (
+	PeerFromTracker  PeerSource = "tracker"
+	PeerFromPex      PeerSource = "pex"      // Peer Exchange (BEP 11)
+	PeerFromIncoming PeerSource = "incoming" // peers that connected to us
 )
 
 type Peer struct {
-	ID   string
-	IP   string
-	Port uint16
+	ID     string
+	IP     string
+	Port   uint16
+	Source PeerSource
 }
 
 func PeerMe() *Peer {
@@ -26,7 +37,7 @@ func PeerMe() *Peer {
 }
 
 func (p *Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.IP, p.Port)
+	return net.JoinHostPort(p.IP, strconv.Itoa(int(p.Port)))
 }
 
 func externalIP() string {
@@ -0,0 +1,199 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxPeerSetSize is the most peers a PeerSet holds, further peers are not added.
+const MaxPeerSetSize = 1000
+
+// PeerSet holds the peers of a download. Peers come from trackers and from
+// other peers through Peer Exchange, and may be added while the download
+// runs. It is safe for concurrent use.
+type PeerSet struct {
+	// OnAdd is called with every peer added to the set, if set. It has to
+	// be set before the set is used.
+	OnAdd func(peer *Peer)
+
+	mu        sync.Mutex
+	peers     map[string]*Peer
+	order     []string        // addresses in the order the peers were added
+	connected map[string]bool // peers that completed a handshake with us
+	exchanges map[string]*pexExchange
+}
+
+// NewPeerSet returns a set of the peers.
+func NewPeerSet(peers map[string]*Peer) *PeerSet {
+	s := &PeerSet{
+		peers:     make(map[string]*Peer),
+		connected: make(map[string]bool),
+		exchanges: make(map[string]*pexExchange),
+	}
+	for _, peer := range peers {
+		s.add(peer)
+	}
+	return s
+}
+
+func (s *PeerSet) add(peer *Peer) bool {
+	if peer.Port == 0 || net.ParseIP(peer.IP) == nil || net.ParseIP(peer.IP).IsUnspecified() {
+		return false
+	}
+	addr := peer.String()
+	if _, ok := s.peers[addr]; ok || len(s.order) >= MaxPeerSetSize {
+		return false
+	}
+	s.peers[addr] = peer
+	s.order = append(s.order, addr)
+	return true
+}
+
+// Add adds the peers that are not in the set yet while it has room for
+// them, and returns them.
+func (s *PeerSet) Add(peers ...*Peer) []*Peer {
+	s.mu.Lock()
+	added := s.addAll(peers)
+	s.mu.Unlock()
+	s.notify(added)
+	return added
+}
+
+// AddFromPex adds the peers that from sent through Peer Exchange, like Add.
+// A message that arrives less than PexInterval after the last one from the
+// same peer is dropped, ok is false then.
+func (s *PeerSet) AddFromPex(from *Peer, peers []*Peer, now time.Time) (added []*Peer, ok bool) {
+	s.mu.Lock()
+	exchange := s.exchange(from)
+	if !exchange.received.IsZero() && now.Sub(exchange.received) < PexInterval {
+		s.mu.Unlock()
+		return nil, false
+	}
+	exchange.received = now
+	added = s.addAll(peers)
+	s.mu.Unlock()
+	s.notify(added)
+	return added, true
+}
+
+// addAll adds peers with s.mu held, and returns the ones that were added.
+func (s *PeerSet) addAll(peers []*Peer) []*Peer {
+	added := make([]*Peer, 0, len(peers))
+	for _, peer := range peers {
+		if s.add(peer) {
+			added = append(added, peer)
+		}
+	}
+	return added
+}
+
+// notify calls OnAdd with the added peers, without s.mu held.
+func (s *PeerSet) notify(added []*Peer) {
+	if s.OnAdd != nil {
+		for _, peer := range added {
+			s.OnAdd(peer)
+		}
+	}
+}
+
+// Peers returns the peers of the set, in the order they were added.
+func (s *PeerSet) Peers() []*Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]*Peer, len(s.order))
+	for i, addr := range s.order {
+		peers[i] = s.peers[addr]
+	}
+	return peers
+}
+
+// Len returns the number of peers in the set.
+func (s *PeerSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.order)
+}
+
+// SetConnected records whether the last connection to peer succeeded. Only
+// the peers we could connect to are sent to other peers. A new connection
+// starts what we send to peer over, as it forgot what we sent before, but a
+// peer that reconnects may not send its messages more often.
+func (s *PeerSet) SetConnected(peer *Peer, connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if connected {
+		s.connected[peer.String()] = true
+		exchange := s.exchange(peer)
+		exchange.sent = make(map[string]bool)
+		exchange.last = time.Time{}
+	} else {
+		delete(s.connected, peer.String())
+	}
+}
+
+// PexMessage returns the ut_pex message to send to peer: the peers we
+// connected to since the last message sent to it, and the ones we lost.
+// ok is false if a message was sent to peer less than PexInterval ago, or
+// if there is nothing new to send.
+func (s *PeerSet) PexMessage(peer *Peer, now time.Time) (payload []byte, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	to := peer.String()
+	exchange := s.exchange(peer)
+	if !exchange.last.IsZero() && now.Sub(exchange.last) < PexInterval {
+		return nil, false, nil
+	}
+
+	added := make([]PexPeer, 0)
+	for _, addr := range s.order {
+		if len(added) == MaxPexPeers {
+			break
+		}
+		if addr != to && s.connected[addr] && !exchange.sent[addr] {
+			added = append(added, PexPeer{Peer: s.peers[addr], Flags: PexReachable})
+		}
+	}
+	dropped := make([]*Peer, 0)
+	for addr := range exchange.sent {
+		if len(dropped) == MaxPexPeers {
+			break
+		}
+		if !s.connected[addr] {
+			dropped = append(dropped, s.peers[addr])
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil, false, nil
+	}
+
+	payload, err = FormatPex(added, dropped)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, p := range added {
+		exchange.sent[p.Peer.String()] = true
+	}
+	for _, p := range dropped {
+		delete(exchange.sent, p.String())
+	}
+	exchange.last = now
+	return payload, true, nil
+}
+
+// exchange returns the Peer Exchange state of peer, with s.mu held.
+func (s *PeerSet) exchange(peer *Peer) *pexExchange {
+	exchange, found := s.exchanges[peer.String()]
+	if !found {
+		exchange = &pexExchange{sent: make(map[string]bool)}
+		s.exchanges[peer.String()] = exchange
+	}
+	return exchange
+}
+
+// pexExchange is what was exchanged with a peer through Peer Exchange.
+type pexExchange struct {
+	sent     map[string]bool // peers the peer knows from us
+	last     time.Time       // when the last message was sent
+	received time.Time       // when the last message was received
+}
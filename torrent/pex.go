@@ -0,0 +1,168 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"gtorrent/bencode"
+	"net"
+	"time"
+)
+
+const (
+	UtPex       = "ut_pex"    // name of the Peer Exchange extension (BEP 11)
+	PexInterval = time.Minute // least time between two messages to the same peer
+	MaxPexPeers = 50          // most added and most dropped peers in one message
+)
+
+// Flags of an added peer.
+const (
+	PexEncryption byte = 0x01 // prefers encrypted connections
+	PexSeed       byte = 0x02 // is a seed or only uploads
+	PexUTP        byte = 0x04 // supports uTP
+	PexHolepunch  byte = 0x08 // supports ut_holepunch
+	PexReachable  byte = 0x10 // the sender connected to it, so it accepts connections
+)
+
+// PexPeer is a peer added in a ut_pex message, with its flags.
+type PexPeer struct {
+	Peer  *Peer
+	Flags byte
+}
+
+// pexMessage is the dictionary of a ut_pex message. Peers are in compact
+// form, 6 bytes for IPv4 and 18 bytes for IPv6, and the flags of the added
+// peers one byte each.
+type pexMessage struct {
+	Added       []byte `bencode:"added,omitempty"`
+	AddedFlags  []byte `bencode:"added.f,omitempty"`
+	Added6      []byte `bencode:"added6,omitempty"`
+	Added6Flags []byte `bencode:"added6.f,omitempty"`
+	Dropped     []byte `bencode:"dropped,omitempty"`
+	Dropped6    []byte `bencode:"dropped6,omitempty"`
+}
+
+// compactPeer appends the compact form of peer to the IPv4 or IPv6 list.
+func compactPeer(v4, v6 []byte, peer *Peer) ([]byte, []byte, error) {
+	ip := net.ParseIP(peer.IP)
+	if ip == nil {
+		return v4, v6, fmt.Errorf("invalid peer address %s", peer.IP)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.AppendUint16(append(v4, ip4...), peer.Port), v6, nil
+	}
+	return v4, binary.BigEndian.AppendUint16(append(v6, ip...), peer.Port), nil
+}
+
+// parseCompactPeers parses a list of peers in compact form with addresses
+// of size bytes.
+func parseCompactPeers(list []byte, size int) ([]*Peer, error) {
+	if len(list)%(size+2) != 0 {
+		return nil, fmt.Errorf("compact peer list of %d bytes", len(list))
+	}
+	peers := make([]*Peer, 0, len(list)/(size+2))
+	for i := 0; i < len(list); i += size + 2 {
+		peers = append(peers, &Peer{
+			IP:     net.IP(list[i : i+size]).String(),
+			Port:   binary.BigEndian.Uint16(list[i+size:]),
+			Source: PeerFromPex,
+		})
+	}
+	return peers, nil
+}
+
+// FormatPex creates the payload of a ut_pex message.
+func FormatPex(added []PexPeer, dropped []*Peer) ([]byte, error) {
+	msg := pexMessage{}
+	var err error
+	for _, p := range added {
+		before := len(msg.Added)
+		if msg.Added, msg.Added6, err = compactPeer(msg.Added, msg.Added6, p.Peer); err != nil {
+			return nil, err
+		}
+		if len(msg.Added) > before {
+			msg.AddedFlags = append(msg.AddedFlags, p.Flags)
+		} else {
+			msg.Added6Flags = append(msg.Added6Flags, p.Flags)
+		}
+	}
+	for _, peer := range dropped {
+		if msg.Dropped, msg.Dropped6, err = compactPeer(msg.Dropped, msg.Dropped6, peer); err != nil {
+			return nil, err
+		}
+	}
+	return bencode.Marshal(msg)
+}
+
+// ParsePex parses the payload of a ut_pex message. Missing flags are taken
+// as zero.
+func ParsePex(payload []byte) (added []PexPeer, dropped []*Peer, err error) {
+	msg := pexMessage{}
+	if err := bencode.Unmarshal(payload, &msg); err != nil {
+		return nil, nil, fmt.Errorf("invalid pex message: %w", err)
+	}
+	for _, list := range []struct {
+		peers []byte
+		flags []byte
+		size  int
+	}{{msg.Added, msg.AddedFlags, net.IPv4len}, {msg.Added6, msg.Added6Flags, net.IPv6len}} {
+		peers, err := parseCompactPeers(list.peers, list.size)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pex message: %w", err)
+		}
+		for i, peer := range peers {
+			p := PexPeer{Peer: peer}
+			if i < len(list.flags) {
+				p.Flags = list.flags[i]
+			}
+			added = append(added, p)
+		}
+	}
+	for _, list := range []struct {
+		peers []byte
+		size  int
+	}{{msg.Dropped, net.IPv4len}, {msg.Dropped6, net.IPv6len}} {
+		peers, err := parseCompactPeers(list.peers, list.size)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pex message: %w", err)
+		}
+		dropped = append(dropped, peers...)
+	}
+	return added, dropped, nil
+}
+
+// PexConn is a peer that exchanges peers with us.
+type PexConn interface {
+	ExtendedPeer
+	// AddPeers is called with the peers the peer sent, it ignores them if
+	// Peer Exchange is disabled for the torrent or if the peer sent others
+	// less than PexInterval ago.
+	AddPeers(peers []*Peer)
+}
+
+// HandlePex handles a ut_pex message: the added peers go to the peer set of
+// the download. Dropped peers are only dropped by the sender, they are kept.
+func HandlePex(peer ExtendedPeer, payload []byte) error {
+	pc, ok := peer.(PexConn)
+	if !ok {
+		return fmt.Errorf("peer does not exchange peers")
+	}
+	added, _, err := ParsePex(payload)
+	if err != nil {
+		return err
+	}
+	if len(added) > MaxPexPeers {
+		added = added[:MaxPexPeers]
+	}
+	peers := make([]*Peer, len(added))
+	for i, p := range added {
+		peers[i] = p.Peer
+	}
+	pc.AddPeers(peers)
+	return nil
+}
+
+func init() {
+	if _, err := Extensions.Register(UtPex, HandlePex); err != nil {
+		panic(err)
+	}
+}
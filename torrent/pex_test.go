@@ -0,0 +1,192 @@
+package torrent
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testPexConn collects the peers it receives.
+type testPexConn struct {
+	testExtendedPeer
+	received []*Peer
+}
+
+func (p *testPexConn) AddPeers(peers []*Peer) {
+	p.received = append(p.received, peers...)
+}
+
+func TestParsePex(t *testing.T) {
+	added := []PexPeer{
+		{&Peer{IP: "10.0.0.1", Port: 6881, Source: PeerFromPex}, PexReachable},
+		{&Peer{IP: "2001:db8::1", Port: 51413, Source: PeerFromPex}, PexSeed | PexEncryption},
+		{&Peer{IP: "192.168.1.20", Port: 1, Source: PeerFromPex}, 0},
+	}
+	dropped := []*Peer{
+		{IP: "10.0.0.2", Port: 6882, Source: PeerFromPex},
+		{IP: "2001:db8::2", Port: 6883, Source: PeerFromPex},
+	}
+	payload, err := FormatPex(added, dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotAdded, gotDropped, err := ParsePex(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IPv4 peers come before IPv6 ones
+	wantAdded := []PexPeer{added[0], added[2], added[1]}
+	if !reflect.DeepEqual(gotAdded, wantAdded) {
+		t.Errorf("ParsePex() added got = %v, want %v", gotAdded, wantAdded)
+	}
+	if !reflect.DeepEqual(gotDropped, dropped) {
+		t.Errorf("ParsePex() dropped got = %v, want %v", gotDropped, dropped)
+	}
+
+	tests := []struct {
+		payload string
+		wantErr bool
+	}{
+		{"de", false},
+		{"d5:added6:\x0a\x00\x00\x01\x1a\xe1e", false}, // no flags
+		{"d5:added5:\x0a\x00\x00\x01\x1ae", true},
+		{"d6:added617:0123456789abcdefge", true},
+		{"li1ee", true},
+	}
+	for _, tt := range tests {
+		if _, _, err := ParsePex([]byte(tt.payload)); (err != nil) != tt.wantErr {
+			t.Errorf("ParsePex(%q) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPeerSet(t *testing.T) {
+	var onAdd []string
+	s := NewPeerSet(map[string]*Peer{"10.0.0.1:1": {IP: "10.0.0.1", Port: 1}})
+	s.OnAdd = func(peer *Peer) { onAdd = append(onAdd, peer.String()) }
+
+	added := s.Add(
+		&Peer{IP: "10.0.0.1", Port: 1},    // already in the set
+		&Peer{IP: "0.0.0.0", Port: 2},     // unspecified
+		&Peer{IP: "not an ip", Port: 3},   // invalid
+		&Peer{IP: "10.0.0.4", Port: 0},    // no port
+		&Peer{IP: "2001:db8::5", Port: 5}, // new
+	)
+	if len(added) != 1 || s.Len() != 2 {
+		t.Errorf("Add() added %v, set has %d peers", added, s.Len())
+	}
+	if want := []string{"[2001:db8::5]:5"}; !reflect.DeepEqual(onAdd, want) {
+		t.Errorf("OnAdd got = %v, want %v", onAdd, want)
+	}
+	got := make([]string, 0)
+	for _, peer := range s.Peers() {
+		got = append(got, peer.String())
+	}
+	if want := []string{"10.0.0.1:1", "[2001:db8::5]:5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Peers() got = %v, want %v", got, want)
+	}
+}
+
+func TestPeerSetLimits(t *testing.T) {
+	s := NewPeerSet(nil)
+	for i := 0; i < MaxPeerSetSize+10; i++ {
+		s.Add(&Peer{IP: fmt.Sprintf("10.%d.%d.1", i/256, i%256), Port: 6881})
+	}
+	if s.Len() != MaxPeerSetSize {
+		t.Errorf("Len() got = %d, want %d", s.Len(), MaxPeerSetSize)
+	}
+
+	s = NewPeerSet(nil)
+	from := &Peer{IP: "10.0.0.1", Port: 1}
+	now := time.Now()
+	if added, ok := s.AddFromPex(from, []*Peer{{IP: "10.0.0.2", Port: 2}}, now); !ok || len(added) != 1 {
+		t.Errorf("AddFromPex() got = %v, ok %v, want 1 peer", added, ok)
+	}
+	if _, ok := s.AddFromPex(from, []*Peer{{IP: "10.0.0.3", Port: 3}}, now.Add(PexInterval-time.Second)); ok || s.Len() != 1 {
+		t.Errorf("AddFromPex() within %v of the last message got ok %v, %d peers", PexInterval, ok, s.Len())
+	}
+	if _, ok := s.AddFromPex(&Peer{IP: "10.0.0.4", Port: 4}, []*Peer{{IP: "10.0.0.3", Port: 3}}, now); !ok {
+		t.Errorf("AddFromPex() from another peer got no ok")
+	}
+
+	// reconnecting does not let a peer send more often
+	s.SetConnected(from, true)
+	if _, ok := s.AddFromPex(from, nil, now.Add(time.Second)); ok {
+		t.Errorf("AddFromPex() after a new connection within %v of the last message got ok", PexInterval)
+	}
+	if _, ok := s.AddFromPex(from, nil, now.Add(PexInterval)); !ok {
+		t.Errorf("AddFromPex() after a new connection and %v got no ok", PexInterval)
+	}
+}
+
+func TestPeerSetPexMessage(t *testing.T) {
+	s := NewPeerSet(nil)
+	for i := 0; i < MaxPexPeers+10; i++ {
+		peer := &Peer{IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Port: 6881}
+		s.Add(peer)
+		s.SetConnected(peer, true)
+	}
+	peers := s.Peers()
+	to := peers[0]
+	now := time.Now()
+
+	payload, ok, err := s.PexMessage(to, now)
+	if err != nil || !ok {
+		t.Fatalf("PexMessage() got ok %v, error %v", ok, err)
+	}
+	added, dropped, _ := ParsePex(payload)
+	if len(added) != MaxPexPeers || len(dropped) != 0 {
+		t.Errorf("PexMessage() sent %d added and %d dropped, want %d and 0", len(added), len(dropped), MaxPexPeers)
+	}
+	for _, p := range added {
+		if p.Peer.String() == to.String() {
+			t.Errorf("PexMessage() sent the peer to itself")
+		}
+		if p.Flags != PexReachable {
+			t.Errorf("PexMessage() flags got = %x, want %x", p.Flags, PexReachable)
+		}
+	}
+
+	if _, ok, _ := s.PexMessage(to, now.Add(PexInterval-time.Second)); ok {
+		t.Errorf("PexMessage() within %v of the last message got ok", PexInterval)
+	}
+
+	// the rest of the peers, and the one we lost since
+	s.SetConnected(peers[1], false)
+	payload, ok, _ = s.PexMessage(to, now.Add(PexInterval))
+	if !ok {
+		t.Fatalf("PexMessage() after %v got no message", PexInterval)
+	}
+	added, dropped, _ = ParsePex(payload)
+	if len(added) != 9 || len(dropped) != 1 || dropped[0].String() != peers[1].String() {
+		t.Errorf("PexMessage() sent %d added and dropped %v, want 9 and %v", len(added), dropped, peers[1])
+	}
+
+	if _, ok, _ := s.PexMessage(to, now.Add(3*PexInterval)); ok {
+		t.Errorf("PexMessage() without news got ok")
+	}
+
+	// a reconnected peer gets every peer again, right away
+	s.SetConnected(to, true)
+	payload, ok, _ = s.PexMessage(to, now.Add(3*PexInterval+time.Second))
+	added, _, _ = ParsePex(payload)
+	if !ok || len(added) != MaxPexPeers {
+		t.Errorf("PexMessage() after a new connection got ok %v and %d added, want %d", ok, len(added), MaxPexPeers)
+	}
+}
+
+func TestHandlePex(t *testing.T) {
+	payload, _ := FormatPex([]PexPeer{{&Peer{IP: "10.0.0.1", Port: 1}, 0}}, nil)
+	conn := &testPexConn{testExtendedPeer: testExtendedPeer{extensions: NewPeerExtensions()}}
+	if err := HandlePex(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	want := []*Peer{{IP: "10.0.0.1", Port: 1, Source: PeerFromPex}}
+	if !reflect.DeepEqual(conn.received, want) {
+		t.Errorf("HandlePex() got = %v, want %v", conn.received, want)
+	}
+	if err := HandlePex(&conn.testExtendedPeer, payload); err == nil {
+		t.Errorf("HandlePex() for a peer that does not exchange peers got no error")
+	}
+}
@@ -0,0 +1,105 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"gtorrent/bencode"
+	"testing"
+)
+
+// benchmarkPieceCount is the number of pieces of a torrent of a few hundred
+// GB with common piece sizes.
+const benchmarkPieceCount = 500_000
+
+// newBenchmarkTorrent returns a bencoded single-file torrent with count pieces
+// and the SHA-1 sums its piece hashes were made from.
+func newBenchmarkTorrent(count int) ([]byte, [][20]byte) {
+	const pieceLength = 16384
+	sums := make([][20]byte, count)
+	pieces := make([]byte, 0, 20*count)
+	for i := range sums {
+		sums[i] = sha1.Sum([]byte(fmt.Sprint(i)))
+		pieces = append(pieces, sums[i][:]...)
+	}
+	info := map[string]*bencode.Data{
+		"name":         bencode.NewData("big"),
+		"length":       bencode.NewData(int64(count) * pieceLength),
+		"piece length": bencode.NewData(int64(pieceLength)),
+		"pieces":       bencode.NewData(pieces),
+	}
+	return bencode.Encode(bencode.NewData(map[string]*bencode.Data{
+		"announce": bencode.NewData("http://tracker.example.com/announce"),
+		"info":     bencode.NewData(info),
+	})), sums
+}
+
+func BenchmarkTorrentFromBytes(b *testing.B) {
+	content, _ := newBenchmarkTorrent(benchmarkPieceCount)
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := TorrentFromBytes(content); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPieceHashCheck(b *testing.B) {
+	content, sums := newBenchmarkTorrent(benchmarkPieceCount)
+	tor, err := TorrentFromBytes(content)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range sums {
+			if !bytes.Equal(sums[j][:], tor.Pieces[j][:]) {
+				b.Fatalf("piece %d does not match", j)
+			}
+		}
+	}
+}
+
+// hexPieces returns the piece hashes of tor as hex strings, the way they
+// were stored before they were kept as [20]byte.
+func hexPieces(tor *Torrent) []string {
+	pieces := make([]string, len(tor.Pieces))
+	for i := range tor.Pieces {
+		pieces[i] = fmt.Sprintf("%x", tor.Pieces[i][:])
+	}
+	return pieces
+}
+
+// BenchmarkPieceHashesHex is the baseline of BenchmarkTorrentFromBytes: the
+// conversion of every piece hash to a hex string that parsing used to do.
+func BenchmarkPieceHashesHex(b *testing.B) {
+	content, _ := newBenchmarkTorrent(benchmarkPieceCount)
+	tor, err := TorrentFromBytes(content)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hexPieces(tor)
+	}
+}
+
+// BenchmarkPieceHashCheckHex is the baseline of BenchmarkPieceHashCheck: the
+// sums are formatted as hex and compared with the hex piece hashes.
+func BenchmarkPieceHashCheckHex(b *testing.B) {
+	content, sums := newBenchmarkTorrent(benchmarkPieceCount)
+	tor, err := TorrentFromBytes(content)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pieces := hexPieces(tor)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range sums {
+			if fmt.Sprintf("%x", sums[j]) != pieces[j] {
+				b.Fatalf("piece %d does not match", j)
+			}
+		}
+	}
+}
@@ -30,6 +30,12 @@ const (
 	MsgPiece         MessageType = 7
 	MsgCancel        MessageType = 8
 	MsgPort          MessageType = 9   // Typically not used by download clients
+	MsgSuggestPiece  MessageType = 13  // Fast Extension (BEP 6)
+	MsgHaveAll       MessageType = 14  // Fast Extension (BEP 6)
+	MsgHaveNone      MessageType = 15  // Fast Extension (BEP 6)
+	MsgRejectRequest MessageType = 16  // Fast Extension (BEP 6)
+	MsgAllowedFast   MessageType = 17  // Fast Extension (BEP 6)
+	MsgExtended      MessageType = 20  // Extension protocol (BEP 10)
 	MsgKeepAlive     MessageType = 255 // Special case, no ID, zero length
 )
 
@@ -53,6 +59,7 @@ func NewHandshake(infoHash, peerID [20]byte) *Handshake {
 	return &Handshake{
 		Pstrlen:  uint8(len(ProtocolIdentifier)),
 		Pstr:     ProtocolIdentifier,
+		Reserved: [8]byte{5: 0x10, 7: 0x04}, // we support the extension protocol and the Fast Extension
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -63,6 +70,7 @@ func (h *Handshake) Serialize() []byte {
 	buf := make([]byte, 49+len(h.Pstr))
 	buf[0] = h.Pstrlen
 	copy(buf[1:], h.Pstr)
+	copy(buf[1+len(h.Pstr):], h.Reserved[:])
 	copy(buf[1+len(h.Pstr)+8:], h.InfoHash[:])
 	copy(buf[1+len(h.Pstr)+8+20:], h.PeerID[:])
 	return buf
@@ -88,7 +96,6 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 
 	var infoHash, peerID [20]byte
 	pstr := string(handshakeBuf[:pstrlen])
-	// reserved := handshakeBuf[pstrlen : pstrlen+8] // We don't use reserved bytes yet
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
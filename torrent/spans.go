@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// FileSpan is the part of a file that a piece covers. Pieces are cut from the
+// concatenated content of all files, so one piece may span several files.
+type FileSpan struct {
+	FileIndex   int   // index of the file in FileList
+	FileOffset  int64 // offset of the span in the file
+	PieceOffset int64 // offset of the span in the piece
+	Length      int64
+}
+
+// setFileOffsets computes the offset and the piece range of every file from
+// the lengths of the files before it.
+func setFileOffsets(t *Torrent) {
+	var offset int64
+	for _, file := range t.FileList {
+		file.Offset = offset
+		offset += file.Length
+		if t.PieceLength <= 0 {
+			continue
+		}
+		file.FirstPieceIndex = int(file.Offset / t.PieceLength)
+		file.LastPieceIndex = file.FirstPieceIndex - 1
+		if file.Length > 0 {
+			file.LastPieceIndex = int((file.Offset + file.Length - 1) / t.PieceLength)
+		}
+	}
+}
+
+// PieceSize returns the length of piece i, which is PieceLength for every
+// piece but the last one.
+func (t *Torrent) PieceSize(i int) int64 {
+	start := int64(i) * t.PieceLength
+	if i < 0 || start >= t.Length {
+		return 0
+	}
+	return min(t.PieceLength, t.Length-start)
+}
+
+// PieceSpans returns the parts of the files that piece i covers, in file
+// order. Empty files never appear, padding files do. It returns nil for
+// pieces out of range.
+func (t *Torrent) PieceSpans(i int) []FileSpan {
+	size := t.PieceSize(i)
+	if size == 0 {
+		return nil
+	}
+	start := int64(i) * t.PieceLength
+	end := start + size
+
+	// first file that ends after the start of the piece
+	fileIndex := sort.Search(len(t.FileList), func(j int) bool {
+		return t.FileList[j].Offset+t.FileList[j].Length > start
+	})
+	spans := make([]FileSpan, 0, 1)
+	for ; fileIndex < len(t.FileList) && t.FileList[fileIndex].Offset < end; fileIndex++ {
+		file := t.FileList[fileIndex]
+		if file.Length == 0 {
+			continue
+		}
+		spanStart := max(start, file.Offset)
+		spanEnd := min(end, file.Offset+file.Length)
+		spans = append(spans, FileSpan{
+			FileIndex:   fileIndex,
+			FileOffset:  spanStart - file.Offset,
+			PieceOffset: spanStart - start,
+			Length:      spanEnd - spanStart,
+		})
+	}
+	return spans
+}
+
+// FilePieces returns the first and the last piece holding data of the file
+// at index fileIdx. For empty files last is first-1.
+func (t *Torrent) FilePieces(fileIdx int) (first, last int) {
+	file := t.FileList[fileIdx]
+	return file.FirstPieceIndex, file.LastPieceIndex
+}
+
+// ReadPiece reads piece i from the files on disk into buf, which must hold at
+// least PieceLength bytes, and returns the piece. Padding files read as zeros.
+func (l *Layout) ReadPiece(i int, buf []byte) ([]byte, error) {
+	piece := buf[:l.tor.PieceSize(i)]
+	for _, span := range l.tor.PieceSpans(i) {
+		part := piece[span.PieceOffset : span.PieceOffset+span.Length]
+		if l.tor.FileList[span.FileIndex].IsPadding() {
+			clear(part)
+			continue
+		}
+		f, err := os.Open(l.paths[span.FileIndex])
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.ReadAt(part, span.FileOffset)
+		f.Close()
+		if err == io.EOF {
+			err = fmt.Errorf("%s is shorter than expected: %w", l.paths[span.FileIndex], io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return piece, nil
+}
@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newSpansTorrent() *Torrent {
+	tor := NewTorrent()
+	tor.PieceLength = 8
+	for _, file := range []struct {
+		path   string
+		length int64
+	}{{"a", 5}, {"empty", 0}, {"c", 20}, {"d", 3}} {
+		tor.FileList = append(tor.FileList, NewFile(file.length, file.path))
+		tor.Length += file.length
+	}
+	setFileOffsets(tor)
+	return tor
+}
+
+func TestPieceSpans(t *testing.T) {
+	tor := newSpansTorrent()
+	tests := []struct {
+		piece int
+		want  []FileSpan
+	}{
+		{0, []FileSpan{{FileIndex: 0, FileOffset: 0, PieceOffset: 0, Length: 5}, {FileIndex: 2, FileOffset: 0, PieceOffset: 5, Length: 3}}},
+		{1, []FileSpan{{FileIndex: 2, FileOffset: 3, PieceOffset: 0, Length: 8}}},
+		{2, []FileSpan{{FileIndex: 2, FileOffset: 11, PieceOffset: 0, Length: 8}}},
+		{3, []FileSpan{{FileIndex: 2, FileOffset: 19, PieceOffset: 0, Length: 1}, {FileIndex: 3, FileOffset: 0, PieceOffset: 1, Length: 3}}},
+		{4, nil},
+		{-1, nil},
+	}
+	for _, tt := range tests {
+		if got := tor.PieceSpans(tt.piece); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PieceSpans(%d) got = %+v, want %+v", tt.piece, got, tt.want)
+		}
+	}
+
+	sizes := []int64{8, 8, 8, 4, 0}
+	for i, want := range sizes {
+		if got := tor.PieceSize(i); got != want {
+			t.Errorf("PieceSize(%d) got = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestFilePieces(t *testing.T) {
+	tor := newSpansTorrent()
+	want := [][2]int{{0, 0}, {0, -1}, {0, 3}, {3, 3}}
+	for i := range tor.FileList {
+		first, last := tor.FilePieces(i)
+		if [2]int{first, last} != want[i] {
+			t.Errorf("FilePieces(%d) got = %d, %d, want %d, %d", i, first, last, want[i][0], want[i][1])
+		}
+	}
+}
+
+func TestVerifyTorrentAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	content := filepath.Join(dir, "content")
+	files := map[string]int{"a.bin": 5000, "b/c.bin": 70000, "b/empty": 0, "d.bin": 12345}
+	for name, length := range files {
+		path := filepath.Join(content, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, patternContent(length, byte(len(name))), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	created, err := Create(CreateOptions{Path: content, PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentPath := filepath.Join(dir, "content.torrent")
+	if err := os.WriteFile(torrentPath, created, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyTorrent(torrentPath, content); err != nil {
+		t.Fatalf("VerifyTorrent() error = %v", err)
+	}
+
+	// corrupt the last byte of a.bin, which lives in the first piece along with c.bin
+	path := filepath.Join(content, "a.bin")
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyTorrent(torrentPath, content); err == nil || !strings.Contains(err.Error(), "piece 0") {
+		t.Errorf("VerifyTorrent() error = %v, want piece 0 corrupted", err)
+	}
+}
@@ -0,0 +1,56 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+)
+
+// ShuffleTiers returns a copy of tiers with the trackers of every tier in
+// random order. BEP 12 asks clients to do this once, when a torrent is added,
+// and to keep the resulting order from then on.
+func ShuffleTiers(tiers [][]string) [][]string {
+	shuffled := make([][]string, len(tiers))
+	for i, tier := range tiers {
+		shuffled[i] = slices.Clone(tier)
+		rand.Shuffle(len(shuffled[i]), func(a, b int) {
+			shuffled[i][a], shuffled[i][b] = shuffled[i][b], shuffled[i][a]
+		})
+	}
+	return shuffled
+}
+
+// PromoteTracker moves the tracker at index i to the front of its tier,
+// keeping the order of the others.
+func PromoteTracker[T any](tier []T, i int) {
+	if i <= 0 || i >= len(tier) {
+		return
+	}
+	promoted := tier[i]
+	copy(tier[1:i+1], tier[:i])
+	tier[0] = promoted
+}
+
+// AnnounceTiers tries the trackers one at a time, tier by tier, and stops at
+// the first one for which announce succeeds. That tracker is moved to the
+// front of its tier in tiers, so the caller can keep the order for the next
+// announce. The returned error joins the errors of every tracker tried when
+// none of them answered.
+func AnnounceTiers(tiers [][]ITracker, announce func(tracker ITracker) error) error {
+	errs := make([]error, 0)
+	for _, tier := range tiers {
+		for i, tracker := range tier {
+			err := announce(tracker)
+			if err == nil {
+				PromoteTracker(tier, i)
+				return nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", tracker.Announce(), err))
+		}
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no trackers to announce to")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,168 @@
+package torrent
+
+import (
+	"fmt"
+	"gtorrent/bencode"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestParseAnnounceTiers(t *testing.T) {
+	list := func(tiers ...[]string) *bencode.Data {
+		data := make([]*bencode.Data, len(tiers))
+		for i, tier := range tiers {
+			urls := make([]*bencode.Data, len(tier))
+			for j, url := range tier {
+				urls[j] = bencode.NewData(url)
+			}
+			data[i] = bencode.NewData(urls)
+		}
+		return bencode.NewData(data)
+	}
+	tests := []struct {
+		name      string
+		root      map[string]*bencode.Data
+		wantTiers [][]string
+		wantList  []string
+	}{
+		{
+			name:      "announce only",
+			root:      map[string]*bencode.Data{"announce": bencode.NewData("http://a")},
+			wantTiers: [][]string{{"http://a"}},
+			wantList:  []string{"http://a"},
+		},
+		{
+			name: "announce-list wins over announce",
+			root: map[string]*bencode.Data{
+				"announce":      bencode.NewData("http://x"),
+				"announce-list": list([]string{"http://a", "http://b"}, []string{}, []string{"udp://c"}),
+			},
+			wantTiers: [][]string{{"http://a", "http://b"}, {"udp://c"}},
+			wantList:  []string{"http://a", "http://b", "udp://c", "http://x"},
+		},
+		{
+			name:      "no trackers",
+			root:      map[string]*bencode.Data{},
+			wantTiers: [][]string{},
+			wantList:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.root["info"] = bencode.NewData(map[string]*bencode.Data{
+				"name":         bencode.NewData("a"),
+				"length":       bencode.NewData(1),
+				"piece length": bencode.NewData(16384),
+				"pieces":       bencode.NewData(make([]byte, 20)),
+			})
+			tor, err := TorrentFromBytes(bencode.Encode(bencode.NewData(tt.root)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tor.AnnounceTiers, tt.wantTiers) {
+				t.Errorf("AnnounceTiers got = %v, want %v", tor.AnnounceTiers, tt.wantTiers)
+			}
+			if !reflect.DeepEqual(tor.AnnounceList, tt.wantList) {
+				t.Errorf("AnnounceList got = %v, want %v", tor.AnnounceList, tt.wantList)
+			}
+		})
+	}
+}
+
+func TestShuffleTiers(t *testing.T) {
+	tiers := [][]string{{"a", "b", "c", "d", "e", "f"}, {"g"}}
+	original := [][]string{slices.Clone(tiers[0]), slices.Clone(tiers[1])}
+	shuffled := ShuffleTiers(tiers)
+	if !reflect.DeepEqual(tiers, original) {
+		t.Errorf("ShuffleTiers() modified its input: %v", tiers)
+	}
+	for i := range tiers {
+		got := slices.Clone(shuffled[i])
+		slices.Sort(got)
+		if !reflect.DeepEqual(got, original[i]) {
+			t.Errorf("ShuffleTiers() tier %d got = %v, want a permutation of %v", i, shuffled[i], original[i])
+		}
+	}
+}
+
+func TestPromoteTracker(t *testing.T) {
+	tests := []struct {
+		index int
+		want  []string
+	}{
+		{0, []string{"a", "b", "c", "d"}},
+		{2, []string{"c", "a", "b", "d"}},
+		{3, []string{"d", "a", "b", "c"}},
+		{4, []string{"a", "b", "c", "d"}},
+	}
+	for _, tt := range tests {
+		tier := []string{"a", "b", "c", "d"}
+		PromoteTracker(tier, tt.index)
+		if !reflect.DeepEqual(tier, tt.want) {
+			t.Errorf("PromoteTracker(%d) got = %v, want %v", tt.index, tier, tt.want)
+		}
+	}
+}
+
+// fakeTracker is an ITracker that only knows its announce URL.
+type fakeTracker struct {
+	ITracker
+	announce string
+}
+
+func (f *fakeTracker) Announce() string {
+	return f.announce
+}
+
+func TestAnnounceTiers(t *testing.T) {
+	newTiers := func() [][]ITracker {
+		return [][]ITracker{
+			{&fakeTracker{announce: "a1"}, &fakeTracker{announce: "a2"}},
+			{&fakeTracker{announce: "b1"}, &fakeTracker{announce: "b2"}, &fakeTracker{announce: "b3"}},
+		}
+	}
+	order := func(tiers [][]ITracker) [][]string {
+		result := make([][]string, len(tiers))
+		for i, tier := range tiers {
+			for _, tracker := range tier {
+				result[i] = append(result[i], tracker.Announce())
+			}
+		}
+		return result
+	}
+
+	tests := []struct {
+		name      string
+		working   string
+		wantTried []string
+		wantOrder [][]string
+		wantErr   bool
+	}{
+		{"first tracker", "a1", []string{"a1"}, [][]string{{"a1", "a2"}, {"b1", "b2", "b3"}}, false},
+		{"second tier", "b3", []string{"a1", "a2", "b1", "b2", "b3"}, [][]string{{"a1", "a2"}, {"b3", "b1", "b2"}}, false},
+		{"none", "", []string{"a1", "a2", "b1", "b2", "b3"}, [][]string{{"a1", "a2"}, {"b1", "b2", "b3"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tiers := newTiers()
+			tried := make([]string, 0)
+			err := AnnounceTiers(tiers, func(tracker ITracker) error {
+				tried = append(tried, tracker.Announce())
+				if tracker.Announce() != tt.working {
+					return fmt.Errorf("unreachable")
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AnnounceTiers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(tried, tt.wantTried) {
+				t.Errorf("AnnounceTiers() tried = %v, want %v", tried, tt.wantTried)
+			}
+			if got := order(tiers); !reflect.DeepEqual(got, tt.wantOrder) {
+				t.Errorf("AnnounceTiers() order = %v, want %v", got, tt.wantOrder)
+			}
+		})
+	}
+}
@@ -2,38 +2,48 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"gtorrent/bencode"
 	"gtorrent/utils"
 	"os"
-	"path/filepath"
 	"slices"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type Torrent struct {
-	AnnounceList []string
-	Name         string
-	UrlList      []string
-	CreatedBy    string
-	Comment      string
-	CreatedAt    int64
-	FileList     []*File
-	PieceLength  int64
-	Pieces       []string
-	InfoHash     [20]byte
-	Length       int64
-	IsPrivate    bool
+	AnnounceList  []string   // every tracker, flattened
+	AnnounceTiers [][]string // trackers grouped in tiers (BEP 12), in the order of the torrent file
+	Name          string
+	UrlList       []string
+	CreatedBy     string
+	Comment       string
+	CreatedAt     int64
+	FileList      []*File
+	PieceLength   int64
+	Pieces        [][20]byte // SHA-1 hash of every piece
+	InfoHash      [20]byte   // SHA-1 info hash, the truncated SHA-256 one for v2-only torrents
+	InfoBytes     []byte     // bencoded info dictionary exactly as it appeared in the source
+	Length        int64
+	IsPrivate     bool
+	IsSingleFile  bool // the content is a single file named Name, not a directory
+
+	// BitTorrent v2 (BEP 52), set for v2 and hybrid torrents
+	MetaVersion int
+	InfoHashV2  [32]byte
+	PieceLayers map[[32]byte][]byte // concatenated piece layer hashes by pieces root
 }
 
 func NewTorrent() *Torrent {
 	return &Torrent{
-		AnnounceList: make([]string, 0),
-		UrlList:      make([]string, 0),
-		FileList:     make([]*File, 0),
-		Pieces:       make([]string, 0),
+		AnnounceList:  make([]string, 0),
+		AnnounceTiers: make([][]string, 0),
+		UrlList:       make([]string, 0),
+		FileList:      make([]*File, 0),
+		Pieces:        make([][20]byte, 0),
 	}
 }
 
@@ -72,8 +82,15 @@ func (t *Torrent) InfoHashString() string {
 type File struct {
 	Length          int64
 	Path            string
-	FirstPieceIndex int
-	LastPieceIndex  int
+	Offset          int64    // offset of the file in the concatenated content of the torrent
+	FirstPieceIndex int      // first piece holding data of the file
+	LastPieceIndex  int      // last piece holding data of the file, FirstPieceIndex-1 for empty files
+	PiecesRoot      [32]byte // v2 merkle root of the file, zero for empty and v1 files
+
+	// BEP 47 file attributes
+	Attr        string // any of p (padding), x (executable), h (hidden) and l (symlink)
+	SymlinkPath string // "/" separated target of a symlink, relative to the root of the torrent
+	SHA1        []byte // SHA-1 of the whole file, nil if the torrent does not list it
 }
 
 func NewFile(length int64, path string) *File {
@@ -90,142 +107,239 @@ func (f *File) String() string {
 // TorrentFromBencodeData converts bencode data into a Torrent struct.
 // It extracts all torrent metadata including announce lists, file information,
 // piece hashes, and other properties from the bencode data.
-// Returns nil if the input data is nil.
-func TorrentFromBencodeData(data *bencode.Data) *Torrent {
+// Returns a *ValidationError listing every problem found if the metainfo is invalid.
+func TorrentFromBencodeData(data *bencode.Data) (*Torrent, error) {
+	r := &metainfoReader{}
 	if data == nil {
-		return nil
+		r.addf("", "empty torrent")
+		return nil, r.err()
+	}
+	if data.Type != bencode.DICT {
+		r.addf("", "expected a dictionary, got %s", typeName(data.Type))
+		return nil, r.err()
 	}
 	torrent := NewTorrent()
 	rootDict := data.AsDict()
-	infoDict := rootDict["info"].AsDict()
+	infoData, ok := r.value(rootDict, "", "info", bencode.DICT, true)
+	if !ok {
+		return nil, r.err()
+	}
+	infoDict := infoData.AsDict()
 
 	// announce-list
-	if announceList, ok := rootDict["announce-list"]; ok {
-		announceListData := announceList.AsList()
-		for _, announceData := range announceListData {
-			announceList := announceData.AsList()
-			for _, announce := range announceList {
-				torrent.AnnounceList = append(torrent.AnnounceList, announce.AsString())
+	if announceList, ok := r.list(rootDict, "", "announce-list", false); ok {
+		for i, announceData := range announceList {
+			field := fmt.Sprintf("announce-list[%d]", i)
+			if _, ok := r.check(announceData, field, bencode.LIST); !ok {
+				continue
+			}
+			tier := r.strings(announceData.AsList(), field)
+			torrent.AnnounceList = append(torrent.AnnounceList, tier...)
+			if len(tier) > 0 {
+				torrent.AnnounceTiers = append(torrent.AnnounceTiers, tier)
 			}
 		}
 	}
 
-	// announce
-	if announce, ok := rootDict["announce"]; ok {
-		if !slices.Contains(torrent.AnnounceList, announce.AsString()) {
-			torrent.AnnounceList = append(torrent.AnnounceList, announce.AsString())
+	// announce, only used as a tier of its own when there is no announce-list
+	if announce, ok := r.str(rootDict, "", "announce", false); ok {
+		if !slices.Contains(torrent.AnnounceList, announce) {
+			torrent.AnnounceList = append(torrent.AnnounceList, announce)
+		}
+		if len(torrent.AnnounceTiers) == 0 {
+			torrent.AnnounceTiers = append(torrent.AnnounceTiers, []string{announce})
 		}
 	}
 
 	// name
-	if name, ok := infoDict["name"]; ok {
-		torrent.Name = name.AsString()
+	if name, ok := r.str(infoDict, "info", "name", true); ok {
+		if name == "" {
+			r.addf("info.name", "empty")
+		}
+		torrent.Name = name
+	}
+	// name.utf-8, set by some clients when name is in another encoding
+	if name, ok := r.str(infoDict, "info", "name.utf-8", false); ok && name != "" && utf8.ValidString(name) {
+		torrent.Name = name
 	}
 
-	// url-list
+	// url-list, a single URL or a list of them (BEP 19)
 	if urlList, ok := rootDict["url-list"]; ok {
-		urlListData := urlList.AsList()
-		for _, url := range urlListData {
-			torrent.UrlList = append(torrent.UrlList, url.AsString())
+		if urlList.Type == bencode.STRING {
+			if url := urlList.AsString(); url != "" {
+				torrent.UrlList = append(torrent.UrlList, url)
+			}
+		} else if _, ok := r.check(urlList, "url-list", bencode.LIST); ok {
+			torrent.UrlList = r.strings(urlList.AsList(), "url-list")
 		}
 	}
 
 	// comment
-	if comment, ok := rootDict["comment"]; ok {
-		torrent.Comment = comment.AsString()
+	if comment, ok := r.str(rootDict, "", "comment", false); ok {
+		torrent.Comment = comment
 	}
 
 	// created by
-	if createdBy, ok := rootDict["created by"]; ok {
-		torrent.CreatedBy = createdBy.AsString()
+	if createdBy, ok := r.str(rootDict, "", "created by", false); ok {
+		torrent.CreatedBy = createdBy
 	}
 
 	// creation date
-	if createdAt, ok := rootDict["creation date"]; ok {
-		torrent.CreatedAt = createdAt.AsInt()
+	if createdAt, ok := r.integer(rootDict, "", "creation date", false); ok {
+		torrent.CreatedAt = createdAt
+	}
+
+	// meta version 2 (BEP 52), hybrid torrents carry both v1 and v2 metadata
+	torrent.MetaVersion = 1
+	if metaVersion, ok := r.integer(infoDict, "info", "meta version", false); ok {
+		if metaVersion != 1 && metaVersion != 2 {
+			r.addf("info.meta version", "unsupported version %d", metaVersion)
+		} else {
+			torrent.MetaVersion = int(metaVersion)
+		}
 	}
 
 	// files list
-	if files, ok := infoDict["files"]; ok {
-		filesData := files.AsList()
-		for _, fileData := range filesData {
+	_, hasFiles := infoDict["files"]
+	_, hasLength := infoDict["length"]
+	if files, ok := r.list(infoDict, "info", "files", false); ok {
+		if hasLength {
+			r.addf("info", "has both length and files")
+		}
+		if len(files) == 0 {
+			r.addf("info.files", "empty")
+		}
+		seen := make(map[string]int, len(files))
+		for i, fileData := range files {
+			field := fmt.Sprintf("info.files[%d]", i)
+			if _, ok := r.check(fileData, field, bencode.DICT); !ok {
+				continue
+			}
 			fileDict := fileData.AsDict()
-			file := NewFile(fileDict["length"].AsInt(), "")
-
-			if filePath, ok := fileDict["path"]; ok {
-				pathData := filePath.AsList()
-				for i, path := range pathData {
-					// join path with "/"
-					file.Path += path.AsString()
-					if i < len(pathData)-1 {
-						file.Path += "/"
-					}
+			length, _ := r.integer(fileDict, field, "length", true)
+			if length < 0 {
+				r.addf(field+".length", "negative length %d", length)
+			}
+
+			pathData, ok := r.list(fileDict, field, "path", true)
+			if ok && len(pathData) == 0 {
+				r.addf(field+".path", "empty")
+			}
+			path := r.strings(pathData, field+".path")
+			for j, component := range path {
+				if component == "" {
+					r.addf(fmt.Sprintf("%s.path[%d]", field, j), "empty")
 				}
 			}
 
+			// path.utf-8 is preferred when path is in another encoding
+			if utf8PathData, ok := r.list(fileDict, field, "path.utf-8", false); ok {
+				utf8Path := r.strings(utf8PathData, field+".path.utf-8")
+				if len(utf8Path) > 0 && len(utf8Path) == len(utf8PathData) && utf8.ValidString(strings.Join(utf8Path, "/")) {
+					path = utf8Path
+				}
+			}
+
+			// join path with "/"
+			file := NewFile(length, strings.Join(path, "/"))
+
+			readFileAttributes(r, fileDict, field, file)
+
+			// padding files are named after their length and may repeat
+			if first, ok := seen[file.Path]; ok && len(path) > 0 && !file.IsPadding() {
+				r.addf(field+".path", "duplicate of info.files[%d]", first)
+			} else {
+				seen[file.Path] = i
+			}
 			torrent.FileList = append(torrent.FileList, file)
 			torrent.Length += file.Length
 		}
-	} else {
+	} else if length, ok := r.integer(infoDict, "info", "length", false); ok {
 		// single file mode
-		torrent.Length = infoDict["length"].AsInt()
+		if length < 0 {
+			r.addf("info.length", "negative length %d", length)
+		}
+		torrent.Length = length
+		torrent.IsSingleFile = true
 		file := NewFile(torrent.Length, torrent.Name)
+		readFileAttributes(r, infoDict, "info", file)
 		torrent.FileList = append(torrent.FileList, file)
+	} else if !hasFiles && !hasLength && torrent.MetaVersion < 2 {
+		r.addf("info", "missing both length and files")
 	}
 
 	// piece length
-	if pieceLength, ok := infoDict["piece length"]; ok {
-		torrent.PieceLength = pieceLength.AsInt()
-	} else {
-		torrent.PieceLength = 0
-
+	if pieceLength, ok := r.integer(infoDict, "info", "piece length", true); ok {
+		if pieceLength <= 0 {
+			r.addf("info.piece length", "must be positive, got %d", pieceLength)
+		} else if torrent.MetaVersion == 2 && (pieceLength < V2BlockSize || pieceLength&(pieceLength-1) != 0) {
+			r.addf("info.piece length", "must be a power of two of at least %d in v2 torrents, got %d", V2BlockSize, pieceLength)
+		}
+		torrent.PieceLength = pieceLength
 	}
 
-	// pieces
-	if pieces, ok := infoDict["pieces"]; ok {
+	// pieces, only optional in v2-only torrents
+	if pieces, ok := r.value(infoDict, "info", "pieces", bencode.STRING, torrent.MetaVersion < 2); ok {
 		piecesData := pieces.AsBytes()
-		for i := 0; i < len(piecesData); i += 20 {
-			piece := fmt.Sprintf("%x", piecesData[i:i+20])
-			torrent.Pieces = append(torrent.Pieces, piece)
+		if len(piecesData)%20 != 0 {
+			r.addf("info.pieces", "length %d is not a multiple of 20", len(piecesData))
+		} else {
+			torrent.Pieces = make([][20]byte, len(piecesData)/20)
+			for i := range torrent.Pieces {
+				copy(torrent.Pieces[i][:], piecesData[i*20:])
+			}
+			if torrent.PieceLength > 0 && torrent.Length >= 0 {
+				want := (torrent.Length + torrent.PieceLength - 1) / torrent.PieceLength
+				if int64(len(torrent.Pieces)) != want {
+					r.addf("info.pieces", "has %d hashes, %d bytes in pieces of %d need %d", len(torrent.Pieces), torrent.Length, torrent.PieceLength, want)
+				}
+			}
 		}
 	}
 
 	// is private
-	if isPrivate, ok := infoDict["private"]; ok {
-		torrent.IsPrivate = isPrivate.AsInt() == 1
+	if isPrivate, ok := r.integer(infoDict, "info", "private", false); ok {
+		torrent.IsPrivate = isPrivate == 1
 	}
 
-	// info hash
-	infoData := rootDict["info"]
-	hash := sha1.Sum(infoData.ToBytes())
-	torrent.InfoHash = hash
-
-	// put piece indices in the files
-	pieceIndex := 0
-	for _, file := range torrent.FileList {
-		// calculate the number of pieces for this file
-		pieceCount := file.Length / torrent.PieceLength
-		if file.Length%torrent.PieceLength != 0 {
-			pieceCount++
+	// info hash, computed from the original bytes so that non-canonical info
+	// dictionaries still hash to the value the rest of the swarm uses
+	infoBytes := infoData.Raw
+	if infoBytes == nil {
+		infoBytes = infoData.ToBytes()
+	}
+	torrent.InfoBytes = slices.Clone(infoBytes)
+	torrent.InfoHash = sha1.Sum(torrent.InfoBytes)
+
+	if torrent.HasV2() {
+		torrent.InfoHashV2 = sha256.Sum256(torrent.InfoBytes)
+		if !torrent.HasV1() {
+			copy(torrent.InfoHash[:], torrent.InfoHashV2[:20])
+		}
+		if err := applyV2Metadata(torrent, rootDict, infoDict); err != nil {
+			r.addf("", "%s", err)
 		}
-		file.FirstPieceIndex = pieceIndex
-		file.LastPieceIndex = pieceIndex + int(pieceCount) - 1
-		pieceIndex += int(pieceCount)
 	}
 
-	return torrent
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+
+	setFileOffsets(torrent)
+	return torrent, nil
 }
 
 // TorrentFromBytes parses a byte slice containing torrent file data and converts it to a Torrent struct.
 // This is typically used when reading a .torrent file from disk.
 // It first decodes the bencode data and then converts it to a Torrent struct.
-// Returns an error if the bencode data cannot be decoded.
+// Returns an error if the bencode data cannot be decoded, and a *ValidationError
+// if the metainfo is invalid.
 func TorrentFromBytes(data []byte) (*Torrent, error) {
 	bencodeData, _, err := bencode.Decode(data)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding torrent file: %s", err.Error())
 	}
-	return TorrentFromBencodeData(bencodeData), nil
+	return TorrentFromBencodeData(bencodeData)
 }
 
 // VerifyTorrent checks if the files described in a torrent file exist at the given contentPath
@@ -251,92 +365,22 @@ func VerifyTorrent(filename string, contentPath string) error {
 		return err
 	}
 
-	// Verify the existence of the physical files
-	for _, file := range torrent.FileList {
-		filePath := filepath.Join(contentPath, file.Path)
-		if _, err := os.Stat(filePath); err != nil {
-			return err
-		}
+	layout, err := NewLayout(torrent, contentPath)
+	if err != nil {
+		return err
 	}
 
-	// Verify the integrity of the files
-	/* Note: For the purposes of piece boundaries in the multi-file case,
-	consider the file data as one long continuous stream, composed of the concatenation of
-	each file in the order listed in the files list. The number of pieces and their boundaries
-	are then determined in the same manner as the case of a single file.
-	Pieces may overlap file boundaries.
-	So we have this strategy:
-	1. Open each file and read chunks in the size of the piece length
-	2. if the last chunk is smaller than the piece length, append it to the next chunk
-	3. Calculate the SHA1 hash of the chunk
-	*/
-
-	pieceLength := torrent.PieceLength
-	pieceHashes := torrent.Pieces
-	pieceIndex := 0
-	piece := make([]byte, pieceLength)
-	// Create a single reusable buffer for reading pieces
-	pieceBuf := make([]byte, pieceLength)
-
-	for fileIndex, file := range torrent.FileList {
-		println("Checking " + file.Path)
-		filePath := filepath.Join(contentPath, file.Path)
-		f, err := os.Open(filePath)
-		if err != nil {
-			return err
-		}
-
-		// Process the file
-		fileProcessingErr := func() error {
-			defer f.Close() // Close inside the function scope when done with this file
-
-			for {
-				// Use our reusable buffer instead of creating a new one each time
-				n, err := f.Read(pieceBuf)
-				if err != nil {
-					if err.Error() == "EOF" {
-						break
-					}
-					return err
-				}
-				if n == 0 {
-					break
-				}
-				if n < int(pieceLength) {
-					if len(piece) < int(pieceLength) {
-						piece = append(piece, pieceBuf[:n]...)
-					} else {
-						// Copy the data instead of reassigning
-						copy(piece, pieceBuf[:n])
-						// Ensure piece has the right length
-						piece = piece[:n]
-					}
-
-					if fileIndex != len(torrent.FileList)-1 {
-						break
-					}
-				} else {
-					// Use our buffer directly
-					piece = pieceBuf[:n]
-				}
-
-				hash := sha1.Sum(piece)
-				hashStr := fmt.Sprintf("%x", hash)
-				if hashStr != pieceHashes[pieceIndex] {
-					return fmt.Errorf("piece %d is corrupted", pieceIndex)
-				}
-				pieceIndex++
-				if pieceIndex == len(pieceHashes) {
-					break
-				}
-			}
-			return nil // Add explicit return nil
-		}()
-
-		// If there was an error processing this file, return it
-		if fileProcessingErr != nil {
-			return fileProcessingErr
-		}
+	// v2 and hybrid torrents are checked file by file against their merkle roots
+	var report *VerifyReport
+	if torrent.HasV2() {
+		println(fmt.Sprintf("Checking %d files", len(torrent.FileList)))
+		report, err = layout.VerifyV2()
+	} else {
+		println(fmt.Sprintf("Checking %d pieces", len(torrent.Pieces)))
+		report, err = layout.Verify(VerifyOptions{})
+	}
+	if err != nil {
+		return err
 	}
-	return nil
+	return report.Err()
 }
@@ -64,7 +64,11 @@ func testBody(t *testing.T, filename string) {
 		t.Error(err)
 		return
 	}
-	torrent := TorrentFromBencodeData(data)
+	torrent, err := TorrentFromBencodeData(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
 	filenameJson := filename + ".json"
 	fileJson, err := os.Open(filenameJson)
@@ -251,3 +255,22 @@ func TestVerifyTorrent3(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestInfoHashFromRawBytes(t *testing.T) {
+	// keys of the info dictionary are deliberately out of order, re-encoding
+	// it would sort them and produce a different hash
+	info := "d4:name5:a.txt6:lengthi3e12:piece lengthi16384e6:pieces20:01234567890123456789e"
+	content := []byte("d8:announce20:http://tracker/annnc4:info" + info + "e")
+
+	torrent, err := TorrentFromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha1.Sum([]byte(info))
+	if torrent.InfoHash != want {
+		t.Errorf("Expected InfoHash to be %x, got %x", want, torrent.InfoHash)
+	}
+	if string(torrent.InfoBytes) != info {
+		t.Errorf("Expected InfoBytes to be %s, got %s", info, torrent.InfoBytes)
+	}
+}
@@ -2,9 +2,20 @@ package torrent
 
 import (
 	"fmt"
+	"gtorrent/bencode"
 	"net/url"
 )
 
+// TrackerLimits bounds how much of a tracker reply is decoded. Replies are
+// attacker-controlled and are never larger than a few hundred kilobytes, even
+// for non-compact peer lists.
+var TrackerLimits = bencode.Limits{
+	MaxDepth:        8,
+	MaxStringLength: 1 << 20,
+	MaxElements:     64 << 10,
+	MaxInputSize:    2 << 20,
+}
+
 type ITracker interface {
 	GetPeers(tor *Torrent, me *Peer) ([]*Peer, error)
 	Announce() string
@@ -1,8 +1,10 @@
 package torrent
 
 import (
+	"errors"
 	"fmt"
 	"gtorrent/bencode"
+	"io"
 
 	"time"
 
@@ -49,11 +51,22 @@ func (t *httpTracker) Leechers() int {
 	return t.leechers
 }
 
+// httpTrackerResponse is the bencoded dictionary an HTTP tracker answers an announce with.
+type httpTrackerResponse struct {
+	FailureReason  string        `bencode:"failure reason"`
+	WarningMessage string        `bencode:"warning message"`
+	Interval       int64         `bencode:"interval"`
+	Complete       int64         `bencode:"complete"`
+	Incomplete     int64         `bencode:"incomplete"`
+	Peers          *bencode.Data `bencode:"peers"` // compact string or list of dictionaries
+}
+
 func (t *httpTracker) GetPeers(tor *Torrent, me *Peer) ([]*Peer, error) {
 	peers := make([]*Peer, 0)
 	cli := resty.New()
 
 	resp, err := cli.R().
+		SetDoNotParseResponse(true).
 		SetQueryParam("info_hash", string(tor.InfoHash[:])).
 		SetQueryParam("peer_id", me.ID).
 		SetQueryParam("ip", me.IP).
@@ -68,61 +81,65 @@ func (t *httpTracker) GetPeers(tor *Torrent, me *Peer) ([]*Peer, error) {
 		t.lastError = err
 		return peers, err
 	}
+	body := resp.RawBody()
+	defer body.Close()
+
 	t.lastCheck = time.Now().Unix()
 	if resp.StatusCode() != 200 {
-		err = fmt.Errorf("status code: %d, error: %s", resp.StatusCode(), resp.String())
+		msg, _ := io.ReadAll(io.LimitReader(body, 1024))
+		err = fmt.Errorf("status code: %d, error: %s", resp.StatusCode(), string(msg))
 		t.lastError = err
 		return peers, err
 	}
-	// Parse the response
-	response, _, err := bencode.Decode(resp.Body())
+	// Parse the response straight off the connection
+	var response httpTrackerResponse
+	dec := bencode.NewDecoder(body)
+	dec.SetOptions(bencode.DecodeOptions{Limits: &TrackerLimits})
+	err = dec.Decode(&response)
 	if err != nil {
 		err = fmt.Errorf("status code: %d, error: %s", resp.StatusCode(), err.Error())
 		t.lastError = err
 		return peers, err
 	}
-	// respStr := response.ToJSON()
-	// log.Debug().Msgf("Response: %s", respStr)
-	respDict := response.AsDict()
 
-	if failureReason, ok := respDict["failure reason"]; ok {
-		err = fmt.Errorf(failureReason.AsString())
+	if response.FailureReason != "" {
+		err = errors.New(response.FailureReason)
 		t.lastError = err
 		return peers, err
 	}
 
-	if complete, ok := respDict["complete"]; ok {
-		t.seeders = int(complete.AsInt())
-	}
-
-	// if downloaded, ok := respDict["downloaded"]; ok {
-	// 	t.seeders = int(downloaded.AsInt())
-	// }
+	t.seeders = int(response.Complete)
+	t.leechers = int(response.Incomplete)
 
-	if leechers, ok := respDict["incomplete"]; ok {
-		t.leechers = int(leechers.AsInt())
+	if response.Interval > 0 {
+		t.nextCheck = time.Now().Unix() + response.Interval
 	}
 
-	if interval, ok := respDict["interval"]; ok {
-		t.nextCheck = time.Now().Unix() + int64(interval.AsInt())
-	}
-
-	if peersList, ok := respDict["peers"]; ok {
+	if peersList := response.Peers; peersList != nil {
 		if peersList.Type == bencode.STRING {
-			peersList := peersList.AsString()
-			for i := 0; i < len(peersList); i += 6 {
+			peersList := peersList.AsBytes()
+			for i := 0; i+6 <= len(peersList); i += 6 {
 				peer := &Peer{
-					IP:   fmt.Sprintf("%d.%d.%d.%d", peersList[i], peersList[i+1], peersList[i+2], peersList[i+3]),
-					Port: uint16(int(peersList[i+4])<<8 + int(peersList[i+5])),
+					IP:     fmt.Sprintf("%d.%d.%d.%d", peersList[i], peersList[i+1], peersList[i+2], peersList[i+3]),
+					Port:   uint16(int(peersList[i+4])<<8 + int(peersList[i+5])),
+					Source: PeerFromTracker,
 				}
 				peers = append(peers, peer)
 			}
 		} else if peersList.Type == bencode.LIST {
-			for _, peerData := range peersList.AsList() {
-				peerDict := peerData.AsDict()
+			var peerDicts []struct {
+				IP   string `bencode:"ip"`
+				Port uint16 `bencode:"port"`
+			}
+			if err := bencode.UnmarshalData(peersList, &peerDicts); err != nil {
+				t.lastError = err
+				return peers, err
+			}
+			for _, peerDict := range peerDicts {
 				peer := &Peer{
-					IP:   peerDict["ip"].AsString(),
-					Port: uint16(peerDict["port"].AsInt()),
+					IP:     peerDict.IP,
+					Port:   peerDict.Port,
+					Source: PeerFromTracker,
 				}
 				peers = append(peers, peer)
 			}
@@ -130,8 +147,6 @@ func (t *httpTracker) GetPeers(tor *Torrent, me *Peer) ([]*Peer, error) {
 
 	}
 
-	if lastWarning, ok := respDict["warning message"]; ok {
-		t.lastWarning = lastWarning.AsString()
-	}
+	t.lastWarning = response.WarningMessage
 	return peers, nil
 }
@@ -237,12 +237,13 @@ func (t *udpTracker) announce(tor *Torrent, me *Peer) error {
 	t.peers = make([]*Peer, 0)
 
 	readBytes = readBytes[20:]
-	for len(readBytes) > 0 {
+	for len(readBytes) >= 6 {
 		ip := net.IPv4(readBytes[0], readBytes[1], readBytes[2], readBytes[3])
 		port := uint16(readBytes[4])<<8 + uint16(readBytes[5])
 		peer := Peer{
-			IP:   ip.String(),
-			Port: port,
+			IP:     ip.String(),
+			Port:   port,
+			Source: PeerFromTracker,
 		}
 
 		t.peers = append(t.peers, &peer)
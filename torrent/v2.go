@@ -0,0 +1,272 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gtorrent/bencode"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+)
+
+// HasV1 reports whether the torrent carries v1 metadata, SHA-1 piece hashes
+// over the concatenated files.
+func (t *Torrent) HasV1() bool {
+	return len(t.Pieces) > 0 || t.MetaVersion < 2
+}
+
+// HasV2 reports whether the torrent carries BitTorrent v2 metadata (BEP 52).
+func (t *Torrent) HasV2() bool {
+	return t.MetaVersion == 2
+}
+
+// IsHybrid reports whether the torrent can be used by both v1 and v2 clients.
+func (t *Torrent) IsHybrid() bool {
+	return t.HasV2() && len(t.Pieces) > 0
+}
+
+// InfoHashV2String returns the hex encoded SHA-256 info hash of v2 and hybrid torrents.
+func (t *Torrent) InfoHashV2String() string {
+	return hex.EncodeToString(t.InfoHashV2[:])
+}
+
+// v2File is a file found in a v2 "file tree".
+type v2File struct {
+	path       []string
+	length     int64
+	piecesRoot [32]byte
+}
+
+// parseFileTree walks a v2 "file tree" dictionary. Files are leaves whose
+// only key is the empty string, and come out in key order as the spec requires.
+func parseFileTree(tree *bencode.Data, prefix []string) ([]v2File, error) {
+	if tree.Type != bencode.DICT {
+		return nil, fmt.Errorf("file tree entry %q is not a dictionary", strings.Join(prefix, "/"))
+	}
+	dict := tree.AsDict()
+	if leaf, ok := dict[""]; ok {
+		if len(dict) != 1 || leaf.Type != bencode.DICT {
+			return nil, fmt.Errorf("file tree entry %q is not a valid file", strings.Join(prefix, "/"))
+		}
+		var fileInfo struct {
+			Length     int64  `bencode:"length"`
+			PiecesRoot []byte `bencode:"pieces root"`
+		}
+		if err := bencode.UnmarshalData(leaf, &fileInfo); err != nil {
+			return nil, fmt.Errorf("file %q: %w", strings.Join(prefix, "/"), err)
+		}
+		file := v2File{path: slices.Clone(prefix), length: fileInfo.Length}
+		if fileInfo.Length > 0 {
+			if len(fileInfo.PiecesRoot) != 32 {
+				return nil, fmt.Errorf("file %q has no valid pieces root", strings.Join(prefix, "/"))
+			}
+			copy(file.piecesRoot[:], fileInfo.PiecesRoot)
+		}
+		return []v2File{file}, nil
+	}
+
+	keys := make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	files := make([]v2File, 0)
+	for _, key := range keys {
+		sub, err := parseFileTree(dict[key], append(prefix, key))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// parsePieceLayers reads the "piece layers" dictionary of the root of a v2 torrent.
+func parsePieceLayers(layers *bencode.Data) (map[[32]byte][]byte, error) {
+	if layers.Type != bencode.DICT {
+		return nil, fmt.Errorf("piece layers is not a dictionary")
+	}
+	result := make(map[[32]byte][]byte, len(layers.AsDict()))
+	for key, layer := range layers.AsDict() {
+		if len(key) != 32 || layer.Type != bencode.STRING || len(layer.AsBytes())%32 != 0 {
+			return nil, fmt.Errorf("invalid piece layer for pieces root %x", key)
+		}
+		var root [32]byte
+		copy(root[:], key)
+		result[root] = layer.AsBytes()
+	}
+	return result, nil
+}
+
+// applyV2Metadata fills in the v2 parts of torrent from the info and root dictionaries.
+// For hybrid torrents the v1 file list is kept, which includes padding files,
+// and the pieces roots are attached to it by path.
+func applyV2Metadata(torrent *Torrent, rootDict, infoDict map[string]*bencode.Data) error {
+	tree, ok := infoDict["file tree"]
+	if !ok {
+		return fmt.Errorf("v2 torrent has no file tree")
+	}
+	files, err := parseFileTree(tree, nil)
+	if err != nil {
+		return err
+	}
+
+	if layers, ok := rootDict["piece layers"]; ok {
+		torrent.PieceLayers, err = parsePieceLayers(layers)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a single file at the top of the tree is a single-file torrent, named after the file
+	singleFile := len(files) == 1 && len(files[0].path) == 1
+	if !torrent.IsHybrid() {
+		torrent.IsSingleFile = singleFile
+		torrent.FileList = make([]*File, 0, len(files))
+		torrent.Length = 0
+		for _, f := range files {
+			path := strings.Join(f.path, "/")
+			if singleFile {
+				path = torrent.Name
+			}
+			file := NewFile(f.length, path)
+			file.PiecesRoot = f.piecesRoot
+			torrent.FileList = append(torrent.FileList, file)
+			torrent.Length += f.length
+		}
+		return nil
+	}
+
+	roots := make(map[string][32]byte, len(files))
+	for _, f := range files {
+		roots[strings.Join(f.path, "/")] = f.piecesRoot
+	}
+	for _, file := range torrent.FileList {
+		key := file.Path
+		if singleFile {
+			key = files[0].path[0]
+		}
+		if root, ok := roots[key]; ok {
+			file.PiecesRoot = root
+		}
+	}
+	return nil
+}
+
+// VerifyV2 checks every file of a v2 torrent against its pieces root, and
+// against the piece layer for files larger than a piece. Like Verify, it goes
+// on after a bad or missing file, so the report covers every file. v2 pieces
+// do not span files, so the report counts them file by file and has no
+// piece states over the whole torrent. It only fails on errors in the
+// torrent or errors that say nothing about the content.
+func (l *Layout) VerifyV2() (*VerifyReport, error) {
+	tor := l.tor
+	report := &VerifyReport{Name: tor.Name, Files: make([]FileReport, 0, len(tor.FileList))}
+	for fileIndex, file := range tor.FileList {
+		if file.IsPadding() {
+			continue
+		}
+		fileReport, problem, err := l.verifyV2File(fileIndex)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Path, err)
+		}
+		if problem != "" {
+			report.problems = append(report.problems, problem)
+		}
+		report.Checked += fileReport.Good + fileReport.Bad + fileReport.Missing
+		report.Good += fileReport.Good
+		report.Bad += fileReport.Bad
+		report.Missing += fileReport.Missing
+		report.Files = append(report.Files, fileReport)
+	}
+	return report, nil
+}
+
+// verifyV2File checks the file at index i against its merkle hashes, and
+// describes what is wrong with it in problem.
+func (l *Layout) verifyV2File(i int) (report FileReport, problem string, err error) {
+	tor := l.tor
+	file := tor.FileList[i]
+	report = FileReport{Index: i, Path: file.Path, Length: file.Length, Exists: true}
+	pieces := int((file.Length + tor.PieceLength - 1) / tor.PieceLength)
+
+	if file.Length == 0 || file.PiecesRoot == [32]byte{} {
+		// empty files have nothing to check
+		if _, err := os.Lstat(l.paths[i]); err != nil {
+			report.Exists = false
+			return report, fmt.Sprintf("%s does not exist", file.Path), nil
+		}
+		report.Percent = 100
+		return report, "", nil
+	}
+
+	f, err := os.Open(l.paths[i])
+	if errors.Is(err, fs.ErrNotExist) {
+		report.Exists = false
+		report.Missing = pieces
+		return report, fmt.Sprintf("%s does not exist", file.Path), nil
+	}
+	if err != nil {
+		return report, "", err
+	}
+	layer, root, err := v2FileHashes(f, file.Length, tor.PieceLength)
+	f.Close()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		report.Missing = pieces
+		return report, fmt.Sprintf("%s is shorter than %d bytes", file.Path, file.Length), nil
+	}
+	if err != nil {
+		return report, "", err
+	}
+
+	if layer == nil {
+		// a single piece, checked against the root
+		if root != file.PiecesRoot {
+			report.Bad = 1
+			return report, fmt.Sprintf("%s does not match its pieces root", file.Path), nil
+		}
+		report.Good = 1
+		report.Percent = 100
+		return report, "", nil
+	}
+
+	expected, ok := tor.PieceLayers[file.PiecesRoot]
+	if !ok {
+		return report, "", fmt.Errorf("piece layer missing from torrent")
+	}
+	expectedLayer, err := splitHashes(expected)
+	if err != nil {
+		return report, "", err
+	}
+	if piecesRootFromLayer(expectedLayer, tor.PieceLength) != file.PiecesRoot {
+		return report, "", fmt.Errorf("piece layer does not match its pieces root")
+	}
+	if len(expectedLayer) != len(layer) {
+		return report, "", fmt.Errorf("piece layer has %d hashes, file has %d pieces", len(expectedLayer), len(layer))
+	}
+	firstBad := -1
+	var goodBytes int64
+	for p := range layer {
+		if !bytes.Equal(layer[p][:], expectedLayer[p][:]) {
+			report.Bad++
+			if firstBad < 0 {
+				firstBad = p
+			}
+			continue
+		}
+		report.Good++
+		goodBytes += min(tor.PieceLength, file.Length-int64(p)*tor.PieceLength)
+	}
+	report.Percent = float64(goodBytes) * 100 / float64(file.Length)
+	switch {
+	case report.Bad == 1:
+		problem = fmt.Sprintf("piece %d of %s is corrupted", firstBad, file.Path)
+	case report.Bad > 1:
+		problem = fmt.Sprintf("piece %d of %s is corrupted, and %d more of its pieces", firstBad, file.Path, report.Bad-1)
+	}
+	return report, problem, nil
+}
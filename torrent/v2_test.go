@@ -0,0 +1,287 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"gtorrent/bencode"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// naivePiecesRoot builds the whole merkle tree of content from its 16 KiB
+// blocks, the way BEP 52 describes it, without reusing the package helpers.
+func naivePiecesRoot(content []byte, pieceLength int) (root [32]byte, layer []byte) {
+	leaves := make([][32]byte, 0)
+	for start := 0; start < len(content); start += V2BlockSize {
+		leaves = append(leaves, sha256.Sum256(content[start:min(start+V2BlockSize, len(content))]))
+	}
+	blocksPerPiece := pieceLength / V2BlockSize
+	width := 1
+	if len(content) > pieceLength {
+		for width*blocksPerPiece < len(leaves) {
+			width *= 2
+		}
+		width *= blocksPerPiece
+	} else {
+		for width < len(leaves) {
+			width *= 2
+		}
+	}
+	for len(leaves) < width {
+		leaves = append(leaves, [32]byte{})
+	}
+
+	for nodes := 1; len(leaves) > 1; nodes *= 2 {
+		if len(content) > pieceLength && nodes == blocksPerPiece {
+			// the piece layer stops at the last piece of the file
+			pieces := (len(content) + pieceLength - 1) / pieceLength
+			for _, node := range leaves[:pieces] {
+				layer = append(layer, node[:]...)
+			}
+		}
+		parents := make([][32]byte, len(leaves)/2)
+		for i := range parents {
+			parents[i] = sha256.Sum256(append(leaves[2*i][:], leaves[2*i+1][:]...))
+		}
+		leaves = parents
+	}
+	return leaves[0], layer
+}
+
+type v2TestFile struct {
+	path    string
+	content []byte
+}
+
+// buildV2Torrent writes files into dir and returns a v2 torrent describing
+// them, with v1 metadata and padding files as well when hybrid is set.
+func buildV2Torrent(t *testing.T, dir string, files []v2TestFile, pieceLength int, hybrid bool) []byte {
+	tree := map[string]*bencode.Data{}
+	layers := map[string]*bencode.Data{}
+	v1Files := make([]*bencode.Data, 0)
+	var v1Content []byte
+	for i, file := range files {
+		fullPath := filepath.Join(dir, filepath.FromSlash(file.path))
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, file.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		root, layer := naivePiecesRoot(file.content, pieceLength)
+		node := tree
+		components := strings.Split(file.path, "/")
+		for _, component := range components[:len(components)-1] {
+			if _, ok := node[component]; !ok {
+				node[component] = bencode.NewData(map[string]*bencode.Data{})
+			}
+			node = node[component].AsDict()
+		}
+		node[components[len(components)-1]] = bencode.NewData(map[string]*bencode.Data{
+			"": bencode.NewData(map[string]*bencode.Data{
+				"length":      bencode.NewData(int64(len(file.content))),
+				"pieces root": bencode.NewData(root[:]),
+			}),
+		})
+		if layer != nil {
+			layers[string(root[:])] = bencode.NewData(layer)
+		}
+
+		v1Files = append(v1Files, v1FileEntry(int64(len(file.content)), components...))
+		v1Content = append(v1Content, file.content...)
+		if pad := len(v1Content) % pieceLength; pad != 0 && i < len(files)-1 {
+			padLength := pieceLength - pad
+			entry := v1FileEntry(int64(padLength), ".pad", "pad")
+			entry.AsDict()["attr"] = bencode.NewData("p")
+			v1Files = append(v1Files, entry)
+			v1Content = append(v1Content, make([]byte, padLength)...)
+		}
+	}
+
+	info := map[string]*bencode.Data{
+		"name":         bencode.NewData("v2test"),
+		"piece length": bencode.NewData(int64(pieceLength)),
+		"meta version": bencode.NewData(2),
+		"file tree":    bencode.NewData(tree),
+	}
+	if hybrid {
+		var pieces []byte
+		for start := 0; start < len(v1Content); start += pieceLength {
+			hash := sha1.Sum(v1Content[start:min(start+pieceLength, len(v1Content))])
+			pieces = append(pieces, hash[:]...)
+		}
+		info["files"] = bencode.NewData(v1Files)
+		info["pieces"] = bencode.NewData(pieces)
+	}
+	return bencode.Encode(bencode.NewData(map[string]*bencode.Data{
+		"info":         bencode.NewData(info),
+		"piece layers": bencode.NewData(layers),
+	}))
+}
+
+func v1FileEntry(length int64, path ...string) *bencode.Data {
+	components := make([]*bencode.Data, len(path))
+	for i, component := range path {
+		components[i] = bencode.NewData(component)
+	}
+	return bencode.NewData(map[string]*bencode.Data{
+		"length": bencode.NewData(length),
+		"path":   bencode.NewData(components),
+	})
+}
+
+func patternContent(length int, seed byte) []byte {
+	content := make([]byte, length)
+	for i := range content {
+		content[i] = byte(i*7) + seed
+	}
+	return content
+}
+
+func TestV2Torrent(t *testing.T) {
+	const pieceLength = 32 * 1024
+	files := []v2TestFile{
+		{"big.bin", patternContent(5*pieceLength+1234, 1)},
+		{"dir/small.txt", patternContent(1000, 2)},
+		{"dir/two-blocks.bin", patternContent(V2BlockSize+1, 3)},
+	}
+
+	for _, hybrid := range []bool{false, true} {
+		name := "v2"
+		if hybrid {
+			name = "hybrid"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			content := buildV2Torrent(t, dir, files, pieceLength, hybrid)
+			torrent, err := TorrentFromBytes(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !torrent.HasV2() || torrent.HasV1() != hybrid || torrent.IsHybrid() != hybrid {
+				t.Errorf("HasV1() = %v, HasV2() = %v, IsHybrid() = %v for %s torrent", torrent.HasV1(), torrent.HasV2(), torrent.IsHybrid(), name)
+			}
+			data, _, err := bencode.Decode(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			infoBytes := data.AsDict()["info"].Raw
+			if want := sha256.Sum256(infoBytes); torrent.InfoHashV2 != want {
+				t.Errorf("InfoHashV2 got = %x, want %x", torrent.InfoHashV2, want)
+			}
+			wantInfoHash := sha1.Sum(infoBytes)
+			if !hybrid {
+				copy(wantInfoHash[:], torrent.InfoHashV2[:20])
+			}
+			if torrent.InfoHash != wantInfoHash {
+				t.Errorf("InfoHash got = %x, want %x", torrent.InfoHash, wantInfoHash)
+			}
+
+			for _, file := range files {
+				root, _ := naivePiecesRoot(file.content, pieceLength)
+				found := false
+				for _, f := range torrent.FileList {
+					if f.Path == file.path {
+						found = true
+						if f.PiecesRoot != root || f.Length != int64(len(file.content)) {
+							t.Errorf("file %s got root %x length %d, want %x %d", f.Path, f.PiecesRoot, f.Length, root, len(file.content))
+						}
+					}
+				}
+				if !found {
+					t.Errorf("file %s missing from FileList", file.path)
+				}
+			}
+
+			torrentPath := filepath.Join(t.TempDir(), "v2.torrent")
+			if err := os.WriteFile(torrentPath, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyTorrent(torrentPath, dir); err != nil {
+				t.Fatalf("VerifyTorrent() error = %v", err)
+			}
+
+			// flip a byte in the fourth piece of the big file
+			corrupted := append([]byte(nil), files[0].content...)
+			corrupted[3*pieceLength+10] ^= 0xff
+			if err := os.WriteFile(filepath.Join(dir, "big.bin"), corrupted, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyTorrent(torrentPath, dir); err == nil || !strings.Contains(err.Error(), "piece 3 of big.bin") {
+				t.Errorf("VerifyTorrent() error = %v, want piece 3 of big.bin corrupted", err)
+			}
+
+			// every bad file is reported, not only the first one
+			if err := os.Remove(filepath.Join(dir, "dir", "small.txt")); err != nil {
+				t.Fatal(err)
+			}
+			layout, err := NewLayout(torrent, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := layout.VerifyV2()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Checked != 8 || report.Good != 6 || report.Bad != 1 || report.Missing != 1 {
+				t.Errorf("VerifyV2() counts got = %d checked, %d good, %d bad, %d missing", report.Checked, report.Good, report.Bad, report.Missing)
+			}
+			states := make(map[string]string)
+			for _, file := range report.Files {
+				states[file.Path] = fmt.Sprintf("%v %d/%d/%d", file.Exists, file.Good, file.Bad, file.Missing)
+			}
+			wantStates := map[string]string{"big.bin": "true 5/1/0", "dir/small.txt": "false 0/0/1", "dir/two-blocks.bin": "true 1/0/0"}
+			if !reflect.DeepEqual(states, wantStates) {
+				t.Errorf("VerifyV2() files got = %v, want %v", states, wantStates)
+			}
+			if err := report.Err(); err == nil || !strings.Contains(err.Error(), "piece 3 of big.bin") || !strings.Contains(err.Error(), "dir/small.txt does not exist") {
+				t.Errorf("Err() got = %v, want both bad files", err)
+			}
+		})
+	}
+}
+
+func TestV2SingleFileTorrent(t *testing.T) {
+	dir := t.TempDir()
+	content := buildV2Torrent(t, dir, []v2TestFile{{"v2test", patternContent(40000, 4)}}, 16*1024, false)
+	torrent, err := TorrentFromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrent.FileList) != 1 || torrent.FileList[0].Path != "v2test" || torrent.Length != 40000 {
+		t.Fatalf("FileList got = %v, want a single 40000 byte file", torrent.FileList)
+	}
+	torrentPath := filepath.Join(t.TempDir(), "single.torrent")
+	if err := os.WriteFile(torrentPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyTorrent(torrentPath, dir); err != nil {
+		t.Errorf("VerifyTorrent() error = %v", err)
+	}
+}
+
+func TestV2InvalidFileTree(t *testing.T) {
+	info := map[string]*bencode.Data{
+		"name":         bencode.NewData("broken"),
+		"piece length": bencode.NewData(16384),
+		"meta version": bencode.NewData(2),
+		"file tree": bencode.NewData(map[string]*bencode.Data{
+			"a": bencode.NewData(map[string]*bencode.Data{
+				"": bencode.NewData(map[string]*bencode.Data{
+					"length":      bencode.NewData(10),
+					"pieces root": bencode.NewData("short"),
+				}),
+			}),
+		}),
+	}
+	content := bencode.Encode(bencode.NewData(map[string]*bencode.Data{"info": bencode.NewData(info)}))
+	if _, err := TorrentFromBytes(content); err == nil {
+		t.Error("TorrentFromBytes() accepted a file with an invalid pieces root")
+	}
+}
@@ -0,0 +1,142 @@
+package torrent
+
+import (
+	"fmt"
+	"gtorrent/bencode"
+	"strings"
+)
+
+// Problem is a single issue found in the metainfo of a torrent.
+type Problem struct {
+	Field string // path of the offending key, such as "info.files[3].path", empty for the whole file
+	Msg   string
+}
+
+func (p Problem) String() string {
+	if p.Field == "" {
+		return p.Msg
+	}
+	return p.Field + ": " + p.Msg
+}
+
+// ValidationError is returned by TorrentFromBytes when the metainfo of a
+// torrent is invalid. It lists every problem found, not only the first one.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid torrent: " + e.Problems[0].String()
+	}
+	msgs := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		msgs[i] = problem.String()
+	}
+	return fmt.Sprintf("invalid torrent: %d problems: %s", len(e.Problems), strings.Join(msgs, "; "))
+}
+
+// metainfoReader reads typed values out of metainfo dictionaries. Missing
+// keys and values of the wrong type are recorded as problems instead of
+// panicking, so that parsing can go on and report everything at once.
+type metainfoReader struct {
+	problems []Problem
+}
+
+func (r *metainfoReader) addf(field, format string, args ...any) {
+	r.problems = append(r.problems, Problem{Field: field, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (r *metainfoReader) err() error {
+	if len(r.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: r.problems}
+}
+
+func typeName(t bencode.DataType) string {
+	switch t {
+	case bencode.STRING:
+		return "string"
+	case bencode.INTEGER:
+		return "integer"
+	case bencode.LIST:
+		return "list"
+	case bencode.DICT:
+		return "dictionary"
+	default:
+		return "invalid value"
+	}
+}
+
+func joinField(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// value returns dict[key] if it has type t. A missing key is a problem only when required is set.
+func (r *metainfoReader) value(dict map[string]*bencode.Data, parent, key string, t bencode.DataType, required bool) (*bencode.Data, bool) {
+	field := joinField(parent, key)
+	data, ok := dict[key]
+	if !ok || data == nil {
+		if required {
+			r.addf(field, "missing")
+		}
+		return nil, false
+	}
+	return r.check(data, field, t)
+}
+
+// check reports a problem if data does not have type t.
+func (r *metainfoReader) check(data *bencode.Data, field string, t bencode.DataType) (*bencode.Data, bool) {
+	if data.Type != t {
+		r.addf(field, "expected %s, got %s", typeName(t), typeName(data.Type))
+		return nil, false
+	}
+	return data, true
+}
+
+func (r *metainfoReader) str(dict map[string]*bencode.Data, parent, key string, required bool) (string, bool) {
+	data, ok := r.value(dict, parent, key, bencode.STRING, required)
+	if !ok {
+		return "", false
+	}
+	return data.AsString(), true
+}
+
+func (r *metainfoReader) integer(dict map[string]*bencode.Data, parent, key string, required bool) (int64, bool) {
+	data, ok := r.value(dict, parent, key, bencode.INTEGER, required)
+	if !ok {
+		return 0, false
+	}
+	return data.AsInt(), true
+}
+
+func (r *metainfoReader) list(dict map[string]*bencode.Data, parent, key string, required bool) ([]*bencode.Data, bool) {
+	data, ok := r.value(dict, parent, key, bencode.LIST, required)
+	if !ok {
+		return nil, false
+	}
+	return data.AsList(), true
+}
+
+func (r *metainfoReader) dict(dict map[string]*bencode.Data, parent, key string, required bool) (map[string]*bencode.Data, bool) {
+	data, ok := r.value(dict, parent, key, bencode.DICT, required)
+	if !ok {
+		return nil, false
+	}
+	return data.AsDict(), true
+}
+
+// strings reads a list of strings, skipping and reporting elements of other types.
+func (r *metainfoReader) strings(list []*bencode.Data, field string) []string {
+	result := make([]string, 0, len(list))
+	for i, elem := range list {
+		if _, ok := r.check(elem, fmt.Sprintf("%s[%d]", field, i), bencode.STRING); ok {
+			result = append(result, elem.AsString())
+		}
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"errors"
+	"gtorrent/bencode"
+	"reflect"
+	"testing"
+)
+
+func TestTorrentValidation(t *testing.T) {
+	d := bencode.NewData
+	type dict = map[string]*bencode.Data
+	file := func(length any, path ...string) *bencode.Data {
+		components := make([]*bencode.Data, len(path))
+		for i, component := range path {
+			components[i] = d(component)
+		}
+		return d(dict{"length": d(length), "path": d(components)})
+	}
+	validInfo := func() dict {
+		return dict{
+			"name":         d("name"),
+			"piece length": d(16384),
+			"length":       d(20000),
+			"pieces":       d(make([]byte, 40)),
+		}
+	}
+
+	tests := []struct {
+		name       string
+		root       func() dict
+		wantFields []string
+	}{
+		{
+			name:       "valid",
+			root:       func() dict { return dict{"info": d(validInfo())} },
+			wantFields: nil,
+		},
+		{
+			name:       "missing info",
+			root:       func() dict { return dict{"announce": d("http://a")} },
+			wantFields: []string{"info"},
+		},
+		{
+			name: "missing keys",
+			root: func() dict {
+				return dict{"info": d(dict{"name": d("")})}
+			},
+			wantFields: []string{"info.name", "info", "info.piece length", "info.pieces"},
+		},
+		{
+			name: "wrong types",
+			root: func() dict {
+				info := validInfo()
+				info["name"] = d(5)
+				info["length"] = d("20000")
+				return dict{"info": d(info), "announce": d(dict{}), "announce-list": d([]*bencode.Data{d("x")})}
+			},
+			wantFields: []string{"announce-list[0]", "announce", "info.name", "info.length", "info.pieces"},
+		},
+		{
+			name: "zero piece length and bad pieces",
+			root: func() dict {
+				info := validInfo()
+				info["piece length"] = d(0)
+				info["pieces"] = d(make([]byte, 30))
+				return dict{"info": d(info)}
+			},
+			wantFields: []string{"info.piece length", "info.pieces"},
+		},
+		{
+			name: "piece count",
+			root: func() dict {
+				info := validInfo()
+				info["pieces"] = d(make([]byte, 60))
+				return dict{"info": d(info)}
+			},
+			wantFields: []string{"info.pieces"},
+		},
+		{
+			name: "bad files",
+			root: func() dict {
+				info := validInfo()
+				delete(info, "length")
+				info["files"] = d([]*bencode.Data{
+					file(10000, "a", "b"),
+					file(-1, "c"),
+					file(10000, "a", "b"),
+					file(0),
+					file(0, "d", ""),
+					d("not a file"),
+				})
+				return dict{"info": d(info)}
+			},
+			wantFields: []string{
+				"info.files[1].length",
+				"info.files[2].path",
+				"info.files[3].path",
+				"info.files[4].path[1]",
+				"info.files[5]",
+			},
+		},
+		{
+			name: "both length and files",
+			root: func() dict {
+				info := validInfo()
+				info["files"] = d([]*bencode.Data{file(20000, "a")})
+				return dict{"info": d(info)}
+			},
+			wantFields: []string{"info"},
+		},
+		{
+			name: "single url-list string",
+			root: func() dict {
+				return dict{"info": d(validInfo()), "url-list": d("http://mirror/")}
+			},
+			wantFields: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor, err := TorrentFromBytes(bencode.Encode(d(tt.root())))
+			if tt.wantFields == nil {
+				if err != nil || tor == nil {
+					t.Fatalf("TorrentFromBytes() error = %v", err)
+				}
+				return
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("TorrentFromBytes() error = %v, want a *ValidationError", err)
+			}
+			fields := make([]string, len(validationErr.Problems))
+			for i, problem := range validationErr.Problems {
+				fields[i] = problem.Field
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("TorrentFromBytes() problems = %v, want fields %v", validationErr.Problems, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestTorrentValidationNotADictionary(t *testing.T) {
+	for _, content := range []string{"i42e", "le", "4:spam"} {
+		_, err := TorrentFromBytes([]byte(content))
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("TorrentFromBytes(%q) error = %v, want a *ValidationError", content, err)
+		}
+	}
+}
+
+// FuzzTorrentFromBytes checks that malformed metainfo is reported instead of panicking.
+func FuzzTorrentFromBytes(f *testing.F) {
+	f.Add([]byte("d4:infod6:lengthi20000e4:name4:name12:piece lengthi16384e6:pieces40:0123456789012345678901234567890123456789ee"))
+	f.Add([]byte("d8:announce1:a4:infod5:filesld6:lengthi1e4:pathl1:aeee4:name1:n12:piece lengthi0e6:pieces0:ee"))
+	f.Add([]byte("d4:infod9:file treed1:ad0:d6:lengthi1e11:pieces root32:01234567890123456789012345678901eee12:meta versioni2e4:name1:n12:piece lengthi16384eee"))
+	f.Fuzz(func(t *testing.T, content []byte) {
+		tor, err := TorrentFromBytes(content)
+		if err == nil && tor == nil {
+			t.Fatal("TorrentFromBytes() returned neither a torrent nor an error")
+		}
+	})
+}
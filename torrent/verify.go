@@ -0,0 +1,318 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// PieceState is the outcome of checking a single piece against its hash.
+type PieceState uint8
+
+const (
+	PieceSkipped PieceState = iota // not checked, it holds no data of the selected files
+	PieceGood
+	PieceBad
+	PieceMissing // some of its data is missing from disk
+)
+
+func (s PieceState) String() string {
+	switch s {
+	case PieceSkipped:
+		return "skipped"
+	case PieceGood:
+		return "good"
+	case PieceBad:
+		return "bad"
+	case PieceMissing:
+		return "missing"
+	default:
+		return fmt.Sprintf("PieceState(%d)", s)
+	}
+}
+
+func (s PieceState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// VerifyOptions tunes Layout.Verify.
+type VerifyOptions struct {
+	// Workers is the number of pieces hashed at once, the number of CPUs if not set.
+	Workers int
+	// Files restricts the check to the pieces of these files, given as indices
+	// in FileList. Every file is checked if empty.
+	Files []int
+	// Progress, if set, is called after each piece with the number of pieces
+	// checked so far and the number of pieces to check. It is called from the
+	// goroutine that called Verify.
+	Progress func(checked, total int)
+}
+
+// FileReport is the completion of a single file.
+type FileReport struct {
+	Index   int     `json:"index"`
+	Path    string  `json:"path"`
+	Length  int64   `json:"length"`
+	Exists  bool    `json:"exists"`
+	Good    int     `json:"good_pieces"`
+	Bad     int     `json:"bad_pieces"`
+	Missing int     `json:"missing_pieces"`
+	Percent float64 `json:"percent"` // share of the bytes of the file held by good pieces
+}
+
+// VerifyReport is the result of Layout.Verify.
+type VerifyReport struct {
+	Name    string       `json:"name"`
+	Pieces  []PieceState `json:"pieces"`
+	Checked int          `json:"checked"`
+	Good    int          `json:"good"`
+	Bad     int          `json:"bad"`
+	Missing int          `json:"missing"`
+	Files   []FileReport `json:"files"`
+
+	problems []string // what is wrong with each file, set by VerifyV2
+}
+
+// Complete reports whether every checked piece and every reported file is
+// present and intact.
+func (r *VerifyReport) Complete() bool {
+	if r.Bad > 0 || r.Missing > 0 {
+		return false
+	}
+	for _, file := range r.Files {
+		if !file.Exists {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns an error describing what is wrong with the content, nil if it is complete.
+func (r *VerifyReport) Err() error {
+	if r.Complete() {
+		return nil
+	}
+	if len(r.problems) > 0 {
+		return errors.New(strings.Join(r.problems, "; "))
+	}
+	problems := make([]string, 0, 3)
+	if r.Bad > 0 {
+		problems = append(problems, fmt.Sprintf("%d of %d pieces are corrupted, first is piece %d", r.Bad, r.Checked, r.first(PieceBad)))
+	}
+	if r.Missing > 0 {
+		problems = append(problems, fmt.Sprintf("%d of %d pieces are missing, first is piece %d", r.Missing, r.Checked, r.first(PieceMissing)))
+	}
+	for _, file := range r.Files {
+		if !file.Exists {
+			problems = append(problems, fmt.Sprintf("%s does not exist", file.Path))
+			break
+		}
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+func (r *VerifyReport) first(state PieceState) int {
+	for i, s := range r.Pieces {
+		if s == state {
+			return i
+		}
+	}
+	return -1
+}
+
+// Verify checks the content on disk against the v1 piece hashes of the
+// torrent. Pieces are hashed in parallel and reading goes on after a bad or
+// missing piece, so the report covers every piece. It only fails on errors
+// that say nothing about the content, such as a file that cannot be read.
+func (l *Layout) Verify(opts VerifyOptions) (*VerifyReport, error) {
+	tor := l.tor
+	if len(tor.Pieces) == 0 && tor.Length > 0 {
+		return nil, fmt.Errorf("torrent has no v1 piece hashes")
+	}
+	files := opts.Files
+	pieces := make([]int, 0, len(tor.Pieces))
+	if len(files) == 0 {
+		// every piece, and every file that is stored on disk
+		for i := range tor.Pieces {
+			pieces = append(pieces, i)
+		}
+		for i, file := range tor.FileList {
+			if !file.IsPadding() {
+				files = append(files, i)
+			}
+		}
+	} else {
+		wanted := make([]bool, len(tor.Pieces))
+		for _, fileIndex := range files {
+			if fileIndex < 0 || fileIndex >= len(tor.FileList) {
+				return nil, fmt.Errorf("file index %d out of range", fileIndex)
+			}
+			first, last := tor.FilePieces(fileIndex)
+			for i := first; i <= last; i++ {
+				if !wanted[i] {
+					wanted[i] = true
+					pieces = append(pieces, i)
+				}
+			}
+		}
+	}
+	report := &VerifyReport{
+		Name:   tor.Name,
+		Pieces: make([]PieceState, len(tor.Pieces)),
+		Files:  make([]FileReport, 0, len(files)),
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	work := make(chan int)
+	type result struct {
+		piece int
+		state PieceState
+		err   error
+	}
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, max(len(pieces), 1)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, tor.PieceLength)
+			for pieceIndex := range work {
+				state, err := l.checkPiece(pieceIndex, buf)
+				results <- result{pieceIndex, state, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(work)
+		for _, pieceIndex := range pieces {
+			work <- pieceIndex
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var errs []error
+	for res := range results {
+		if res.err != nil {
+			errs = append(errs, fmt.Errorf("piece %d: %w", res.piece, res.err))
+			continue
+		}
+		report.Pieces[res.piece] = res.state
+		report.Checked++
+		switch res.state {
+		case PieceGood:
+			report.Good++
+		case PieceBad:
+			report.Bad++
+		case PieceMissing:
+			report.Missing++
+		}
+		if opts.Progress != nil {
+			opts.Progress(report.Checked, len(pieces))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	for _, fileIndex := range files {
+		report.Files = append(report.Files, l.fileReport(fileIndex, report.Pieces))
+	}
+	return report, nil
+}
+
+// checkPiece reads piece i and compares it with its hash.
+func (l *Layout) checkPiece(i int, buf []byte) (PieceState, error) {
+	piece, err := l.ReadPiece(i, buf)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return PieceMissing, nil
+	}
+	if err != nil {
+		return PieceSkipped, err
+	}
+	hash := sha1.Sum(piece)
+	if !bytes.Equal(hash[:], l.tor.Pieces[i][:]) {
+		return PieceBad, nil
+	}
+	return PieceGood, nil
+}
+
+// fileReport sums up the pieces of the file at index i.
+func (l *Layout) fileReport(i int, pieces []PieceState) FileReport {
+	file := l.tor.FileList[i]
+	report := FileReport{Index: i, Path: file.Path, Length: file.Length, Exists: true}
+	if !file.IsPadding() {
+		_, err := os.Lstat(l.paths[i])
+		report.Exists = err == nil
+	}
+
+	var goodBytes int64
+	first, last := l.tor.FilePieces(i)
+	for pieceIndex := first; pieceIndex <= last; pieceIndex++ {
+		switch pieces[pieceIndex] {
+		case PieceGood:
+			report.Good++
+			for _, span := range l.tor.PieceSpans(pieceIndex) {
+				if span.FileIndex == i {
+					goodBytes += span.Length
+				}
+			}
+		case PieceBad:
+			report.Bad++
+		case PieceMissing:
+			report.Missing++
+		}
+	}
+	switch {
+	case file.Length > 0:
+		report.Percent = float64(goodBytes) * 100 / float64(file.Length)
+	case report.Exists:
+		report.Percent = 100
+	}
+	return report
+}
+
+// MatchFiles returns the indices of the files whose path matches one of the
+// patterns. A pattern matches a file if it is equal to its path, names one
+// of its directories, or matches its path as in path.Match. Every pattern has
+// to match at least one file.
+func (t *Torrent) MatchFiles(patterns []string) ([]int, error) {
+	matched := make([]bool, len(t.FileList))
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		found := false
+		for i, file := range t.FileList {
+			ok, err := path.Match(pattern, file.Path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			if ok || strings.HasPrefix(file.Path, pattern+"/") {
+				matched[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no file matches %q", pattern)
+		}
+	}
+	indices := make([]int, 0)
+	for i, ok := range matched {
+		if ok {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
@@ -0,0 +1,151 @@
+package torrent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newVerifyContent writes the content of a small multi-file torrent below dir
+// and returns its layout. With 16 KiB pieces, piece 0 covers a.bin and
+// b/c.bin, piece 4 covers b/c.bin and d.bin.
+func newVerifyContent(t *testing.T, dir string) *Layout {
+	content := filepath.Join(dir, "content")
+	files := map[string]int{"a.bin": 5000, "b/c.bin": 70000, "b/empty": 0, "d.bin": 12345}
+	for name, length := range files {
+		path := filepath.Join(content, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, patternContent(length, byte(len(name))), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	created, err := Create(CreateOptions{Path: content, PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err := TorrentFromBytes(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := NewLayout(tor, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+func TestVerify(t *testing.T) {
+	layout := newVerifyContent(t, t.TempDir())
+
+	report, err := layout.Verify(VerifyOptions{Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Complete() || report.Good != 6 || report.Err() != nil {
+		t.Fatalf("Verify() of intact content got = %+v", report)
+	}
+
+	// corrupt a.bin and remove d.bin
+	path := filepath.Join(layout.Root, "a.bin")
+	data, _ := os.ReadFile(path)
+	data[0] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(layout.Root, "d.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls, lastChecked, lastTotal int
+	report, err = layout.Verify(VerifyOptions{Progress: func(checked, total int) {
+		calls++
+		lastChecked, lastTotal = checked, total
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPieces := []PieceState{PieceBad, PieceGood, PieceGood, PieceGood, PieceMissing, PieceMissing}
+	if !reflect.DeepEqual(report.Pieces, wantPieces) {
+		t.Errorf("Verify() pieces got = %v, want %v", report.Pieces, wantPieces)
+	}
+	if report.Checked != 6 || report.Good != 3 || report.Bad != 1 || report.Missing != 2 {
+		t.Errorf("Verify() counts got = %d checked, %d good, %d bad, %d missing", report.Checked, report.Good, report.Bad, report.Missing)
+	}
+	if calls != 6 || lastChecked != 6 || lastTotal != 6 {
+		t.Errorf("Progress got %d calls, last %d/%d, want 6 calls, last 6/6", calls, lastChecked, lastTotal)
+	}
+	if err := report.Err(); err == nil || !strings.Contains(err.Error(), "first is piece 0") || !strings.Contains(err.Error(), "d.bin does not exist") {
+		t.Errorf("Err() got = %v", err)
+	}
+
+	percents := make(map[string]float64)
+	for _, file := range report.Files {
+		percents[file.Path] = file.Percent
+	}
+	wantPercents := map[string]float64{
+		"a.bin":   0,
+		"b/c.bin": float64(3*16384) * 100 / 70000,
+		"b/empty": 100,
+		"d.bin":   0,
+	}
+	if !reflect.DeepEqual(percents, wantPercents) {
+		t.Errorf("Verify() percents got = %v, want %v", percents, wantPercents)
+	}
+
+	// only the pieces of the files below b are checked
+	files, err := layout.tor.MatchFiles([]string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = layout.Verify(VerifyOptions{Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPieces = []PieceState{PieceBad, PieceGood, PieceGood, PieceGood, PieceMissing, PieceSkipped}
+	if !reflect.DeepEqual(report.Pieces, wantPieces) || len(report.Files) != 2 {
+		t.Errorf("Verify() with files got = %v and %d files, want %v and 2 files", report.Pieces, len(report.Files), wantPieces)
+	}
+
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(encoded), `"pieces":["bad","good","good","good","missing","skipped"]`) {
+		t.Errorf("json.Marshal() got = %s", encoded)
+	}
+}
+
+func TestMatchFiles(t *testing.T) {
+	tor := NewTorrent()
+	for _, path := range []string{"a.txt", "dir/b.txt", "dir/sub/c.bin", "dirx/d.txt"} {
+		tor.FileList = append(tor.FileList, NewFile(1, path))
+	}
+	tests := []struct {
+		patterns []string
+		want     []int
+		wantErr  bool
+	}{
+		{[]string{"a.txt"}, []int{0}, false},
+		{[]string{"dir"}, []int{1, 2}, false},
+		{[]string{"dir/"}, []int{1, 2}, false},
+		{[]string{"*.txt"}, []int{0}, false},
+		{[]string{"*/*.txt", "dir/sub/*"}, []int{1, 2, 3}, false},
+		{[]string{"missing"}, nil, true},
+		{[]string{"["}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := tor.MatchFiles(tt.patterns)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("MatchFiles(%q) error = %v, wantErr %v", tt.patterns, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MatchFiles(%q) got = %v, want %v", tt.patterns, got, tt.want)
+		}
+	}
+}
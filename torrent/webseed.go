@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// WebSeedURL returns the URL of the file at index i on the web seed at base
+// (BEP 19). The URL of a single-file torrent names the file itself, unless it
+// ends with a slash. The files of other torrents are found below base/name/.
+func (t *Torrent) WebSeedURL(base string, i int) string {
+	if t.IsSingleFile {
+		if strings.HasSuffix(base, "/") {
+			return base + url.PathEscape(t.Name)
+		}
+		return base
+	}
+	components := strings.Split(t.FileList[i].Path, "/")
+	for j, component := range components {
+		components[j] = url.PathEscape(component)
+	}
+	return strings.TrimSuffix(base, "/") + "/" + url.PathEscape(t.Name) + "/" + strings.Join(components, "/")
+}
+
+// WebSeed downloads pieces over HTTP from a web seed (BEP 19).
+type WebSeed struct {
+	URL    string
+	client *resty.Client
+
+	mu       sync.Mutex
+	noRanges map[string]bool // file URLs whose server ignores ranges
+}
+
+func NewWebSeed(base string) *WebSeed {
+	return &WebSeed{
+		URL:      base,
+		client:   resty.New().SetTimeout(60 * time.Second),
+		noRanges: make(map[string]bool),
+	}
+}
+
+// FetchPiece downloads piece i of tor with one range request per file the
+// piece spans. Padding files are not requested, they read as zeros. The
+// piece is not checked against its hash.
+func (w *WebSeed) FetchPiece(tor *Torrent, i int) ([]byte, error) {
+	spans := tor.PieceSpans(i)
+	if len(spans) == 0 {
+		return nil, fmt.Errorf("piece %d out of range", i)
+	}
+	piece := make([]byte, tor.PieceSize(i))
+	for _, span := range spans {
+		if tor.FileList[span.FileIndex].IsPadding() {
+			continue
+		}
+		part := piece[span.PieceOffset : span.PieceOffset+span.Length]
+		if err := w.fetchRange(tor.WebSeedURL(w.URL, span.FileIndex), span.FileOffset, part); err != nil {
+			return nil, err
+		}
+	}
+	return piece, nil
+}
+
+// fetchRange reads len(buf) bytes at offset of the file at fileURL into buf.
+// A server that ignores the range sends the whole file: its start is still
+// read, but the file is not requested from that web seed again, as every
+// piece would download all the data before it.
+func (w *WebSeed) fetchRange(fileURL string, offset int64, buf []byte) error {
+	w.mu.Lock()
+	noRanges := w.noRanges[fileURL]
+	w.mu.Unlock()
+	if noRanges {
+		return fmt.Errorf("%s: server ignores range requests", fileURL)
+	}
+
+	resp, err := w.client.R().
+		SetDoNotParseResponse(true).
+		SetHeader("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1)).
+		Get(fileURL)
+	if err != nil {
+		return err
+	}
+	body := resp.RawBody()
+	defer body.Close()
+
+	switch resp.StatusCode() {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		w.mu.Lock()
+		w.noRanges[fileURL] = true
+		w.mu.Unlock()
+		if offset > 0 {
+			return fmt.Errorf("%s: server ignores range requests", fileURL)
+		}
+	default:
+		return fmt.Errorf("%s: status code %d", fileURL, resp.StatusCode())
+	}
+	if _, err := io.ReadFull(body, buf); err != nil {
+		return fmt.Errorf("%s: %w", fileURL, err)
+	}
+	return nil
+}
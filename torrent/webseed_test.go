@@ -0,0 +1,100 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebSeedURL(t *testing.T) {
+	single := NewTorrent()
+	single.Name = "file name.iso"
+	single.IsSingleFile = true
+	single.FileList = append(single.FileList, NewFile(1, single.Name))
+
+	multi := NewTorrent()
+	multi.Name = "dir"
+	multi.FileList = append(multi.FileList, NewFile(1, "sub/a b.txt"))
+
+	tests := []struct {
+		tor  *Torrent
+		base string
+		want string
+	}{
+		{single, "http://example.com/mirror/file.iso", "http://example.com/mirror/file.iso"},
+		{single, "http://example.com/mirror/", "http://example.com/mirror/file%20name.iso"},
+		{multi, "http://example.com/mirror", "http://example.com/mirror/dir/sub/a%20b.txt"},
+		{multi, "http://example.com/mirror/", "http://example.com/mirror/dir/sub/a%20b.txt"},
+	}
+	for _, tt := range tests {
+		if got := tt.tor.WebSeedURL(tt.base, 0); got != tt.want {
+			t.Errorf("WebSeedURL(%q) got = %v, want %v", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestWebSeedFetchPiece(t *testing.T) {
+	dir := t.TempDir()
+	layout := newVerifyContent(t, dir)
+	tor := layout.tor
+
+	files := http.StripPrefix("/seed/", http.FileServer(http.Dir(dir)))
+	mux := http.NewServeMux()
+	mux.Handle("/seed/", files)
+	noRangeRequests := 0
+	mux.HandleFunc("/norange/", func(w http.ResponseWriter, r *http.Request) {
+		// a server that ignores ranges and always sends the whole file
+		noRangeRequests++
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(r.URL.Path[len("/norange/"):])))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	webSeed := NewWebSeed(server.URL + "/seed/")
+	for i := range tor.Pieces {
+		piece, err := webSeed.FetchPiece(tor, i)
+		if err != nil {
+			t.Fatalf("FetchPiece(%d) error = %v", i, err)
+		}
+		hash := sha1.Sum(piece)
+		if !bytes.Equal(hash[:], tor.Pieces[i][:]) {
+			t.Errorf("FetchPiece(%d) does not match its hash", i)
+		}
+		want, _ := layout.ReadPiece(i, make([]byte, tor.PieceLength))
+		if !bytes.Equal(piece, want) {
+			t.Errorf("FetchPiece(%d) got different data than on disk", i)
+		}
+	}
+
+	// piece 0 starts both a.bin and b/c.bin, the next pieces are further
+	// into b/c.bin and are not asked for again once the range was ignored
+	noRange := NewWebSeed(server.URL + "/norange")
+	piece, err := noRange.FetchPiece(tor, 0)
+	if err != nil {
+		t.Fatalf("FetchPiece(0) from a server without ranges error = %v", err)
+	}
+	if hash := sha1.Sum(piece); !bytes.Equal(hash[:], tor.Pieces[0][:]) {
+		t.Errorf("FetchPiece(0) from a server without ranges does not match its hash")
+	}
+	for i := 1; i < 3; i++ {
+		if _, err := noRange.FetchPiece(tor, i); err == nil {
+			t.Errorf("FetchPiece(%d) from a server without ranges got no error", i)
+		}
+	}
+	if noRangeRequests != 2 {
+		t.Errorf("server without ranges got %d requests, want 2", noRangeRequests)
+	}
+
+	if _, err := NewWebSeed(server.URL+"/missing/").FetchPiece(tor, 0); err == nil {
+		t.Errorf("FetchPiece() from a web seed without the files got no error")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gtorrent/torrent"
+	"os"
+)
+
+// verifyContent checks the content below contentPath against the torrent file
+// at path and prints a report, as JSON if asJSON is set. With patterns only
+// the files matching them are checked. With repair the bad and missing
+// pieces are downloaded again before the report is printed. It returns an
+// error when a checked piece or file is bad or missing.
+func verifyContent(path, contentPath string, patterns []string, asJSON, repair bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tor, err := torrent.TorrentFromBytes(content)
+	if err != nil {
+		return err
+	}
+	layout, err := torrent.NewLayout(tor, contentPath)
+	if err != nil {
+		return err
+	}
+	if !tor.HasV1() {
+		// v2-only torrents have no piece hashes over the whole content, so
+		// they are checked file by file
+		if len(patterns) > 0 || repair {
+			return fmt.Errorf("--files and --repair need a torrent with v1 piece hashes")
+		}
+		report, err := layout.VerifyV2()
+		if err != nil {
+			return err
+		}
+		return printReport(report, asJSON)
+	}
+	opts := torrent.VerifyOptions{}
+	if len(patterns) > 0 {
+		if opts.Files, err = tor.MatchFiles(patterns); err != nil {
+			return err
+		}
+	}
+	if !asJSON {
+		lastPercent := -1
+		opts.Progress = func(checked, total int) {
+			if percent := checked * 100 / total; percent != lastPercent {
+				lastPercent = percent
+				fmt.Fprintf(os.Stderr, "\rChecking %d pieces: %d%%", total, percent)
+			}
+			if checked == total {
+				fmt.Fprintln(os.Stderr)
+			}
+		}
+	}
+	report, err := layout.Verify(opts)
+	if err != nil {
+		return err
+	}
+	if repair && !report.Complete() {
+		if err := repairContent(path, tor, contentPath, report); err != nil {
+			return err
+		}
+		if report, err = layout.Verify(opts); err != nil {
+			return err
+		}
+	}
+
+	return printReport(report, asJSON)
+}
+
+// printReport prints report, as JSON if asJSON is set, and returns an error
+// when a checked piece or file is bad or missing.
+func printReport(report *torrent.VerifyReport, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%s: %d pieces checked, %d good, %d bad, %d missing\n", report.Name, report.Checked, report.Good, report.Bad, report.Missing)
+		for _, file := range report.Files {
+			status := ""
+			if !file.Exists {
+				status = " (missing)"
+			}
+			fmt.Printf("  %6.2f%%  %s%s\n", file.Percent, file.Path, status)
+		}
+	}
+	return report.Err()
+}